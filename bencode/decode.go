@@ -29,6 +29,10 @@ func Decode(data []byte, info interface{}) error {
 // (int, string, list, or dictionary) and returns the decoded value, the number of bytes read
 // and any error encountered.
 func doDecode(data []byte) (interface{}, int, error) {
+	if len(data) == 0 {
+		return nil, 0, fmt.Errorf("Error: Unexpected end of data")
+	}
+
 	switch firstChar := data[0]; {
 	case firstChar == 'i':
 		return decodeInteger(data)
@@ -47,6 +51,10 @@ func doDecode(data []byte) (interface{}, int, error) {
 // and return the decoded integer, the number of bytes read, and any error encountered.
 // E.g. "i42e" -> 42
 func decodeInteger(data []byte) (int, int, error) {
+	if len(data) < 2 {
+		return 0, 0, missingTerminatorError("integer")
+	}
+
 	i := 0
 	if data[1] == '-' {
 		i = 1
@@ -103,6 +111,10 @@ func decodeString(data []byte) (string, int, error) {
 		return "", 0, err
 	}
 
+	if decodedStrLength > len(data)-end-1 {
+		return "", 0, fmt.Errorf("Error: Encoded string is longer than the data, %v", decodedStrLength)
+	}
+
 	decodedStr := string(data[end+1 : end+1+decodedStrLength])
 
 	return decodedStr, end + decodedStrLength + 1, nil
@@ -80,12 +80,6 @@ func TestValidStringDecode(t *testing.T) {
 }
 
 func TestInvalidStringDecode(t *testing.T) {
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("Expected code to panic, got none")
-		}
-	}()
-
 	var invalidStrings = [][]byte{
 		[]byte("4spam"), // missing colon
 		[]byte("3:ab"),  // length shorter than actual string
@@ -203,3 +197,23 @@ func TestInvalidDecodeFormat(t *testing.T) {
 		t.Errorf("Expected error encoding invalid value x4:spam, but got none")
 	}
 }
+
+func TestTruncatedDecode(t *testing.T) {
+	var truncatedData = [][]byte{
+		[]byte(""),           // no data
+		[]byte("i"),          // integer without digits
+		[]byte("d"),          // dictionary without keys
+		[]byte("d3:foo"),     // key without value
+		[]byte("d3:fooi"),    // truncated integer value
+		[]byte("d3:foo3:ba"), // truncated string value
+		[]byte("l4:sp"),      // truncated list element
+	}
+
+	// Decode is given data received from peers, trackers and DHT nodes, which must not make it panic
+	for _, data := range truncatedData {
+		var decoded map[string]interface{}
+		if err := Decode(data, &decoded); err == nil {
+			t.Errorf("Expected error decoding truncated data %q, but got none", data)
+		}
+	}
+}
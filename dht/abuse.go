@@ -0,0 +1,265 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits that protect the node from hostile nodes.
+const (
+	// DefaultQueryRate is the number of queries per second a single IP may send us by default. Nodes may send
+	// five seconds worth of queries at once, such as during a lookup, before they are limited.
+	DefaultQueryRate = 5
+	queryBurst       = 5
+
+	// Number of IPs whose query rate is tracked, so that queries from spoofed IPs cannot use up our memory.
+	// Once full, queries from IPs that are not tracked are dropped.
+	maxRateLimitedIPs = 10000
+
+	// How long a node that sent us malformed or bogus data is ignored, and the number of IPs that can be
+	// blacklisted at once.
+	blacklistDuration = time.Hour
+	maxBlacklistedIPs = 10000
+)
+
+var (
+	errBlacklisted    = errors.New("DHT node is blacklisted")
+	errMartianAddress = errors.New("DHT node is at an address that is not routable on the internet")
+	errMalformedResp  = errors.New("Malformed DHT response")
+	errBogusItem      = errors.New("DHT node sent an item that does not match the target")
+)
+
+// Address ranges that are not routable on the internet, on top of the loopback, private, link local and multicast
+// ranges the net package knows of. Nodes and peers in these ranges are ignored by public nodes.
+var martianNets = parseCIDRs(
+	"0.0.0.0/8",       // This network
+	"100.64.0.0/10",   // Carrier grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // Documentation
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // Documentation
+	"203.0.113.0/24",  // Documentation
+	"240.0.0.0/4",     // Reserved, including the broadcast address
+	"100::/64",        // Discard only
+	"2001:db8::/32",   // Documentation
+)
+
+// rateLimiter limits the number of queries every IP may send us with a token bucket per IP.
+type rateLimiter struct {
+	rate int
+
+	mu      sync.Mutex
+	buckets map[string]*queryBucket
+}
+
+// queryBucket holds the queries an IP may still send, refilled at the rate of the limiter.
+type queryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// blacklist holds the IPs of nodes that sent us malformed or bogus data until they are forgiven.
+type blacklist struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		buckets: make(map[string]*queryBucket),
+	}
+}
+
+// allow takes a query from the IP's bucket. Queries from the loopback interface are not limited, since they come
+// from our own host.
+//
+// It returns true if the query should be answered, or false if the IP has sent too many queries.
+func (l *rateLimiter) allow(ip net.IP, now time.Time) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.rate * queryBurst)
+	b, ok := l.buckets[ip.String()]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitedIPs {
+			l.expireLocked(now)
+		}
+		if len(l.buckets) >= maxRateLimitedIPs {
+			return false
+		}
+
+		b = &queryBucket{tokens: burst, last: now}
+		l.buckets[ip.String()] = b
+	}
+
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*float64(l.rate))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// expire forgets the IPs whose bucket has refilled, since they are no longer limited.
+func (l *rateLimiter) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.expireLocked(now)
+}
+
+// expireLocked forgets the IPs whose bucket has refilled. The caller must hold l.mu.
+func (l *rateLimiter) expireLocked(now time.Time) {
+	burst := float64(l.rate * queryBurst)
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*float64(l.rate) >= burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// add blacklists the IP until the blacklist duration has passed. IPs are dropped once the blacklist is full.
+func (b *blacklist) add(ip net.IP, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.until == nil {
+		b.until = make(map[string]time.Time)
+	}
+
+	if _, ok := b.until[ip.String()]; !ok && len(b.until) >= maxBlacklistedIPs {
+		return
+	}
+
+	b.until[ip.String()] = now.Add(blacklistDuration)
+}
+
+// contains reports whether the IP is blacklisted.
+func (b *blacklist) contains(ip net.IP, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.until[ip.String()]
+
+	return ok && now.Before(until)
+}
+
+// expire forgives the IPs whose blacklisting has passed.
+func (b *blacklist) expire(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ip, until := range b.until {
+		if !now.Before(until) {
+			delete(b.until, ip)
+		}
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// reachable reports whether we talk to nodes and peers at the IP. Public nodes ignore IPs that are not routable on
+// the internet, so that hostile nodes cannot point our queries or our peers at our local network.
+func (s *Server) reachable(ip net.IP) bool {
+	return !s.cfg.Public || !isMartian(ip)
+}
+
+// blacklistNode ignores the node for the blacklist duration and removes it from the routing table,
+// after it sent us malformed or bogus data.
+func (s *Server) blacklistNode(node compactNode) {
+	s.blacklist.add(node.addr.IP, s.cfg.Clock.Now())
+	s.table.remove(node.addr.IP)
+}
+
+// validResponse checks the fields of a response are well formed, so that a hostile node cannot crash or
+// poison our lookups with them.
+//
+// It returns an error describing the first malformed field, or nil if the response is well formed.
+func validResponse(resp dhtResp) error {
+	switch {
+	case len(resp.Id) != 20:
+		return fmt.Errorf("%w, invalid node id", errMalformedResp)
+	case len(resp.Nodes)%compactNodeLenV4 != 0:
+		return fmt.Errorf("%w, invalid nodes", errMalformedResp)
+	case len(resp.Nodes6)%compactNodeLenV6 != 0:
+		return fmt.Errorf("%w, invalid nodes6", errMalformedResp)
+	case len(resp.Samples)%20 != 0:
+		return fmt.Errorf("%w, invalid info hash samples", errMalformedResp)
+	case (resp.BFsd != "" && len(resp.BFsd) != bloomFilterLen) || (resp.BFpe != "" && len(resp.BFpe) != bloomFilterLen):
+		return fmt.Errorf("%w, invalid bloom filter", errMalformedResp)
+	}
+
+	for _, peer := range resp.Values {
+		if len(peer) != compactPeerLenV4 && len(peer) != compactPeerLenV6 {
+			return fmt.Errorf("%w, invalid peer in values", errMalformedResp)
+		}
+	}
+
+	return nil
+}
+
+// nodesOf returns the IPv4 and IPv6 nodes of a response, leaving out nodes we do not talk to and nodes without
+// a port, which a well behaved node never sends.
+func (s *Server) nodesOf(resp dhtResp) []compactNode {
+	var nodes []compactNode
+	for _, node := range append(parseCompactNodes(resp.Nodes, compactNodeLenV4), parseCompactNodes(resp.Nodes6, compactNodeLenV6)...) {
+		if node.addr.Port != 0 && s.reachable(node.addr.IP) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// valuesOf returns the peers of a get_peers response, leaving out peers we do not connect to.
+func (s *Server) valuesOf(resp dhtResp) []net.TCPAddr {
+	var peers []net.TCPAddr
+	for _, value := range resp.Values {
+		peer := parseCompactPeerInfo(value)
+		if peer.Port != 0 && s.reachable(peer.IP) {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// isMartian reports whether the IP is not routable on the internet.
+func isMartian(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, network := range martianNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCIDRs parses the networks in CIDR notation, panicking if one is invalid.
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks
+}
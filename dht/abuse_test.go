@@ -0,0 +1,211 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+	"github.com/anthony/BT/dht/simnet"
+)
+
+// respondWith answers every query received on the connection with the given response arguments.
+func respondWith(conn net.PacketConn, resp map[string]interface{}) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var query krpcQuery
+		if bencode.Decode(buf[:n], &query) != nil || query.Y != "q" {
+			continue
+		}
+
+		data, _ := bencode.Encode(map[string]interface{}{"t": query.T, "y": "r", "r": resp})
+		conn.WriteTo(data, addr)
+	}
+}
+
+// startSimNode starts a DHT node listening at the address of the simulated network.
+func startSimNode(t *testing.T, network *simnet.Network, addr string, cfg Config) *Server {
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+
+	pc, err := network.ListenPacket("udp4", addr)
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+
+	go s.Serve(pc)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// sendPings sends pings from the connection to the node, and counts the responses received until a read times out.
+// Queries the node sends us of its own accord, such as while bootstrapping, are not counted.
+func sendPings(t *testing.T, conn net.PacketConn, to net.Addr, n int) int {
+	for range n {
+		data, _ := bencode.Encode(map[string]interface{}{
+			"t": "tx",
+			"y": "q",
+			"q": "ping",
+			"a": map[string]interface{}{"id": strings.Repeat("a", 20)},
+		})
+		if _, err := conn.WriteTo(data, to); err != nil {
+			t.Fatalf("Unexpected error sending ping: %v", err)
+		}
+	}
+
+	responses := 0
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return responses
+		}
+
+		var header krpcHeader
+		if bencode.Decode(buf[:n], &header) == nil && header.Y == "r" && header.T == "tx" {
+			responses++
+		}
+	}
+}
+
+func TestMalformedResponseBlacklistsNode(t *testing.T) {
+	s, _ := startLocalNode(t, Config{})
+
+	hostile, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	defer hostile.Close()
+
+	// A single node entry that is one byte short
+	go respondWith(hostile, map[string]interface{}{
+		"id":    strings.Repeat("h", 20),
+		"nodes": strings.Repeat("n", compactNodeLenV4-1),
+	})
+
+	node := compactNode{addr: *hostile.LocalAddr().(*net.UDPAddr)}
+	if _, err := s.findNode(node, [20]byte{}); !errors.Is(err, errMalformedResp) {
+		t.Fatalf("Expected malformed response error, got %v", err)
+	}
+
+	if _, err := s.findNode(node, [20]byte{}); !errors.Is(err, errBlacklisted) {
+		t.Errorf("Expected blacklisted node not to be queried again, got %v", err)
+	}
+
+	if s.table.Len() != 0 {
+		t.Errorf("Expected blacklisted node to stay out of the routing table, got %d nodes", s.table.Len())
+	}
+
+	// Queries from the blacklisted node are ignored as well
+	if responses := sendPings(t, hostile, s.conns[familyIPv4].LocalAddr(), 1); responses != 0 {
+		t.Errorf("Expected no response to a blacklisted node, got %d", responses)
+	}
+}
+
+func TestQueryRateLimit(t *testing.T) {
+	network := simnet.NewNetwork(simnet.Config{})
+	clock := simnet.NewClock(time.Now())
+
+	startSimNode(t, network, "10.0.0.1:6881", Config{QueryRate: 2, Clock: clock})
+
+	conn, err := network.ListenPacket("udp4", "10.0.0.2:6881")
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+	defer conn.Close()
+
+	nodeAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	if responses := sendPings(t, conn, nodeAddr, 20); responses != 2*queryBurst {
+		t.Errorf("Expected %d queries to be answered in a burst, got %d", 2*queryBurst, responses)
+	}
+
+	// The allowance refills at the query rate
+	clock.Advance(time.Second)
+	if responses := sendPings(t, conn, nodeAddr, 20); responses != 2 {
+		t.Errorf("Expected 2 queries to be answered a second later, got %d", responses)
+	}
+}
+
+func TestPublicNodeIgnoresMartians(t *testing.T) {
+	network := simnet.NewNetwork(simnet.Config{})
+
+	s := startSimNode(t, network, "1.0.0.1:6881", Config{Public: true})
+
+	nodeAddr := &net.UDPAddr{IP: net.IPv4(1, 0, 0, 1), Port: 6881}
+	for _, test := range []struct {
+		addr     string
+		answered bool
+	}{
+		{"1.0.0.2:6881", true},
+		{"10.0.0.2:6881", false},
+		{"192.0.2.1:6881", false},
+	} {
+		conn, err := network.ListenPacket("udp4", test.addr)
+		if err != nil {
+			t.Fatalf("Unexpected error listening: %v", err)
+		}
+
+		if answered := sendPings(t, conn, nodeAddr, 1) == 1; answered != test.answered {
+			t.Errorf("Expected query from %s to be answered: %t, got %t", test.addr, test.answered, answered)
+		}
+		conn.Close()
+	}
+
+	// Nodes and peers at martian addresses are left out of responses
+	nodes := s.nodesOf(dhtResp{Nodes: string(encodeCompactNodeInfo(compactNode{
+		id:   strings.Repeat("a", 20),
+		addr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881},
+	})) + string(encodeCompactNodeInfo(compactNode{
+		id:   strings.Repeat("b", 20),
+		addr: net.UDPAddr{IP: net.IPv4(1, 0, 0, 3), Port: 6881},
+	}))})
+	if len(nodes) != 1 || nodes[0].addr.String() != "1.0.0.3:6881" {
+		t.Errorf("Expected only the public node, got %v", nodes)
+	}
+
+	peers := s.valuesOf(dhtResp{Values: []string{
+		string(encodeCompactPeerInfo(net.TCPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 6881})),
+		string(encodeCompactPeerInfo(net.TCPAddr{IP: net.IPv4(1, 0, 0, 4), Port: 6881})),
+	}})
+	if len(peers) != 1 || peers[0].String() != "1.0.0.4:6881" {
+		t.Errorf("Expected only the public peer, got %v", peers)
+	}
+}
+
+func TestIsMartian(t *testing.T) {
+	tests := map[string]bool{
+		"1.1.1.1":         false,
+		"2606:4700::1111": false,
+		"0.0.0.0":         true,
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.1.1":     true,
+		"100.64.0.1":      true,
+		"203.0.113.5":     true,
+		"224.0.0.1":       true,
+		"255.255.255.255": true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"2001:db8::1":     true,
+	}
+
+	for ip, martian := range tests {
+		if got := isMartian(net.ParseIP(ip)); got != martian {
+			t.Errorf("Expected isMartian(%s) to be %t, got %t", ip, martian, got)
+		}
+	}
+}
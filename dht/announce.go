@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// How often an active torrent is announced again. Nodes forget announced peers after about 30 minutes,
+// so re-announcing well within that keeps us findable.
+const announceInterval = 15 * time.Minute
+
+// Announce looks up peers for the info hash, then announces to the K closest nodes that responded that we are a peer
+// listening on the given port, so that other peers can find us. A port of zero announces the port of the DHT node's
+// socket instead, for peers behind a NAT that only know their external port from the source port of their queries.
+//
+// It returns the peers found, or an error if the lookup failed or no node accepted the announce.
+func (s *Server) Announce(infoHash [20]byte, port int) ([]net.TCPAddr, error) {
+	return s.announce(infoHash, port, false)
+}
+
+// AnnounceSeed announces like Announce, but tells the nodes that we are a seed, so that scrapes count us as one as
+// specified in BEP 33. Only peers that are not seeds are looked up, since seeds have nothing to download from each other.
+//
+// It returns the peers found, or an error if the lookup failed or no node accepted the announce.
+func (s *Server) AnnounceSeed(infoHash [20]byte, port int) ([]net.TCPAddr, error) {
+	return s.announce(infoHash, port, true)
+}
+
+// KeepAnnounced announces the info hash every 15 minutes until done is closed, so that we stay findable while the
+// torrent is active. The peers found by every announce are passed to found, if it is not nil.
+func (s *Server) KeepAnnounced(infoHash [20]byte, port int, done <-chan struct{}, found func(peers []net.TCPAddr)) {
+	ticks, stop := s.cfg.Clock.NewTicker(announceInterval)
+	defer stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.done:
+			return
+		case <-ticks:
+			peers, _ := s.Announce(infoHash, port)
+			if found != nil && len(peers) > 0 {
+				found(peers)
+			}
+		}
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// announce looks up peers for the info hash, leaving out seeds if we are a seed, then announces to the K closest
+// nodes that responded with a token.
+//
+// It returns the peers found, or an error if the lookup failed or no node accepted the announce.
+func (s *Server) announce(infoHash [20]byte, port int, seed bool) ([]net.TCPAddr, error) {
+	results, closest, err := s.lookup(infoHash, s.getPeersQuery(infoHash, false, seed))
+	if err != nil {
+		return nil, err
+	}
+	peers := peersOf(results)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for _, target := range closest {
+		if target.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := s.announcePeer(target.node, infoHash, port, seed, target.token); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted == 0 {
+		return peers, fmt.Errorf("No DHT node accepted the announce")
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/anthony/BT/bencode"
+)
+
+func TestAnnounceIsFoundByOtherPeers(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	storer, storerAddr := startLocalNode(t, Config{})
+
+	announcer, announcerAddr := startLocalNode(t, Config{})
+	announcer.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	if _, err := announcer.Announce(infoHash, 7000); err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	// An implied port announces the port of the announcer's DHT socket instead
+	other := [20]byte{4, 5, 6}
+	if _, err := announcer.Announce(other, 0); err != nil {
+		t.Fatalf("Unexpected error announcing with implied port: %v", err)
+	}
+
+	seeker, _ := startLocalNode(t, Config{})
+	seeker.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	peers, err := seeker.GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error getting peers: %v", err)
+	}
+
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:7000" {
+		t.Errorf("Expected announced peer 127.0.0.1:7000, got %v", peers)
+	}
+
+	peers, _ = seeker.GetPeers(other)
+	if len(peers) != 1 || peers[0].Port != announcerAddr.Port {
+		t.Errorf("Expected announced peer on port %d, got %v", announcerAddr.Port, peers)
+	}
+}
+
+func TestAnnounceOverIPv6(t *testing.T) {
+	storer, storerAddr := startDualStackNode(t)
+	announcer, _ := startDualStackNode(t)
+	seeker, _ := startDualStackNode(t)
+
+	// The announcer only knows the storer over IPv6
+	announcer.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	infoHash := [20]byte{7, 8, 9}
+	if _, err := announcer.Announce(infoHash, 7000); err != nil {
+		t.Fatalf("Unexpected error announcing over IPv6: %v", err)
+	}
+
+	nodes, err := seeker.findNode(compactNode{addr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: storer.localPort(familyIPv4)}}, infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error finding nodes: %v", err)
+	}
+	// The seeker only knows the storer over IPv4, and learns of IPv6 nodes through `nodes6`
+	seeker.pingAll(nodes)
+
+	if seeker.table.familyLen(familyIPv6) != 1 {
+		t.Fatalf("Expected the IPv6 node from nodes6 in the routing table, got %d nodes", seeker.table.familyLen(familyIPv6))
+	}
+
+	peers, err := seeker.GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error getting peers: %v", err)
+	}
+
+	if len(peers) != 1 || peers[0].String() != "[::1]:7000" {
+		t.Errorf("Expected announced peer [::1]:7000, got %v", peers)
+	}
+}
+
+// startDualStackNode starts a DHT node serving on local IPv4 and IPv6 UDP ports, skipping the test if the host
+// does not support IPv6.
+func startDualStackNode(t *testing.T) (*Server, net.UDPAddr) {
+	pc6, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not supported: %v", err)
+	}
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+
+	s, err := NewServer(Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+
+	go s.Serve(pc, pc6)
+	t.Cleanup(func() { s.Close() })
+
+	// Wait for the node to start serving, so that its sockets are known
+	s.families()
+
+	return s, *pc6.LocalAddr().(*net.UDPAddr)
+}
+
+func TestGetPeersKeepsResponsesWithoutToken(t *testing.T) {
+	node, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	defer node.Close()
+
+	// The node returns peers without a token, so it cannot be announced to
+	nodeId := string(make([]byte, 20))
+	var announces int32
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := node.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query struct {
+				T string `mapstructure:"t"`
+				Q string `mapstructure:"q"`
+			}
+			bencode.Decode(buf[:n], &query)
+			if query.Q == "announce_peer" {
+				atomic.AddInt32(&announces, 1)
+			}
+
+			resp, _ := bencode.Encode(map[string]interface{}{
+				"t": query.T,
+				"y": "r",
+				"r": map[string]interface{}{
+					"id":     nodeId,
+					"values": []interface{}{"\x7f\x00\x00\x01\x1b\x58"},
+				},
+			})
+			node.WriteTo(resp, addr)
+		}
+	}()
+
+	seeker, _ := startLocalNode(t, Config{})
+	seeker.table.responded(compactNode{id: nodeId, addr: *node.LocalAddr().(*net.UDPAddr)})
+
+	peers, err := seeker.Announce([20]byte{1}, 7001)
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:7000" {
+		t.Errorf("Expected peer 127.0.0.1:7000 from the node without a token, got %v", peers)
+	}
+	if err == nil || atomic.LoadInt32(&announces) != 0 {
+		t.Errorf("Expected the node without a token not to be announced to, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"math"
+	"net"
+)
+
+// Parameters of the bloom filters of seeds and peers returned to scrapes, as specified in BEP 33.
+const (
+	bloomFilterBits   = 2048
+	bloomFilterLen    = bloomFilterBits / 8
+	bloomFilterHashes = 2
+)
+
+// bloomFilter is a set of peer IPs as specified in BEP 33. The size of the set is estimated from the number of bits
+// that are not set, so the filters of several nodes can be merged into a single estimate of the swarm size without
+// counting peers that announced to more than one node twice.
+type bloomFilter [bloomFilterLen]byte
+
+// add inserts the IP into the filter. IPv4 addresses are hashed in their 4 byte form and IPv6 addresses in their
+// 16 byte form.
+func (f *bloomFilter) add(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	hash := sha1.Sum(ip)
+	index1 := (int(hash[0]) | int(hash[1])<<8) % bloomFilterBits
+	index2 := (int(hash[2]) | int(hash[3])<<8) % bloomFilterBits
+
+	f[index1/8] |= 1 << (index1 % 8)
+	f[index2/8] |= 1 << (index2 % 8)
+}
+
+// merge sets every bit that is set in the other filter, so that the filter holds the union of both sets.
+func (f *bloomFilter) merge(other bloomFilter) {
+	for i := range f {
+		f[i] |= other[i]
+	}
+}
+
+// estimate returns the estimated number of IPs in the filter. A full filter is estimated as if a single bit was
+// not set, which is the largest size the filter can tell apart.
+func (f *bloomFilter) estimate() int {
+	zeros := 0
+	for _, b := range f {
+		for bit := range 8 {
+			if b&(1<<bit) == 0 {
+				zeros++
+			}
+		}
+	}
+	zeros = max(zeros, 1)
+
+	m := float64(bloomFilterBits)
+	size := math.Log(float64(zeros)/m) / (bloomFilterHashes * math.Log(1-1/m))
+
+	return int(math.Round(size))
+}
+
+// parseBloomFilter returns the bloom filter in a BFsd or BFpe field of a get_peers response.
+//
+// It returns the filter, or false if the field does not hold a filter.
+func parseBloomFilter(data string) (bloomFilter, bool) {
+	var f bloomFilter
+	if len(data) != bloomFilterLen {
+		return f, false
+	}
+
+	copy(f[:], data)
+
+	return f, true
+}
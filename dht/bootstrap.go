@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// DefaultBootstrapNodes are well known routers that answer find_node queries, used to join the DHT when the routing
+// table has no nodes yet.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"dht.libtorrent.org:25401",
+}
+
+// Bootstrap joins the IPv4 and IPv6 DHTs by asking the configured routers and the nodes already in the routing table,
+// such as nodes restored from the state file, for the nodes closest to our own id. An iterative find_node on our own
+// id is then used to fill the routing table as specified in BEP 5. Routers are only used as starting points and are
+// never added to the routing table, so that they are not overloaded with queries.
+//
+// It returns an error if the routing table is still empty afterwards.
+func (s *Server) Bootstrap() error {
+	self := idToTarget(s.table.id())
+
+	var wg sync.WaitGroup
+	for _, addr := range s.resolveNodes(s.cfg.BootstrapNodes) {
+		s.mu.Lock()
+		s.routers[addr.String()] = true
+		s.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			nodes, err := s.findNode(compactNode{addr: addr}, self)
+			if err != nil {
+				return
+			}
+
+			// Only nodes that respond are added to the routing table
+			s.pingAll(nodes)
+		}()
+	}
+	wg.Wait()
+
+	for _, family := range s.families() {
+		s.findNodes(self, family)
+	}
+
+	if s.table.Len() == 0 {
+		return fmt.Errorf("Could not bootstrap the DHT, no nodes responded")
+	}
+
+	return nil
+}
+
+// AddNodes pings the nodes at the given addresses, such as the `nodes` of a torrent file or the DHT ports of connected
+// peers, adding the nodes that respond to the routing table. Addresses are given as host:port pairs.
+func (s *Server) AddNodes(addrs []string) {
+	var nodes []compactNode
+	for _, addr := range s.resolveNodes(addrs) {
+		nodes = append(nodes, compactNode{addr: addr})
+	}
+
+	s.pingAll(nodes)
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// pingAll pings the nodes concurrently and waits for every ping to finish.
+func (s *Server) pingAll(nodes []compactNode) {
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.query(node, "ping", map[string]interface{}{})
+		}()
+	}
+
+	wg.Wait()
+}
+
+// resolveNodes resolves the addresses of the given host:port pairs in every address family the node has a socket for,
+// skipping any that cannot be resolved.
+func (s *Server) resolveNodes(hostPorts []string) []net.UDPAddr {
+	var hasFamily [numFamilies]bool
+	for _, family := range s.families() {
+		hasFamily[family] = true
+	}
+
+	var addrs []net.UDPAddr
+	for _, hostPort := range hostPorts {
+		host, portStr, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			continue
+		}
+
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 || port > 65535 {
+			continue
+		}
+
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			if ips, err = net.LookupIP(host); err != nil {
+				continue
+			}
+		}
+
+		for _, ip := range ips {
+			if hasFamily[familyOf(ip)] {
+				addrs = append(addrs, net.UDPAddr{IP: ip, Port: port})
+			}
+		}
+	}
+
+	return addrs
+}
+
+// isRouter reports whether the address belongs to one of the bootstrap routers.
+func (s *Server) isRouter(addr net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.routers[addr.String()]
+}
@@ -0,0 +1,31 @@
+package dht
+
+import (
+	"testing"
+)
+
+func TestBootstrapFromRouter(t *testing.T) {
+	router, routerAddr := startLocalNode(t, Config{})
+	node, nodeAddr := startLocalNode(t, Config{})
+
+	// The router knows of a single node, which the new node should find and add to its routing table
+	router.table.responded(compactNode{id: node.table.selfId, addr: nodeAddr})
+
+	s, _ := startLocalNode(t, Config{BootstrapNodes: []string{routerAddr.String()}})
+	if err := s.Bootstrap(); err != nil {
+		t.Fatalf("Unexpected error bootstrapping: %v", err)
+	}
+
+	nodes := s.table.closest(idToTarget(s.table.selfId), bucketSize, familyIPv4)
+	if len(nodes) != 1 || nodes[0].id != node.table.selfId {
+		t.Errorf("Expected only the node found through the router in the routing table, got %d nodes", len(nodes))
+	}
+}
+
+func TestBootstrapWithoutNodes(t *testing.T) {
+	s, _ := startLocalNode(t, Config{})
+
+	if err := s.Bootstrap(); err == nil {
+		t.Errorf("Expected error bootstrapping without any nodes, but got none")
+	}
+}
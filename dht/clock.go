@@ -0,0 +1,28 @@
+package dht
+
+import "time"
+
+// Clock tells the time of a DHT node, so that peer and item expiry, token rotation and routing table maintenance can
+// be driven by a virtual clock in simulations. Query timeouts follow the network the node sends its queries over,
+// so they always run on real time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a channel that delivers the time every period, along with a function that stops the ticker.
+	// Like time.Ticker, ticks are dropped if the receiver falls behind.
+	NewTicker(period time.Duration) (<-chan time.Time, func())
+}
+
+// systemClock is the Clock of the system, used unless a node is given a clock.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(period time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(period)
+
+	return ticker.C, ticker.Stop
+}
@@ -0,0 +1,268 @@
+package crawler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/dht"
+	"github.com/anthony/BT/peer"
+	"github.com/anthony/BT/proxy"
+	"github.com/anthony/BT/torrent"
+)
+
+// Default settings of a crawler.
+const (
+	DefaultMetadataWorkers = 8
+	DefaultMaxPeers        = 5
+
+	// How long to wait between walking to the next target, so that we do not flood the DHT with lookups
+	// while every node near the target is still within its interval.
+	walkDelay = time.Second
+
+	// How long a single peer has to send the metadata of an info hash.
+	metadataTimeout = 30 * time.Second
+
+	// Number of discovered info hashes remembered, so that they are only indexed once. Once full, the
+	// info hashes are forgotten and may be indexed again.
+	maxSeen = 1 << 20
+)
+
+// Config holds the settings of a crawler.
+type Config struct {
+	// Node is the DHT node used to sample info hashes and look up their peers. It must be serving.
+	Node *dht.Server
+
+	// Index is where an entry is written as a line of JSON for every discovered info hash.
+	Index io.Writer
+
+	// MetadataWorkers is the number of info hashes whose metadata is fetched at the same time.
+	MetadataWorkers int
+
+	// MaxPeers is the number of peers asked for the metadata of an info hash before giving up.
+	MaxPeers int
+
+	// Dialer connects to the peers the metadata is fetched from. A nil dialer connects directly.
+	Dialer proxy.Dialer
+}
+
+// Crawler indexes the info hashes active in the DHT. It walks the keyspace with sample_infohashes queries as
+// specified in BEP 51, then fetches the metadata of every discovered info hash from its peers with the ut_metadata
+// extension as specified in BEP 9.
+type Crawler struct {
+	cfg    Config
+	peerId [20]byte
+
+	mu   sync.Mutex
+	seen map[[20]byte]bool
+
+	indexMu sync.Mutex
+}
+
+// Entry is a line of the index.
+type Entry struct {
+	InfoHash     string    `json:"info_hash"`
+	DiscoveredAt time.Time `json:"discovered_at"`
+
+	// Peers is the number of peers found for the info hash in the DHT.
+	Peers int `json:"peers"`
+
+	// The metadata of the torrent, which is empty if no peer sent it.
+	Name   string `json:"name,omitempty"`
+	Length int    `json:"length,omitempty"`
+	Files  []File `json:"files,omitempty"`
+}
+
+// File is a file of a multi-file torrent.
+type File struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+// New creates a crawler with the given config.
+//
+// It returns the crawler, or an error if the config has no DHT node or index.
+func New(cfg Config) (*Crawler, error) {
+	if cfg.Node == nil || cfg.Index == nil {
+		return nil, fmt.Errorf("A crawler needs a DHT node and an index")
+	}
+	if cfg.MetadataWorkers <= 0 {
+		cfg.MetadataWorkers = DefaultMetadataWorkers
+	}
+	if cfg.MaxPeers <= 0 {
+		cfg.MaxPeers = DefaultMaxPeers
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = proxy.Direct{}
+	}
+
+	c := &Crawler{
+		cfg:  cfg,
+		seen: make(map[[20]byte]bool),
+	}
+	rand.Read(c.peerId[:])
+
+	return c, nil
+}
+
+// Run walks the keyspace until done is closed, sweeping the target through every prefix of the keyspace so that
+// every part of the DHT is sampled. The DHT node only samples a node again once the interval the node sent has passed.
+//
+// It returns nil once done is closed, or an error if writing to the index failed.
+func (c *Crawler) Run(done <-chan struct{}) error {
+	infoHashes := make(chan [20]byte)
+	errs := make(chan error, c.cfg.MetadataWorkers)
+
+	var wg sync.WaitGroup
+	for range c.cfg.MetadataWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for infoHash := range infoHashes {
+				if err := c.index(infoHash); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(infoHashes)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(walkDelay)
+	defer ticker.Stop()
+
+	for prefix := 0; ; prefix = (prefix + 1) % 256 {
+		var target [20]byte
+		rand.Read(target[:])
+		target[0] = byte(prefix)
+
+		samples, _ := c.cfg.Node.SampleInfoHashes(target)
+		for _, sample := range samples {
+			for _, infoHash := range sample.InfoHashes {
+				if !c.discovered(infoHash) {
+					continue
+				}
+
+				select {
+				case infoHashes <- infoHash:
+				case err := <-errs:
+					return err
+				case <-done:
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case err := <-errs:
+			return err
+		case <-done:
+			return nil
+		}
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// discovered records that the info hash was found.
+//
+// It returns true if the info hash has not been found before.
+func (c *Crawler) discovered(infoHash [20]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen[infoHash] {
+		return false
+	}
+
+	if len(c.seen) >= maxSeen {
+		c.seen = make(map[[20]byte]bool)
+	}
+	c.seen[infoHash] = true
+
+	return true
+}
+
+// index looks up the peers of the info hash, fetches its metadata from them and writes its entry to the index.
+//
+// It returns an error if the entry could not be written.
+func (c *Crawler) index(infoHash [20]byte) error {
+	entry := Entry{
+		InfoHash:     hex.EncodeToString(infoHash[:]),
+		DiscoveredAt: time.Now().UTC(),
+	}
+
+	peers, _ := c.cfg.Node.GetPeers(infoHash)
+	peers = peer.RemoveDuplicatePeers(peers)
+	entry.Peers = len(peers)
+
+	for i, addr := range peers {
+		if i == c.cfg.MaxPeers {
+			break
+		}
+
+		info, err := c.fetchMetadata(addr, infoHash)
+		if err != nil {
+			continue
+		}
+
+		entry.Name = info.Name
+		entry.Length = info.Length
+		for _, file := range info.Files {
+			entry.Files = append(entry.Files, File{Path: file.Path, Length: file.Length})
+			entry.Length += file.Length
+		}
+		break
+	}
+
+	return c.write(entry)
+}
+
+// fetchMetadata connects to the peer and requests the info dictionary of the info hash.
+//
+// It returns the info dictionary, or an error if the peer did not send valid metadata in time.
+func (c *Crawler) fetchMetadata(addr net.TCPAddr, infoHash [20]byte) (torrent.InfoDict, error) {
+	client, err := peer.NewPeerClient(c.cfg.Dialer, addr, torrent.TorrentFile{InfoHash: infoHash}, c.peerId)
+	if err != nil {
+		return torrent.InfoDict{}, err
+	}
+	defer client.Conn.Close()
+
+	client.Conn.SetDeadline(time.Now().Add(metadataTimeout))
+
+	metadata, err := client.RequestMetadata(infoHash)
+	if err != nil {
+		return torrent.InfoDict{}, err
+	}
+
+	return torrent.ParseInfoDict(metadata)
+}
+
+// write appends the entry to the index as a line of JSON.
+//
+// It returns an error if the entry could not be written.
+func (c *Crawler) write(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
+
+	if _, err := c.cfg.Index.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Error writing to the index: %w", err)
+	}
+
+	return nil
+}
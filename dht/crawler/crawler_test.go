@@ -0,0 +1,102 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/dht"
+)
+
+// lockedBuffer is an index that can be read while the crawler writes to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// startNode starts a DHT node on a local UDP port.
+func startNode(t *testing.T) (*dht.Server, string) {
+	node, err := dht.NewServer(dht.Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+
+	go node.Serve(pc)
+	t.Cleanup(func() { node.Close() })
+
+	return node, pc.LocalAddr().String()
+}
+
+func TestCrawlerIndexesSampledInfoHashes(t *testing.T) {
+	_, storerAddr := startNode(t)
+
+	// The announced peer refuses connections, so the metadata cannot be fetched
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on TCP: %v", err)
+	}
+	peerPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	announcer, _ := startNode(t)
+	announcer.AddNodes([]string{storerAddr})
+	infoHash := [20]byte{1, 2, 3}
+	if _, err := announcer.Announce(infoHash, peerPort); err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	node, _ := startNode(t)
+	node.AddNodes([]string{storerAddr})
+
+	index := &lockedBuffer{}
+	c, err := New(Config{Node: node, Index: index})
+	if err != nil {
+		t.Fatalf("Unexpected error creating crawler: %v", err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() { stopped <- c.Run(done) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for index.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+
+	if err := <-stopped; err != nil {
+		t.Errorf("Unexpected error crawling: %v", err)
+	}
+
+	var entry Entry
+	if err := json.Unmarshal([]byte(index.String()), &entry); err != nil {
+		t.Fatalf("Expected a single JSON line in the index, got %q: %v", index.String(), err)
+	}
+
+	if entry.InfoHash != hex.EncodeToString(infoHash[:]) || entry.Peers != 1 || entry.Name != "" {
+		t.Errorf("Expected entry for the announced info hash with 1 peer and no metadata, got %+v", entry)
+	}
+}
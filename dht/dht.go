@@ -5,19 +5,24 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sort"
 	"sync"
-	"time"
+)
 
-	"github.com/anthony/BT/bencode"
-	"github.com/anthony/BT/message"
+// Lengths of the compact node info and compact peer info formats of both address families,
+// as specified in BEP 5 and BEP 32.
+const (
+	compactNodeLenV4 = 26
+	compactNodeLenV6 = 38
+	compactPeerLenV4 = 6
+	compactPeerLenV6 = 18
 )
 
 type compactNode struct {
-	conn *net.UDPConn
 	id   string
 	addr net.UDPAddr
 }
@@ -26,45 +31,85 @@ type compactNode struct {
 type token string
 type nodes []compactNode
 
-func GetPeersFromDHT(client *message.Client, infoHash [20]byte) ([]net.TCPAddr, error) {
-	// Create a compact node info for the initial DHT node
-	node := compactNode{
-		id: "",
-		addr: net.UDPAddr{
-			IP:   net.ParseIP(client.Ip),
-			Port: client.DHT.Port,
-		}}
+// GetPeers looks up peers for the info hash, starting from the closest nodes in the routing table.
+// The IPv4 and IPv6 DHTs are searched in parallel. If the routing table is empty, the node bootstraps first.
+//
+// It returns the peers found, or an error if there are no nodes to start the lookup from.
+func (s *Server) GetPeers(infoHash [20]byte) ([]net.TCPAddr, error) {
+	results, _, err := s.lookup(infoHash, s.getPeersQuery(infoHash, false, false))
 
-	var err error
-	node.conn, err = net.DialUDP("udp", nil, &node.addr)
-	if err != nil {
-		return nil, err
-	}
+	return peersOf(results), err
+}
 
-	selfId, err := generateNodeId()
-	if err != nil {
-		return nil, err
-	}
+type dhtResult struct {
+	Peers   []net.TCPAddr
+	Nodes   []compactNode
+	Token   tokenNode
+	Item    *Item
+	Sample  *InfoHashSample
+	Filters *swarmFilters
+}
 
-	// Get the node ID of the intial DHT node by pinging it
-	node.id, err = node.ping(selfId)
-	if err != nil {
-		return nil, err
+// tokenNode is a node that responded to get_peers or get, along with the token it gave us for announcing
+// or storing an item.
+type tokenNode struct {
+	node  compactNode
+	token token
+}
+
+// lookupQuery sends a get_peers, get or sample_infohashes query to a node as part of a lookup.
+type lookupQuery func(node compactNode) (dhtResult, error)
+
+// lookup bootstraps the node if its routing table is empty, then iteratively queries the nodes closest to the target
+// in every address family with the given query.
+//
+// It returns the results of every node that responded and the K closest of them in each family, or an error if there
+// are no nodes to start the lookup from.
+func (s *Server) lookup(target [20]byte, get lookupQuery) ([]dhtResult, []tokenNode, error) {
+	if s.table.Len() == 0 {
+		if err := s.Bootstrap(); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	nodes, err := node.findNode(selfId)
+	var results []dhtResult
+	var closest []tokenNode
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 
-	return lookupPeers(selfId, infoHash, nodes), nil
-}
+	started := 0
+	for _, family := range s.families() {
+		initial := s.table.closest(target, bucketSize, family)
+		if len(initial) == 0 {
+			continue
+		}
 
-type dhtResult struct {
-	Peers []net.TCPAddr
-	Nodes []compactNode
+		started++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			familyResults, familyClosest := s.lookupFamily(target, initial, family, get)
+
+			mu.Lock()
+			results = append(results, familyResults...)
+			closest = append(closest, familyClosest...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if started == 0 {
+		return nil, nil, fmt.Errorf("No DHT nodes to start the lookup from")
+	}
+
+	return results, closest, nil
 }
 
-// Performs a DHT lookup for peers by iteratively querying the closest nodes to the target info hash
-// until we either find enough peers or exhaust the search space.
-func lookupPeers(selfID string, infoHash [20]byte, initial []compactNode) []net.TCPAddr {
+// Performs a DHT lookup by iteratively querying the closest nodes to the target until we exhaust the search space.
+// The tokens of the K closest nodes that responded are returned as well, so that we can announce to them or store
+// items on them. Only nodes of the given address family are queried.
+func (s *Server) lookupFamily(target [20]byte, initial []compactNode, family int, get lookupQuery) ([]dhtResult, []tokenNode) {
 	const (
 		K        = 8
 		Alpha    = 3
@@ -72,10 +117,17 @@ func lookupPeers(selfID string, infoHash [20]byte, initial []compactNode) []net.
 	)
 
 	shortlist := initial
-	sortByDistance(shortlist, infoHash)
+	sortByDistance(shortlist, target)
 
-	queried := make(map[string]bool)
-	var foundPeers []net.TCPAddr
+	// Other nodes may return us as one of the closest nodes, but we never query ourselves. Nodes already in the
+	// shortlist are not added again, so that a node returning the same nodes over and over cannot flood it.
+	queried := map[string]bool{s.table.id(): true}
+	known := map[string]bool{s.table.id(): true}
+	for _, n := range shortlist {
+		known[n.id] = true
+	}
+	var results []dhtResult
+	var responded []tokenNode
 
 	for {
 		// Pick the alpha closest nodes from the shortlist that have not been queried yet
@@ -86,7 +138,7 @@ func lookupPeers(selfID string, infoHash [20]byte, initial []compactNode) []net.
 			break
 		}
 
-		results := make(chan dhtResult, len(batch))
+		batchResults := make(chan dhtResult, len(batch))
 		var wg sync.WaitGroup
 
 		for _, n := range batch {
@@ -96,33 +148,42 @@ func lookupPeers(selfID string, infoHash [20]byte, initial []compactNode) []net.
 			go func() {
 				defer wg.Done()
 
-				conn, err := net.DialUDP("udp", nil, &n.addr)
+				res, err := get(n)
 				if err != nil {
 					return
 				}
 
-				defer conn.Close()
-				n.conn = conn
+				batchResults <- res
+			}()
+		}
 
-				_, peers, nodes, err := n.getPeers(selfID, infoHash)
-				if err != nil {
-					return
+		wg.Wait()
+		close(batchResults)
+
+		for res := range batchResults {
+			results = append(results, res)
+			responded = append(responded, res.Token)
+			found := nodesOfFamily(res.Nodes, family)
+			sortByDistance(found, target)
+
+			added := 0
+			for _, n := range found {
+				if added == Alpha {
+					break
 				}
 
-				results <- dhtResult{
-					Peers: peers,
-					Nodes: nodes,
+				if !known[n.id] {
+					known[n.id] = true
+					shortlist = append(shortlist, n)
+					added++
 				}
-			}()
+			}
 		}
 
-		wg.Wait()
-		close(results)
-
-		for res := range results {
-			foundPeers = append(foundPeers, res.Peers...)
-			sortByDistance(res.Nodes, infoHash)
-			shortlist = append(shortlist, pickAlphaCandidates(res.Nodes, queried)...)
+		// Only the closest nodes are kept, so that the shortlist stays bounded however many nodes are returned
+		sortByDistance(shortlist, target)
+		if len(shortlist) > MaxNodes {
+			shortlist = shortlist[:MaxNodes]
 		}
 
 		// Check if the first 8 closest nodes have been queried, if so we can stop
@@ -141,241 +202,215 @@ func lookupPeers(selfID string, infoHash [20]byte, initial []compactNode) []net.
 		}
 	}
 
-	return foundPeers
+	sort.Slice(responded, func(i, j int) bool {
+		return compareDistances([]byte(responded[i].node.id), []byte(responded[j].node.id), target[:])
+	})
+	if len(responded) > K {
+		responded = responded[:K]
+	}
+
+	return results, responded
 }
 
-// Sends a ping to a node, and returns the node id that was sent in the response
-func (d *compactNode) ping(selfId string) (string, error) {
-	// Ping query dictionary as per BEP_5 specifications
-	pingQuery := map[string]interface{}{
-		"t": "aa",
-		"y": "q",
-		"q": "ping",
-		"a": map[string]interface{}{
-			"id": selfId,
-		},
+// getPeersQuery returns the lookup query that asks nodes for the peers of the info hash. Nodes are also asked for
+// the bloom filters of the swarm if scrape is set, and to leave out seeds if noSeed is set, as specified in BEP 33.
+func (s *Server) getPeersQuery(infoHash [20]byte, scrape bool, noSeed bool) lookupQuery {
+	return func(node compactNode) (dhtResult, error) {
+		return s.getPeers(node, infoHash, scrape, noSeed)
 	}
+}
 
-	encodedPingQuery, err := bencode.Encode(pingQuery)
-	if err != nil {
-		return "", err
-	}
+// findNodes iteratively queries the nodes of the address family closest to the target with find_node,
+// so that every node that responds is added to the routing table.
+func (s *Server) findNodes(target [20]byte, family int) {
+	shortlist := s.table.closest(target, bucketSize, family)
+	queried := make(map[string]bool)
 
-	_, err = d.conn.Write(encodedPingQuery)
-	if err != nil {
-		return "", err
-	}
+	for {
+		batch := pickAlphaCandidates(shortlist, queried)
+		if len(batch) == 0 {
+			return
+		}
 
-	d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	resp := make([]byte, 4096)
-	n, err := d.conn.Read(resp)
-	if err != nil {
-		return "", err
-	}
+		results := make(chan []compactNode, len(batch))
+		var wg sync.WaitGroup
+		for _, n := range batch {
+			queried[n.id] = true
 
-	dhtResp, err := parseKRPCReponse(resp[:n])
-	if err != nil {
-		return "", err
-	}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-	return dhtResp.R.Id, nil
-}
+				found, err := s.findNode(n, target)
+				if err == nil {
+					results <- nodesOfFamily(found, family)
+				}
+			}()
+		}
 
-// Sends a find_node query to a node, and returns the list of nodes that were sent in the response.
-func (d *compactNode) findNode(selfId string) ([]compactNode, error) {
-	findNodeQuery := map[string]interface{}{
-		"t": "aa",
-		"y": "q",
-		"q": "find_node",
-		"a": map[string]interface{}{
-			"id":     selfId,
-			"target": d.id,
-		},
-	}
+		wg.Wait()
+		close(results)
 
-	encodedFindNodeQuery, err := bencode.Encode(findNodeQuery)
-	if err != nil {
-		return nil, err
-	}
+		for found := range results {
+			shortlist = append(shortlist, found...)
+		}
 
-	_, err = d.conn.Write(encodedFindNodeQuery)
-	if err != nil {
-		return nil, err
+		sortByDistance(shortlist, target)
+		if len(shortlist) > bucketSize {
+			shortlist = shortlist[:bucketSize]
+		}
 	}
+}
 
-	d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	resp := make([]byte, 4096)
-	n, err := d.conn.Read(resp)
+// Sends a ping to a node, and returns the node id that was sent in the response
+func (s *Server) ping(addr net.UDPAddr) (string, error) {
+	resp, err := s.query(compactNode{addr: addr}, "ping", map[string]interface{}{})
 	if err != nil {
-		return nil, nil
+		return "", err
 	}
 
-	findNodeResp, err := parseKRPCReponse(resp[:n])
+	return resp.Id, nil
+}
+
+// Sends a find_node query to a node for the given target id, and returns the list of nodes that were sent in the response.
+// Nodes of both address families are requested as specified in BEP 32.
+func (s *Server) findNode(node compactNode, target [20]byte) ([]compactNode, error) {
+	resp, err := s.query(node, "find_node", map[string]interface{}{
+		"target": string(target[:]),
+		"want":   []interface{}{"n4", "n6"},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	var nodes []compactNode
-	for i := 0; i < len(findNodeResp.R.Nodes); i += 26 {
-		nodeInfo := parseCompactNodeInfo(findNodeResp.R.Nodes[i : i+26])
-		nodes = append(nodes, nodeInfo)
-	}
-
-	return nodes, nil
+	return s.nodesOf(resp), nil
 }
 
-// Sends a get_peers query to a node, and returns the token, list of peers, and list of nodes that were sent in the response.
-func (d *compactNode) getPeers(selfId string, infoHash [20]byte) (token, []net.TCPAddr, nodes, error) {
-	getPeersQuery := map[string]interface{}{
-		"t": "aa",
-		"y": "q",
-		"q": "get_peers",
-		"a": map[string]interface{}{
-			"id":        selfId,
-			"info_hash": string(infoHash[:]),
-		},
+// Sends a get_peers query to a node, and returns the token, list of peers, list of nodes and the bloom filters of
+// the swarm if asked to scrape, that were sent in the response.
+func (s *Server) getPeers(node compactNode, infoHash [20]byte, scrape bool, noSeed bool) (dhtResult, error) {
+	args := map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"want":      []interface{}{"n4", "n6"},
 	}
-
-	encodedGetPeersQuery, err := bencode.Encode(getPeersQuery)
-	if err != nil {
-		return "", nil, nil, err
+	if scrape {
+		args["scrape"] = 1
+	}
+	if noSeed {
+		args["noseed"] = 1
 	}
 
-	_, err = d.conn.Write(encodedGetPeersQuery)
+	resp, err := s.query(node, "get_peers", args)
 	if err != nil {
-		return "", nil, nil, err
+		return dhtResult{}, err
 	}
 
-	d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	resp := make([]byte, 4096)
-	n, err := d.conn.Read(resp)
-	if err != nil {
-		return "", nil, nil, err
+	// Nodes that leave the token out still help the lookup with their peers and nodes, they are only not announced to
+	result := dhtResult{
+		Peers: s.valuesOf(resp),
+		Nodes: s.nodesOf(resp),
+		Token: tokenNode{node: node, token: token(resp.Token)},
 	}
 
-	getPeersResp, err := parseKRPCReponse(resp[:n])
-	if err != nil {
-		return "", nil, nil, err
+	// Nodes that do not support scrapes leave the filters out
+	seeds, seedsOk := parseBloomFilter(resp.BFsd)
+	others, othersOk := parseBloomFilter(resp.BFpe)
+	if scrape && seedsOk && othersOk {
+		result.Filters = &swarmFilters{seeds: seeds, peers: others}
 	}
 
-	if getPeersResp.R.Token == "" {
-		return "", nil, nil, fmt.Errorf("DHT node does not have peers for the given info hash")
+	return result, nil
+}
+
+// Sends an announce_peer query to a node with the token it gave us, announcing that we are a peer for the given
+// info hash, and whether we are a seed as specified in BEP 33. A port of zero asks the node to use the source port
+// of the query instead, as specified in BEP 5.
+func (s *Server) announcePeer(node compactNode, infoHash [20]byte, port int, seed bool, token token) error {
+	args := map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      port,
+		"token":     string(token),
 	}
 
-	var nodes []compactNode
-	for i := 0; i < len(getPeersResp.R.Nodes); i += 26 {
-		nodeInfo := parseCompactNodeInfo(getPeersResp.R.Nodes[i : i+26])
-		nodes = append(nodes, nodeInfo)
+	if port == 0 {
+		args["implied_port"] = 1
+		args["port"] = s.localPort(familyOf(node.addr.IP))
 	}
 
-	var peers []net.TCPAddr
-	for _, peer := range getPeersResp.R.Values {
-		peerInfo := parseCompactPeerInfo(peer)
-		peers = append(peers, peerInfo)
+	if seed {
+		args["seed"] = 1
 	}
 
-	return token(getPeersResp.R.Token), peers, nodes, nil
-}
+	_, err := s.query(node, "announce_peer", args)
 
-// Sends an announce_peer query to a node, announcing that we have a peer for the given info hash.
-func (d *compactNode) announcePeer(infoHash [20]byte, port uint16, token token) error {
-	announcePeerQuery := map[string]interface{}{
-		"t": "aa",
-		"y": "q",
-		"q": "announce_peer",
-		"a": map[string]interface{}{
-			"id":        d.id,
-			"info_hash": infoHash,
-			"port":      port,
-			"token":     token,
-		},
-	}
+	return err
+}
 
-	encodedAnnouncePeerQuery, err := bencode.Encode(announcePeerQuery)
+// query sends a query with our node id to the node over the node's transport, and records the outcome in the
+// routing table. Nodes that respond are added to the table, and nodes that time out move towards going bad.
+// Nodes that send a malformed response are blacklisted, and blacklisted nodes are not queried.
+// The address the node reports seeing us at counts towards our external IP.
+//
+// It returns the response, or an error if the node did not respond with a valid response.
+func (s *Server) query(node compactNode, method string, args map[string]interface{}) (dhtResp, error) {
+	tr, err := s.transport(familyOf(node.addr.IP))
 	if err != nil {
-		return err
+		return dhtResp{}, err
 	}
 
-	_, err = d.conn.Write(encodedAnnouncePeerQuery)
-	if err != nil {
-		return err
+	if !s.reachable(node.addr.IP) {
+		return dhtResp{}, errMartianAddress
+	}
+	if s.blacklist.contains(node.addr.IP, s.cfg.Clock.Now()) {
+		return dhtResp{}, errBlacklisted
 	}
 
-	d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	resp := make([]byte, 4096)
-	n, err := d.conn.Read(resp)
+	args["id"] = s.table.id()
+	resp, err := tr.query(&node.addr, method, args)
 	if err != nil {
-		return err
+		if errors.Is(err, errQueryTimeout) && node.id != "" {
+			s.table.failed(node)
+		}
+
+		return dhtResp{}, err
 	}
 
-	announcePeerResp, err := parseKRPCReponse(resp[:n])
-	if err != nil {
-		return err
+	if err := validResponse(resp); err != nil {
+		s.blacklistNode(node)
+		return dhtResp{}, err
 	}
 
-	if !bytes.Equal(infoHash[:], []byte(announcePeerResp.R.Id)) {
-		return fmt.Errorf("DHT node did not acknowledge the announce peer request")
+	if !s.isRouter(node.addr) {
+		s.table.responded(compactNode{id: resp.Id, addr: node.addr})
 	}
 
-	return nil
+	if len(resp.Ip) == compactPeerLenV4 || len(resp.Ip) == compactPeerLenV6 {
+		s.reportedIP(parseCompactPeerInfo(resp.Ip).IP, node.addr)
+	}
 
+	return resp, nil
 }
 
 ///////////////////////////// Helper functions /////////////////////////////
 
-// KRPC response as specified in BEP_5
-type krpcResp struct {
-	T string        `mapstructure:"t"`
-	Y string        `mapstructure:"y"`
-	R dhtResp       `mapstructure:"r,omitempty"`
-	E []interface{} `mapstructure:"e,omitempty"`
-}
-
-// Possible DHT response types as specified in BEP_5
-type dhtResp struct {
-	Id     string   `mapstructure:"id,omitempty"`
-	Nodes  string   `mapstructure:"nodes,omitempty"`
-	Token  string   `mapstructure:"token,omitempty"`
-	Values []string `mapstructure:"values,omitempty"`
-}
-
-// Parses a KRPC response and validates it according to BEP_5 specifications.
-// Returns the response as a krpcResp struct if valid,
-// otherwise returns an error with details about the invalid response.
-func parseKRPCReponse(data []byte) (krpcResp, error) {
-	var resp krpcResp
-	err := bencode.Decode(data, &resp)
-	if err != nil {
-
-		return krpcResp{}, err
-	}
-
-	// Validate transaction ID
-	if resp.T != "aa" {
-		return krpcResp{}, fmt.Errorf("Invalid KRPC transaction ID: %s", resp.T)
-	}
-
-	// Validate response type
-	// The response type must be one of "r" (response), or "e" (error)
-	if resp.Y != "r" && resp.Y != "e" {
-		return krpcResp{}, fmt.Errorf("Invalid KRPC response type: %s", resp.Y)
-	}
-
-	// If the response type is "e", return the error details
-	if resp.Y == "e" {
-		return krpcResp{}, fmt.Errorf("KRPC error: %v", resp.E)
+// peersOf returns the peers found by every node of a lookup.
+func peersOf(results []dhtResult) []net.TCPAddr {
+	var peers []net.TCPAddr
+	for _, res := range results {
+		peers = append(peers, res.Peers...)
 	}
 
-	return resp, nil
+	return peers
 }
 
-// Parses a compact node info string (26 bytes) into a node struct with id, IP address, and port.
+// Parses a compact node info string (26 bytes, or 38 bytes for IPv6 nodes) into a node struct with id, IP address, and port.
 func parseCompactNodeInfo(node string) compactNode {
 	compactNodeBytes := []byte(node)
+	ipEnd := len(compactNodeBytes) - 2
 
 	id := string(compactNodeBytes[:20])
-	ip := net.IP(compactNodeBytes[20:24])
-	port := binary.BigEndian.Uint16(compactNodeBytes[24:26])
+	ip := net.IP(compactNodeBytes[20:ipEnd])
+	port := binary.BigEndian.Uint16(compactNodeBytes[ipEnd:])
 
 	return compactNode{
 		id: id,
@@ -386,18 +421,49 @@ func parseCompactNodeInfo(node string) compactNode {
 	}
 }
 
-// Parses a compact peer info string (6 bytes) into a TCP address with IP and port.
+// Parses a string of concatenated compact node infos of the given length, ignoring any trailing partial node.
+func parseCompactNodes(nodes string, entryLen int) []compactNode {
+	var parsed []compactNode
+	for i := 0; i+entryLen <= len(nodes); i += entryLen {
+		parsed = append(parsed, parseCompactNodeInfo(nodes[i:i+entryLen]))
+	}
+
+	return parsed
+}
+
+// Returns the nodes of the given address family.
+func nodesOfFamily(nodes []compactNode, family int) []compactNode {
+	var out []compactNode
+	for _, node := range nodes {
+		if familyOf(node.addr.IP) == family {
+			out = append(out, node)
+		}
+	}
+
+	return out
+}
+
+// Parses a compact peer info string (6 bytes, or 18 bytes for IPv6 peers) into a TCP address with IP and port.
 func parseCompactPeerInfo(peer string) net.TCPAddr {
 	compactPeerBytes := []byte(peer)
+	ipEnd := len(compactPeerBytes) - 2
 
-	ip := net.IP(compactPeerBytes[:4])
-	port := binary.BigEndian.Uint16(compactPeerBytes[4:6])
+	ip := net.IP(compactPeerBytes[:ipEnd])
+	port := binary.BigEndian.Uint16(compactPeerBytes[ipEnd:])
 	return net.TCPAddr{
 		IP:   ip,
 		Port: int(port),
 	}
 }
 
+// Converts a node id into a lookup target.
+func idToTarget(id string) [20]byte {
+	var target [20]byte
+	copy(target[:], id)
+
+	return target
+}
+
 // Generates a random 20-byte node ID by creating 20 random bytes and
 // hashing them with SHA-1 to produce a unique identifier for the DHT node.
 func generateNodeId() (string, error) {
@@ -0,0 +1,332 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// Limits of stored items as specified in BEP 44.
+const (
+	maxItemValueLen = 1000
+	maxSaltLen      = 64
+)
+
+var (
+	errValueTooBig      = errors.New("Message too big")
+	errSaltTooBig       = errors.New("Salt too big")
+	errInvalidSignature = errors.New("Invalid signature")
+)
+
+// Item is a value stored in the DHT as specified in BEP 44. The value is any bencodable value, i.e. an int, string,
+// []interface{} or map[string]interface{}, of at most 1000 bytes once bencoded.
+//
+// Immutable items only have a value, and are stored under the SHA-1 hash of the bencoded value. Mutable items are
+// signed with an ed25519 key and stored under the SHA-1 hash of the public key and salt, so that the owner of the key
+// can publish new values under the same target by increasing the sequence number.
+type Item struct {
+	Value interface{}
+
+	PublicKey ed25519.PublicKey
+	Salt      string
+	Seq       int
+	Signature []byte
+}
+
+// NewMutableItem creates a mutable item with the given salt, sequence number and value, signed with the private key.
+//
+// It returns the item, or an error if the value or salt is invalid.
+func NewMutableItem(key ed25519.PrivateKey, salt string, seq int, value interface{}) (Item, error) {
+	encoded, err := encodeItemValue(value)
+	if err != nil {
+		return Item{}, err
+	}
+
+	if len(salt) > maxSaltLen {
+		return Item{}, errSaltTooBig
+	}
+
+	return Item{
+		Value:     value,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+		Signature: ed25519.Sign(key, signedData(salt, seq, encoded)),
+	}, nil
+}
+
+// ImmutableTarget returns the target an immutable item with the given value is stored under.
+//
+// It returns the target, or an error if the value cannot be bencoded.
+func ImmutableTarget(value interface{}) ([20]byte, error) {
+	encoded, err := bencode.Encode(value)
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	return sha1.Sum(encoded), nil
+}
+
+// MutableTarget returns the target the mutable items of the public key and salt are stored under.
+func MutableTarget(publicKey ed25519.PublicKey, salt string) [20]byte {
+	return sha1.Sum(append(append([]byte{}, publicKey...), salt...))
+}
+
+// Mutable reports whether the item is a mutable item.
+func (item Item) Mutable() bool {
+	return item.PublicKey != nil
+}
+
+// Target returns the target the item is stored under. The item must be valid.
+func (item Item) Target() [20]byte {
+	if item.Mutable() {
+		return MutableTarget(item.PublicKey, item.Salt)
+	}
+
+	target, _ := ImmutableTarget(item.Value)
+	return target
+}
+
+// Verify checks the item can be stored in the DHT, and that the signature of a mutable item is valid.
+//
+// It returns nil if the item is valid, otherwise an error describing why it is not.
+func (item Item) Verify() error {
+	encoded, err := encodeItemValue(item.Value)
+	if err != nil {
+		return err
+	}
+
+	if !item.Mutable() {
+		return nil
+	}
+
+	if len(item.Salt) > maxSaltLen {
+		return errSaltTooBig
+	}
+
+	if len(item.PublicKey) != ed25519.PublicKeySize || len(item.Signature) != ed25519.SignatureSize {
+		return errInvalidSignature
+	}
+
+	if !ed25519.Verify(item.PublicKey, signedData(item.Salt, item.Seq, encoded), item.Signature) {
+		return errInvalidSignature
+	}
+
+	return nil
+}
+
+// GetImmutable looks up the immutable item stored under the target. Values are only accepted if they hash to the
+// target, so nodes cannot return a different value.
+//
+// It returns the value, or an error if the lookup failed or no node had the item.
+func (s *Server) GetImmutable(target [20]byte) (interface{}, error) {
+	results, _, err := s.lookup(target, s.getQuery(target, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range results {
+		if res.Item != nil {
+			return res.Item.Value, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Item not found in the DHT")
+}
+
+// GetMutable looks up the mutable item of the public key and salt. Items are only accepted if they are signed by the
+// public key, and the item with the highest sequence number is returned.
+//
+// It returns the item, or an error if the lookup failed or no node had the item.
+func (s *Server) GetMutable(publicKey ed25519.PublicKey, salt string) (Item, error) {
+	target := MutableTarget(publicKey, salt)
+	results, _, err := s.lookup(target, s.getQuery(target, salt))
+	if err != nil {
+		return Item{}, err
+	}
+
+	var latest *Item
+	for _, res := range results {
+		if res.Item != nil && (latest == nil || res.Item.Seq > latest.Seq) {
+			latest = res.Item
+		}
+	}
+
+	if latest == nil {
+		return Item{}, fmt.Errorf("Item not found in the DHT")
+	}
+
+	return *latest, nil
+}
+
+// Put stores the item on the K closest nodes to its target that responded to a get query.
+//
+// It returns the target the item is stored under, or an error if the item is invalid, the lookup failed
+// or no node accepted the item.
+func (s *Server) Put(item Item) ([20]byte, error) {
+	return s.put(item, nil)
+}
+
+// CompareAndPut stores the mutable item like Put, but nodes only accept it if the sequence number of the item they
+// already have equals cas, so that concurrent writers do not overwrite each other's updates.
+//
+// It returns the target the item is stored under, or an error if the item is invalid, the lookup failed
+// or no node accepted the item.
+func (s *Server) CompareAndPut(item Item, cas int) ([20]byte, error) {
+	if !item.Mutable() {
+		return [20]byte{}, fmt.Errorf("Only mutable items can be compared and put")
+	}
+
+	return s.put(item, &cas)
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// put stores the item on the closest nodes to its target, passing cas along to the nodes if it is not nil.
+func (s *Server) put(item Item, cas *int) ([20]byte, error) {
+	if err := item.Verify(); err != nil {
+		return [20]byte{}, err
+	}
+
+	target := item.Target()
+	_, closest, err := s.lookup(target, s.getQuery(target, item.Salt))
+	if err != nil {
+		return target, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	accepted := 0
+	for _, node := range closest {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := s.putItem(node.node, item, cas, node.token)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				accepted++
+			} else {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted == 0 {
+		if len(errs) > 0 {
+			return target, fmt.Errorf("No DHT node accepted the item: %w", errs[0])
+		}
+
+		return target, fmt.Errorf("No DHT node accepted the item")
+	}
+
+	return target, nil
+}
+
+// getQuery returns the lookup query that asks nodes for the item stored under the target. Mutable items are given
+// the salt, since nodes do not send it back. Items are only accepted if they are stored under the target and mutable
+// items are signed, so nodes cannot return a different value, and nodes that do are blacklisted.
+func (s *Server) getQuery(target [20]byte, salt string) lookupQuery {
+	return func(node compactNode) (dhtResult, error) {
+		resp, err := s.query(node, "get", map[string]interface{}{
+			"target": string(target[:]),
+			"want":   []interface{}{"n4", "n6"},
+		})
+		if err != nil {
+			return dhtResult{}, err
+		}
+
+		if resp.Token == "" {
+			return dhtResult{}, fmt.Errorf("DHT node did not send a token")
+		}
+
+		res := dhtResult{
+			Nodes: s.nodesOf(resp),
+			Token: tokenNode{node: node, token: token(resp.Token)},
+		}
+
+		if resp.V != nil {
+			item := Item{Value: resp.V}
+			if resp.K != "" {
+				item.PublicKey = ed25519.PublicKey(resp.K)
+				item.Salt = salt
+				item.Signature = []byte(resp.Sig)
+				if resp.Seq != nil {
+					item.Seq = *resp.Seq
+				}
+			}
+
+			if item.Target() != target || (item.Mutable() && item.Verify() != nil) {
+				s.blacklistNode(node)
+				return dhtResult{}, errBogusItem
+			}
+			res.Item = &item
+		}
+
+		return res, nil
+	}
+}
+
+// putItem sends a put query to a node with the token it gave us, asking it to store the item.
+func (s *Server) putItem(node compactNode, item Item, cas *int, token token) error {
+	args := map[string]interface{}{
+		"token": string(token),
+		"v":     item.Value,
+	}
+
+	if item.Mutable() {
+		args["k"] = string(item.PublicKey)
+		args["sig"] = string(item.Signature)
+		args["seq"] = item.Seq
+		if item.Salt != "" {
+			args["salt"] = item.Salt
+		}
+		if cas != nil {
+			args["cas"] = *cas
+		}
+	}
+
+	_, err := s.query(node, "put", args)
+
+	return err
+}
+
+// encodeItemValue bencodes the value of an item.
+//
+// It returns the bencoded value, or an error if the value cannot be bencoded or is too big to be stored.
+func encodeItemValue(value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, fmt.Errorf("Missing item value")
+	}
+
+	encoded, err := bencode.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encoded) > maxItemValueLen {
+		return nil, errValueTooBig
+	}
+
+	return encoded, nil
+}
+
+// signedData returns the data signed for a mutable item, which is the bencoded salt, sequence number and value
+// without the surrounding dictionary, as specified in BEP 44.
+func signedData(salt string, seq int, encodedValue []byte) []byte {
+	var data []byte
+	if salt != "" {
+		data = append(data, fmt.Sprintf("4:salt%d:%s", len(salt), salt)...)
+	}
+	data = append(data, fmt.Sprintf("3:seqi%de1:v", seq)...)
+
+	return append(data, encodedValue...)
+}
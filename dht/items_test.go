@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestPutAndGetImmutableItem(t *testing.T) {
+	storer, storerAddr := startLocalNode(t, Config{})
+	writer, _ := startLocalNode(t, Config{})
+	writer.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	value := map[string]interface{}{"info hash": "0123456789abcdefghij", "build": 42}
+	target, err := writer.Put(Item{Value: value})
+	if err != nil {
+		t.Fatalf("Unexpected error putting item: %v", err)
+	}
+
+	reader, _ := startLocalNode(t, Config{})
+	reader.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	got, err := reader.GetImmutable(target)
+	if err != nil {
+		t.Fatalf("Unexpected error getting item: %v", err)
+	}
+
+	if gotTarget, _ := ImmutableTarget(got); gotTarget != target {
+		t.Errorf("Expected value %v, got %v", value, got)
+	}
+}
+
+func TestPutAndGetMutableItem(t *testing.T) {
+	storer, storerAddr := startLocalNode(t, Config{})
+	writer, _ := startLocalNode(t, Config{})
+	writer.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	publicKey := key.Public().(ed25519.PublicKey)
+
+	first, _ := NewMutableItem(key, "latest", 1, "first")
+	if _, err := writer.Put(first); err != nil {
+		t.Fatalf("Unexpected error putting item: %v", err)
+	}
+
+	second, _ := NewMutableItem(key, "latest", 2, "second")
+	if _, err := writer.CompareAndPut(second, 1); err != nil {
+		t.Fatalf("Unexpected error updating item: %v", err)
+	}
+
+	// The stored item is at sequence number 2 now, so both a stale CAS and an older sequence number are rejected
+	third, _ := NewMutableItem(key, "latest", 3, "third")
+	var kerr *krpcError
+	if _, err := writer.CompareAndPut(third, 1); !errors.As(err, &kerr) || kerr.code != krpcErrorCASMismatch {
+		t.Errorf("Expected CAS mismatch error, got %v", err)
+	}
+
+	if _, err := writer.Put(first); err == nil {
+		t.Errorf("Expected error putting an older sequence number, but got none")
+	}
+
+	reader, _ := startLocalNode(t, Config{})
+	reader.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	got, err := reader.GetMutable(publicKey, "latest")
+	if err != nil {
+		t.Fatalf("Unexpected error getting item: %v", err)
+	}
+
+	if got.Seq != 2 || got.Value != "second" {
+		t.Errorf("Expected item 2 \"second\", got %d %v", got.Seq, got.Value)
+	}
+
+	// The salt is part of the target, so items with another salt are not found
+	if _, err := reader.GetMutable(publicKey, "other"); err == nil {
+		t.Errorf("Expected error getting item with another salt, but got none")
+	}
+}
+
+func TestItemVerify(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	item, err := NewMutableItem(key, "salt", 7, []interface{}{"a", 1})
+	if err != nil {
+		t.Fatalf("Unexpected error creating item: %v", err)
+	}
+
+	if err := item.Verify(); err != nil {
+		t.Errorf("Expected valid item, got %v", err)
+	}
+
+	tampered := item
+	tampered.Seq = 8
+	if err := tampered.Verify(); !errors.Is(err, errInvalidSignature) {
+		t.Errorf("Expected invalid signature for tampered sequence number, got %v", err)
+	}
+
+	tampered = item
+	tampered.Salt = "other"
+	if err := tampered.Verify(); !errors.Is(err, errInvalidSignature) {
+		t.Errorf("Expected invalid signature for tampered salt, got %v", err)
+	}
+
+	big := Item{Value: string(make([]byte, maxItemValueLen))}
+	if err := big.Verify(); !errors.Is(err, errValueTooBig) {
+		t.Errorf("Expected value too big error, got %v", err)
+	}
+}
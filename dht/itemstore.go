@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Limit of the item store, so that nodes storing many items cannot use up our memory.
+const maxStoredItems = 10000
+
+var (
+	errCASMismatch = errors.New("CAS mismatch")
+	errSeqTooLow   = errors.New("Sequence number less than current")
+	errStoreFull   = errors.New("Item store is full")
+)
+
+// itemStore holds the items put to us as specified in BEP 44, so that they can be returned to get queries.
+// Items are forgotten if they are not put again before they expire.
+type itemStore struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	items map[[20]byte]storedItem
+}
+
+// storedItem is a single item along with the time it expires.
+type storedItem struct {
+	item    Item
+	expires time.Time
+}
+
+func newItemStore(ttl time.Duration) *itemStore {
+	return &itemStore{
+		ttl:   ttl,
+		items: make(map[[20]byte]storedItem),
+	}
+}
+
+// put stores a verified item under the target, or extends its expiry if it is already stored. A mutable item only
+// replaces the stored item if its sequence number is not lower, and if cas is not nil, only if the stored item's
+// sequence number equals cas.
+//
+// It returns errCASMismatch or errSeqTooLow if the stored item was not replaced, or errStoreFull if the item
+// is new and the store is full.
+func (st *itemStore) put(target [20]byte, item Item, cas *int, now time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	stored, ok := st.items[target]
+	if ok && now.Before(stored.expires) && item.Mutable() {
+		if cas != nil && *cas != stored.item.Seq {
+			return errCASMismatch
+		}
+
+		if item.Seq < stored.item.Seq {
+			return errSeqTooLow
+		}
+	} else if !ok && len(st.items) >= maxStoredItems {
+		return errStoreFull
+	}
+
+	st.items[target] = storedItem{item: item, expires: now.Add(st.ttl)}
+
+	return nil
+}
+
+// get returns the item stored under the target, if it has not expired.
+func (st *itemStore) get(target [20]byte, now time.Time) (Item, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	stored, ok := st.items[target]
+	if !ok || !now.Before(stored.expires) {
+		return Item{}, false
+	}
+
+	return stored.item, true
+}
+
+// expire removes every item that has expired.
+func (st *itemStore) expire(now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for target, stored := range st.items {
+		if !now.Before(stored.expires) {
+			delete(st.items, target)
+		}
+	}
+}
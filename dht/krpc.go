@@ -0,0 +1,288 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// Default time to wait for a response to a query before the node is considered unresponsive.
+const defaultQueryTimeout = 5 * time.Second
+
+var (
+	errQueryTimeout    = errors.New("DHT query timed out")
+	errTransportClosed = errors.New("DHT transport is closed")
+	errNoTransport     = errors.New("DHT node has no socket for the address family")
+)
+
+// transport sends KRPC queries and receives their responses over a single UDP socket, as specified in BEP 5.
+// Every outstanding query has a unique transaction id, so that responses can be matched to their queries and
+// any number of lookups can share the socket. Incoming queries are passed to the query handler. Queries of a
+// read-only transport are flagged with `ro`, as specified in BEP 43, so that other nodes leave us out of their
+// routing tables.
+type transport struct {
+	conn     net.PacketConn
+	handler  func(packet []byte, addr *net.UDPAddr) []byte
+	timeout  time.Duration
+	readOnly bool
+
+	mu      sync.Mutex
+	nextTid uint16
+	pending map[string]*pendingQuery
+	closed  bool
+}
+
+// pendingQuery is a query waiting for its response. Only a response from the address the query was sent to
+// is accepted, so other nodes cannot answer on its behalf.
+type pendingQuery struct {
+	addr   string
+	result chan queryResult
+}
+
+// queryResult is the response to a query, or the KRPC error the node sent instead.
+type queryResult struct {
+	resp dhtResp
+	err  error
+}
+
+// Header of a KRPC message as specified in BEP 5, which tells queries, responses and errors apart before the rest
+// of the message is decoded.
+type krpcHeader struct {
+	T string `mapstructure:"t"`
+	Y string `mapstructure:"y"`
+}
+
+// KRPC response or error as specified in BEP 5. Responses may also tell us the address the node sees us at, as
+// specified in BEP 42.
+type krpcResp struct {
+	T  string        `mapstructure:"t"`
+	Y  string        `mapstructure:"y"`
+	R  dhtResp       `mapstructure:"r,omitempty"`
+	E  []interface{} `mapstructure:"e,omitempty"`
+	Ip string        `mapstructure:"ip,omitempty"`
+}
+
+// Possible DHT response types as specified in BEP_5, with IPv6 nodes in `nodes6` as specified in BEP 32,
+// swarm bloom filters as specified in BEP 33, stored items as specified in BEP 44 and info hash samples
+// as specified in BEP 51
+type dhtResp struct {
+	Id       string      `mapstructure:"id,omitempty"`
+	Nodes    string      `mapstructure:"nodes,omitempty"`
+	Nodes6   string      `mapstructure:"nodes6,omitempty"`
+	Token    string      `mapstructure:"token,omitempty"`
+	Values   []string    `mapstructure:"values,omitempty"`
+	BFsd     string      `mapstructure:"BFsd,omitempty"`
+	BFpe     string      `mapstructure:"BFpe,omitempty"`
+	V        interface{} `mapstructure:"v,omitempty"`
+	K        string      `mapstructure:"k,omitempty"`
+	Sig      string      `mapstructure:"sig,omitempty"`
+	Seq      *int        `mapstructure:"seq,omitempty"`
+	Samples  string      `mapstructure:"samples,omitempty"`
+	Num      int         `mapstructure:"num,omitempty"`
+	Interval int         `mapstructure:"interval,omitempty"`
+
+	// Our address as seen by the node in the compact peer info format, taken from the `ip` field of the message
+	Ip string `mapstructure:"-"`
+}
+
+func newTransport(conn net.PacketConn, timeout time.Duration, readOnly bool, handler func(packet []byte, addr *net.UDPAddr) []byte) *transport {
+	// Transaction ids start at a random value so that they are not reused straight away after a restart
+	var start [2]byte
+	rand.Read(start[:])
+
+	return &transport{
+		conn:     conn,
+		handler:  handler,
+		timeout:  timeout,
+		readOnly: readOnly,
+		nextTid:  binary.BigEndian.Uint16(start[:]),
+		pending:  make(map[string]*pendingQuery),
+	}
+}
+
+// serve reads packets from the socket until it is closed. Responses and errors are delivered to the query waiting
+// for them, as an error if they cannot be decoded, and queries are answered with the response from the query handler.
+//
+// It returns the error that stopped the socket.
+func (t *transport) serve() error {
+	defer t.close()
+
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		// Anything that is not a response or error is treated as a query, so that malformed queries can be answered
+		// with an error
+		var header krpcHeader
+		if err := bencode.Decode(buf[:n], &header); err != nil || (header.Y != "r" && header.Y != "e") {
+			if resp := t.handler(buf[:n], udpAddr); resp != nil {
+				t.conn.WriteTo(resp, addr)
+			}
+			continue
+		}
+
+		var msg krpcResp
+		if err := bencode.Decode(buf[:n], &msg); err != nil {
+			t.deliver(header.T, udpAddr, queryResult{err: fmt.Errorf("Malformed KRPC response: %w", err)})
+			continue
+		}
+
+		if msg.Y == "e" {
+			t.deliver(msg.T, udpAddr, queryResult{err: parseKRPCError(msg.E)})
+			continue
+		}
+
+		resp := msg.R
+		resp.Ip = msg.Ip
+		t.deliver(msg.T, udpAddr, queryResult{resp: resp})
+	}
+}
+
+// query sends a query to the address and waits for the matching response.
+//
+// It returns the response, a *krpcError if the node responded with an error, or an error if the query could not be
+// sent or timed out.
+func (t *transport) query(addr *net.UDPAddr, method string, args map[string]interface{}) (dhtResp, error) {
+	tid, pq, err := t.register(addr)
+	if err != nil {
+		return dhtResp{}, err
+	}
+	defer t.unregister(tid)
+
+	msg := map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": method,
+		"a": args,
+	}
+	if t.readOnly {
+		msg["ro"] = 1
+	}
+
+	data, err := bencode.Encode(msg)
+	if err != nil {
+		return dhtResp{}, err
+	}
+
+	if _, err := t.conn.WriteTo(data, addr); err != nil {
+		return dhtResp{}, err
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-pq.result:
+		return res.resp, res.err
+	case <-timer.C:
+		return dhtResp{}, errQueryTimeout
+	}
+}
+
+// close fails every outstanding query and stops new queries from being sent.
+func (t *transport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for tid, pq := range t.pending {
+		pq.result <- queryResult{err: errTransportClosed}
+		delete(t.pending, tid)
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// register assigns an unused transaction id to a new query to the address.
+//
+// It returns the transaction id and the pending query, or an error if the transport is closed
+// or every transaction id is in use.
+func (t *transport) register(addr *net.UDPAddr) (string, *pendingQuery, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return "", nil, errTransportClosed
+	}
+
+	for range 1 << 16 {
+		var buf [2]byte
+		binary.BigEndian.PutUint16(buf[:], t.nextTid)
+		t.nextTid++
+
+		tid := string(buf[:])
+		if _, ok := t.pending[tid]; ok {
+			continue
+		}
+
+		pq := &pendingQuery{addr: addr.String(), result: make(chan queryResult, 1)}
+		t.pending[tid] = pq
+
+		return tid, pq, nil
+	}
+
+	return "", nil, fmt.Errorf("Too many outstanding DHT queries")
+}
+
+// unregister forgets the query, so that a late response to it is ignored.
+func (t *transport) unregister(tid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.pending, tid)
+}
+
+// deliver passes the result of a response or error to the query with the transaction id. Messages that do not match
+// an outstanding query to the address they came from are ignored.
+func (t *transport) deliver(tid string, addr *net.UDPAddr, res queryResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pq, ok := t.pending[tid]
+	if !ok || pq.addr != addr.String() {
+		return
+	}
+	delete(t.pending, tid)
+
+	pq.result <- res
+}
+
+// parseKRPCError parses the list of an error code and message sent in a KRPC error.
+func parseKRPCError(e []interface{}) *krpcError {
+	kerr := &krpcError{code: krpcErrorGeneric}
+	if len(e) > 0 {
+		if code, ok := e[0].(int); ok {
+			kerr.code = code
+		}
+	}
+	if len(e) > 1 {
+		if message, ok := e[1].(string); ok {
+			kerr.message = message
+		}
+	}
+
+	return kerr
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.code, e.message)
+}
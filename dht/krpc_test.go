@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// startLocalNode starts a DHT node serving on a local UDP port.
+func startLocalNode(t *testing.T, cfg Config) (*Server, net.UDPAddr) {
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+
+	go s.Serve(pc)
+	t.Cleanup(func() { s.Close() })
+
+	return s, *pc.LocalAddr().(*net.UDPAddr)
+}
+
+func TestTransportMatchesConcurrentQueries(t *testing.T) {
+	a, _ := startLocalNode(t, Config{})
+	b, bAddr := startLocalNode(t, Config{})
+
+	// Fill b's routing table so that its find_node responses differ by target
+	for i := 0; i < 50; i++ {
+		b.table.add(nodeInBucket(b.table, i%10, 1000+i))
+	}
+
+	// b adds a to its routing table when it first hears from it, so do that before comparing responses
+	a.query(compactNode{addr: bAddr}, "ping", map[string]interface{}{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			target := randomIdInBucket(b.table.selfId, i%10)
+			nodes, err := a.findNode(compactNode{addr: bAddr}, target)
+			if err != nil {
+				t.Errorf("Unexpected error querying node: %v", err)
+				return
+			}
+
+			expected := b.closestNodes(target, familyIPv4)
+			if len(nodes) == 0 || string(encodeCompactNodeInfo(nodes[0])) != expected[:26] {
+				t.Errorf("Response was not matched to its query")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every query shares a's socket, and b is now in a's routing table
+	if a.table.Len() != 1 {
+		t.Errorf("Expected responding node in the routing table, got %d nodes", a.table.Len())
+	}
+}
+
+func TestTransportTimeout(t *testing.T) {
+	a, _ := startLocalNode(t, Config{QueryTimeout: 100 * time.Millisecond})
+
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	defer silent.Close()
+
+	_, err = a.ping(*silent.LocalAddr().(*net.UDPAddr))
+	if err != errQueryTimeout {
+		t.Errorf("Expected query timeout, got %v", err)
+	}
+}
+
+func TestTransportFailsMalformedResponses(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+
+	var queries int32
+	tr := newTransport(conn, 5*time.Second, false, func(packet []byte, addr *net.UDPAddr) []byte {
+		atomic.AddInt32(&queries, 1)
+		return nil
+	})
+	go tr.serve()
+	defer conn.Close()
+
+	// The node answers every query with a response whose body is not a dictionary
+	node, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	defer node.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := node.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query krpcHeader
+			bencode.Decode(buf[:n], &query)
+			node.WriteTo([]byte(fmt.Sprintf("d1:r3:bad1:t%d:%s1:y1:re", len(query.T), query.T)), addr)
+		}
+	}()
+
+	start := time.Now()
+	_, err = tr.query(node.LocalAddr().(*net.UDPAddr), "ping", map[string]interface{}{"id": "a"})
+	if err == nil || err == errQueryTimeout || time.Since(start) > time.Second {
+		t.Errorf("Expected malformed response to fail the query straight away, got %v", err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Errorf("Expected malformed response not to be handled as a query, got %d queries", n)
+	}
+}
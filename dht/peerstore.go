@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits of the peer store, so that nodes announcing many torrents or peers cannot use up our memory.
+const (
+	maxStoredInfoHashes = 10000
+	maxPeersPerInfoHash = 1000
+)
+
+// peerStore holds the peers announced to us with announce_peer, so that they can be returned to get_peers queries.
+// Peers are forgotten if they do not announce again before they expire.
+type peerStore struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]storedPeer
+
+	// Info hashes returned to sample_infohashes queries until the sample is refreshed, as specified in BEP 51
+	samples   [][20]byte
+	sampledAt time.Time
+}
+
+// storedPeer is a single announced peer along with the time it expires, and whether it announced itself as a seed
+// as specified in BEP 33.
+type storedPeer struct {
+	addr    net.TCPAddr
+	seed    bool
+	expires time.Time
+}
+
+func newPeerStore(ttl time.Duration) *peerStore {
+	return &peerStore{
+		ttl:   ttl,
+		peers: make(map[[20]byte]map[string]storedPeer),
+	}
+}
+
+// add stores the peer for the info hash, or extends its expiry if it is already stored.
+// New peers are dropped once the store is full.
+func (p *peerStore) add(infoHash [20]byte, addr net.TCPAddr, seed bool, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	swarm, ok := p.peers[infoHash]
+	if !ok {
+		if len(p.peers) >= maxStoredInfoHashes {
+			return
+		}
+
+		swarm = make(map[string]storedPeer)
+		p.peers[infoHash] = swarm
+	}
+
+	key := addr.String()
+	if _, ok := swarm[key]; !ok && len(swarm) >= maxPeersPerInfoHash {
+		return
+	}
+
+	swarm[key] = storedPeer{addr: addr, seed: seed, expires: now.Add(p.ttl)}
+}
+
+// get returns up to n peers of the address family stored for the info hash that have not expired, leaving out seeds
+// if noSeed is set. Map iteration order is random, so repeated queries return different subsets of a large swarm.
+func (p *peerStore) get(infoHash [20]byte, n int, family int, noSeed bool, now time.Time) []net.TCPAddr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var peers []net.TCPAddr
+	for _, peer := range p.peers[infoHash] {
+		if len(peers) == n {
+			break
+		}
+
+		if now.Before(peer.expires) && familyOf(peer.addr.IP) == family && !(noSeed && peer.seed) {
+			peers = append(peers, peer.addr)
+		}
+	}
+
+	return peers
+}
+
+// bloomFilters returns the bloom filters of the seeds and of the other peers stored for the info hash that have not
+// expired, as returned to scrapes as specified in BEP 33. Peers of both address families are included.
+func (p *peerStore) bloomFilters(infoHash [20]byte, now time.Time) (seeds bloomFilter, peers bloomFilter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, peer := range p.peers[infoHash] {
+		if !now.Before(peer.expires) {
+			continue
+		}
+
+		if peer.seed {
+			seeds.add(peer.addr.IP)
+		} else {
+			peers.add(peer.addr.IP)
+		}
+	}
+
+	return seeds, peers
+}
+
+// expire removes every peer that has expired, along with info hashes that have no peers left.
+func (p *peerStore) expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for infoHash, swarm := range p.peers {
+		for key, peer := range swarm {
+			if !now.Before(peer.expires) {
+				delete(swarm, key)
+			}
+		}
+
+		if len(swarm) == 0 {
+			delete(p.peers, infoHash)
+		}
+	}
+}
+
+// sample returns up to n random info hashes we have peers for, along with the number of info hashes stored.
+// The same sample is returned until it is older than the interval, so that crawlers gain nothing by querying
+// us more often.
+func (p *peerStore) sample(n int, interval time.Duration, now time.Time) ([][20]byte, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.samples == nil || now.Sub(p.sampledAt) >= interval {
+		p.samples = make([][20]byte, 0, n)
+		for infoHash := range p.peers {
+			if len(p.samples) == n {
+				break
+			}
+
+			p.samples = append(p.samples, infoHash)
+		}
+		p.sampledAt = now
+	}
+
+	return p.samples, len(p.peers)
+}
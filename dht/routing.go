@@ -0,0 +1,573 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// These constants are based on the specification in BEP 5:
+const (
+	numBuckets = 160 // One bucket for every bit of the 160 bit node id space
+	bucketSize = 8   // K, the number of nodes in a bucket
+
+	// Nodes that have not been heard from within this period are questionable, and buckets that have not
+	// changed within this period are refreshed.
+	nodeTimeout     = 15 * time.Minute
+	refreshInterval = 15 * time.Minute
+
+	// Nodes that fail to respond to this many queries in a row are bad
+	maxFailures = 2
+)
+
+// Address families of the DHT. The IPv4 and IPv6 DHTs are separate networks as specified in BEP 32,
+// so every family has its own buckets.
+const (
+	familyIPv4 = iota
+	familyIPv6
+	numFamilies
+)
+
+// Possible states of a node in the routing table as specified in BEP 5.
+type nodeState int
+
+const (
+	nodeGood nodeState = iota
+	nodeQuestionable
+	nodeBad
+)
+
+// routingNode is a node in the routing table along with the times we last heard from it.
+type routingNode struct {
+	compactNode
+	lastResponse time.Time
+	lastQuery    time.Time
+	failures     int
+}
+
+// bucket holds up to K nodes, ordered from least to most recently seen, along with a cache of
+// nodes that can replace nodes that go bad.
+type bucket struct {
+	nodes        []*routingNode
+	replacements []*routingNode
+	lastChanged  time.Time
+}
+
+// RoutingTable is a Kademlia routing table as specified in BEP 5. It has 160 buckets of up to 8 nodes,
+// where bucket i holds the nodes whose id shares exactly i leading bits with our own id. IPv6 nodes are kept
+// in their own set of buckets as specified in BEP 32, using the same node id.
+//
+// Our node id is derived from our external IP as specified in BEP 42 once it is known, and nodes whose id is derived
+// from their own IP are preferred over nodes whose id is not, so that an attacker cannot choose ids to surround
+// a target.
+type RoutingTable struct {
+	mu      sync.Mutex
+	selfId  string
+	buckets [numFamilies][numBuckets]bucket
+	clock   Clock
+}
+
+// staleBucket identifies a bucket of one of the address families.
+type staleBucket struct {
+	family int
+	index  int
+}
+
+// Struct for decoding a persisted routing table. The nodes are stored in the compact node info format,
+// with IPv6 nodes in `nodes6` as specified in BEP 32.
+type persistedTable struct {
+	Id     string `mapstructure:"id"`
+	Nodes  string `mapstructure:"nodes"`
+	Nodes6 string `mapstructure:"nodes6"`
+}
+
+// NewRoutingTable creates an empty routing table with a newly generated node id.
+//
+// It returns the routing table, or an error if a node id could not be generated.
+func NewRoutingTable() (*RoutingTable, error) {
+	selfId, err := generateNodeId()
+	if err != nil {
+		return nil, err
+	}
+
+	return newRoutingTable(selfId), nil
+}
+
+// LoadRoutingTable restores a routing table saved with Save, keeping the node id of the previous run.
+// The restored nodes are questionable until they respond to a query. If the file does not exist,
+// an empty routing table is created instead.
+//
+// It returns the routing table, or an error if the file exists but could not be read.
+func LoadRoutingTable(path string) (*RoutingTable, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewRoutingTable()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading routing table: %w", err)
+	}
+
+	var persisted persistedTable
+	if err := bencode.Decode(data, &persisted); err != nil {
+		return nil, fmt.Errorf("Error decoding routing table: %w", err)
+	}
+
+	if len(persisted.Id) != 20 || len(persisted.Nodes)%compactNodeLenV4 != 0 || len(persisted.Nodes6)%compactNodeLenV6 != 0 {
+		return nil, fmt.Errorf("Invalid routing table in %s", path)
+	}
+
+	table := newRoutingTable(persisted.Id)
+	for _, node := range parseCompactNodes(persisted.Nodes, compactNodeLenV4) {
+		table.add(node)
+	}
+	for _, node := range parseCompactNodes(persisted.Nodes6, compactNodeLenV6) {
+		table.add(node)
+	}
+
+	return table, nil
+}
+
+// Save writes our node id and the nodes in the routing table to the given file, so that the next run can reach the
+// DHT without bootstrapping. Bad nodes are not saved. The file is written to a temporary file first and then renamed,
+// so a crash while saving does not corrupt the previous table.
+//
+// It returns an error if the file could not be written.
+func (t *RoutingTable) Save(path string) error {
+	t.mu.Lock()
+	id := t.selfId
+	var nodes [numFamilies][]byte
+	now := t.clock.Now()
+	for family := range t.buckets {
+		for i := range t.buckets[family] {
+			for _, node := range t.buckets[family][i].nodes {
+				if node.state(now) != nodeBad {
+					nodes[family] = append(nodes[family], encodeCompactNodeInfo(node.compactNode)...)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	data, err := bencode.Encode(map[string]interface{}{
+		"id":     id,
+		"nodes":  string(nodes[familyIPv4]),
+		"nodes6": string(nodes[familyIPv6]),
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding routing table: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("Error writing routing table: %w", err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Len returns the number of nodes of both address families in the routing table.
+func (t *RoutingTable) Len() int {
+	return t.familyLen(familyIPv4) + t.familyLen(familyIPv6)
+}
+
+// familyLen returns the number of nodes of the address family in the routing table.
+func (t *RoutingTable) familyLen(family int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for i := range t.buckets[family] {
+		n += len(t.buckets[family][i].nodes)
+	}
+
+	return n
+}
+
+// closest returns up to n nodes of the address family that are not bad, sorted by their distance to the target.
+func (t *RoutingTable) closest(target [20]byte, n int, family int) []compactNode {
+	t.mu.Lock()
+	var nodes []compactNode
+	now := t.clock.Now()
+	for i := range t.buckets[family] {
+		for _, node := range t.buckets[family][i].nodes {
+			if node.state(now) != nodeBad {
+				nodes = append(nodes, node.compactNode)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+
+	return nodes
+}
+
+// responded records that the node responded to one of our queries, adding it to the routing table if there is room.
+func (t *RoutingTable) responded(node compactNode) {
+	t.update(node, func(n *routingNode, now time.Time) {
+		n.lastResponse = now
+		n.failures = 0
+	})
+}
+
+// queried records that the node sent us a query, adding it to the routing table if there is room.
+func (t *RoutingTable) queried(node compactNode) {
+	t.update(node, func(n *routingNode, now time.Time) {
+		n.lastQuery = now
+	})
+}
+
+// failed records that the node did not respond to one of our queries. If the node goes bad, it is replaced by the
+// most recently seen node in the bucket's replacement cache, preferring nodes whose id is compliant with BEP 42.
+func (t *RoutingTable) failed(failed compactNode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(failed)
+	if b == nil {
+		return
+	}
+
+	for i, node := range b.nodes {
+		if node.id != failed.id {
+			continue
+		}
+
+		node.failures++
+		if node.failures >= maxFailures && len(b.replacements) > 0 {
+			b.nodes = append(append(b.nodes[:i:i], b.nodes[i+1:]...), b.takeReplacement())
+			b.lastChanged = t.clock.Now()
+		}
+
+		return
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// remove drops every node at the IP from the routing table and the replacement caches, such as the nodes of a
+// blacklisted IP. Their places in the buckets are taken by the most recently seen replacements.
+func (t *RoutingTable) remove(ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	family := familyOf(ip)
+	for i := range t.buckets[family] {
+		b := &t.buckets[family][i]
+
+		var replacements []*routingNode
+		for _, node := range b.replacements {
+			if !node.addr.IP.Equal(ip) {
+				replacements = append(replacements, node)
+			}
+		}
+		b.replacements = replacements
+
+		var kept []*routingNode
+		for _, node := range b.nodes {
+			if !node.addr.IP.Equal(ip) {
+				kept = append(kept, node)
+			}
+		}
+		if len(kept) == len(b.nodes) {
+			continue
+		}
+
+		for len(kept) < bucketSize && len(b.replacements) > 0 {
+			kept = append(kept, b.takeReplacement())
+		}
+		b.nodes = kept
+		b.lastChanged = t.clock.Now()
+	}
+}
+
+func newRoutingTable(selfId string) *RoutingTable {
+	return &RoutingTable{selfId: selfId, clock: systemClock{}}
+}
+
+// setClock changes the clock the times nodes were last seen are taken from.
+func (t *RoutingTable) setClock(clock Clock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clock = clock
+}
+
+// add inserts a node we have not heard from yet, such as a node restored from disk.
+func (t *RoutingTable) add(node compactNode) {
+	t.update(node, func(n *routingNode, now time.Time) {})
+}
+
+// update applies the change to the node if it is in the routing table. Otherwise the node is added to its bucket
+// if the bucket has room or contains a bad node, or if its id is compliant with BEP 42 and the bucket contains a node
+// whose id is not. Otherwise the node is kept in the bucket's replacement cache instead.
+func (t *RoutingTable) update(node compactNode, change func(n *routingNode, now time.Time)) {
+	if len(node.id) != 20 || node.addr.IP == nil || node.addr.Port == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(node)
+	if b == nil {
+		return
+	}
+
+	now := t.clock.Now()
+	for i, existing := range b.nodes {
+		if existing.id == node.id {
+			change(existing, now)
+
+			// Move the node to the end, since it is now the most recently seen
+			b.nodes = append(append(b.nodes[:i:i], b.nodes[i+1:]...), existing)
+			b.lastChanged = now
+			return
+		}
+	}
+
+	newNode := &routingNode{compactNode: compactNode{id: node.id, addr: node.addr}}
+	change(newNode, now)
+
+	if len(b.nodes) < bucketSize {
+		b.nodes = append(b.nodes, newNode)
+		b.lastChanged = now
+		return
+	}
+
+	for i, existing := range b.nodes {
+		if existing.state(now) == nodeBad {
+			b.nodes[i] = newNode
+			b.lastChanged = now
+			return
+		}
+	}
+
+	// A node whose id is compliant with BEP 42 takes the place of the least recently seen node that is not,
+	// which is kept as a replacement instead
+	if compliantNodeId(newNode.id, newNode.addr.IP) {
+		for i, existing := range b.nodes {
+			if !compliantNodeId(existing.id, existing.addr.IP) {
+				b.nodes = append(append(b.nodes[:i:i], b.nodes[i+1:]...), newNode)
+				b.lastChanged = now
+				b.addReplacement(existing)
+				return
+			}
+		}
+	}
+
+	b.addReplacement(newNode)
+}
+
+// setId changes our node id, moving every node to the bucket it belongs in under the new id. Every bucket is
+// refreshed at the next maintenance, since our neighbourhood in the DHT has changed.
+func (t *RoutingTable) setId(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	old := t.buckets
+	t.selfId = id
+	t.buckets = [numFamilies][numBuckets]bucket{}
+
+	for family := range old {
+		for i := range old[family] {
+			for _, node := range append(old[family][i].nodes, old[family][i].replacements...) {
+				b := t.bucketFor(node.compactNode)
+				if b == nil {
+					continue
+				}
+
+				if len(b.nodes) < bucketSize {
+					b.nodes = append(b.nodes, node)
+				} else {
+					b.addReplacement(node)
+				}
+			}
+		}
+	}
+}
+
+// id returns our node id.
+func (t *RoutingTable) id() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.selfId
+}
+
+// addReplacement adds the node to the end of the replacement cache as the most recently seen replacement,
+// dropping the least recently seen replacement if the cache is full.
+func (b *bucket) addReplacement(node *routingNode) {
+	for i, replacement := range b.replacements {
+		if replacement.id == node.id {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			break
+		}
+	}
+
+	b.replacements = append(b.replacements, node)
+	if len(b.replacements) > bucketSize {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// takeReplacement removes and returns the most recently seen replacement whose id is compliant with BEP 42,
+// or the most recently seen replacement if none are. The replacement cache must not be empty.
+func (b *bucket) takeReplacement() *routingNode {
+	i := len(b.replacements) - 1
+	for j := i; j >= 0; j-- {
+		if compliantNodeId(b.replacements[j].id, b.replacements[j].addr.IP) {
+			i = j
+			break
+		}
+	}
+
+	replacement := b.replacements[i]
+	b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+
+	return replacement
+}
+
+// bucketFor returns the bucket the given node belongs in, or nil if the node has our own id.
+func (t *RoutingTable) bucketFor(node compactNode) *bucket {
+	index := commonPrefixLen([]byte(t.selfId), []byte(node.id))
+	if index >= numBuckets || len(node.id) != 20 {
+		return nil
+	}
+
+	return &t.buckets[familyOf(node.addr.IP)][index]
+}
+
+// questionableNodes returns the least recently seen questionable node of every bucket that has nodes waiting in its
+// replacement cache. These nodes are pinged, so that they go bad and are replaced if they do not respond.
+func (t *RoutingTable) questionableNodes() []compactNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []compactNode
+	now := t.clock.Now()
+	for family := range t.buckets {
+		for i := range t.buckets[family] {
+			b := &t.buckets[family][i]
+			if len(b.replacements) == 0 {
+				continue
+			}
+
+			for _, node := range b.nodes {
+				if node.state(now) == nodeQuestionable {
+					nodes = append(nodes, node.compactNode)
+					break
+				}
+			}
+		}
+	}
+
+	return nodes
+}
+
+// staleBuckets returns every bucket that has not changed in 15 minutes, and marks them as refreshed
+// so that they are not refreshed again straight away if the refresh finds no new nodes.
+func (t *RoutingTable) staleBuckets() []staleBucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stale []staleBucket
+	now := t.clock.Now()
+	for family := range t.buckets {
+		for i := range t.buckets[family] {
+			b := &t.buckets[family][i]
+			if len(b.nodes) > 0 && now.Sub(b.lastChanged) > refreshInterval {
+				stale = append(stale, staleBucket{family: family, index: i})
+				b.lastChanged = now
+			}
+		}
+	}
+
+	return stale
+}
+
+// state returns whether the node is good, questionable or bad as specified in BEP 5. A node is good if it responded
+// to one of our queries within the last 15 minutes, or has ever responded and sent us a query within the last
+// 15 minutes. A node that fails to respond to multiple queries in a row is bad.
+func (n *routingNode) state(now time.Time) nodeState {
+	switch {
+	case n.failures >= maxFailures:
+		return nodeBad
+	case now.Sub(n.lastResponse) < nodeTimeout:
+		return nodeGood
+	case !n.lastResponse.IsZero() && now.Sub(n.lastQuery) < nodeTimeout:
+		return nodeGood
+	default:
+		return nodeQuestionable
+	}
+}
+
+// commonPrefixLen returns the number of leading bits the two ids share.
+func commonPrefixLen(a []byte, b []byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return len(a) * 8
+}
+
+// randomIdInBucket generates a random id that shares exactly the given number of leading bits with our id,
+// so that it falls in the range of that bucket.
+func randomIdInBucket(selfId string, index int) [20]byte {
+	var id [20]byte
+	rand.Read(id[:])
+
+	self := []byte(selfId)
+	for bit := 0; bit <= index && bit < numBuckets; bit++ {
+		byteIndex, mask := bit/8, byte(0x80>>(bit%8))
+		selfBit := self[byteIndex] & mask
+
+		// Copy the shared prefix from our id, then flip the next bit so the id is in the bucket's range
+		if bit == index {
+			selfBit ^= mask
+		}
+		id[byteIndex] = id[byteIndex]&^mask | selfBit
+	}
+
+	return id
+}
+
+// encodeCompactNodeInfo encodes a node in the 26 byte compact node info format as specified in BEP 5,
+// or the 38 byte format for IPv6 nodes as specified in BEP 32.
+func encodeCompactNodeInfo(node compactNode) []byte {
+	buf := make([]byte, 0, compactNodeLenV6)
+	buf = append(buf, node.id...)
+	buf = append(buf, compactIP(node.addr.IP)...)
+
+	return binary.BigEndian.AppendUint16(buf, uint16(node.addr.Port))
+}
+
+// familyOf returns the address family of the IP.
+func familyOf(ip net.IP) int {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+
+	return familyIPv6
+}
+
+// compactIP returns the 4 byte form of an IPv4 address, or the 16 byte form of an IPv6 address.
+func compactIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip.To16()
+}
@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// nodeInBucket creates a node whose id falls in the given bucket of the table.
+func nodeInBucket(table *RoutingTable, index int, port int) compactNode {
+	id := randomIdInBucket(table.selfId, index)
+
+	return compactNode{
+		id:   string(id[:]),
+		addr: net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port},
+	}
+}
+
+func TestRandomIdInBucket(t *testing.T) {
+	table, _ := NewRoutingTable()
+
+	for _, index := range []int{0, 1, 7, 8, 80, 159} {
+		id := randomIdInBucket(table.selfId, index)
+		if got := commonPrefixLen([]byte(table.selfId), id[:]); got != index {
+			t.Errorf("Expected id in bucket %d, got bucket %d", index, got)
+		}
+	}
+}
+
+func TestBucketReplacesBadNodes(t *testing.T) {
+	table, _ := NewRoutingTable()
+
+	var nodes []compactNode
+	for i := 0; i < bucketSize; i++ {
+		node := nodeInBucket(table, 3, 1000+i)
+		nodes = append(nodes, node)
+		table.responded(node)
+	}
+
+	// The bucket is full of good nodes, so the new node is only kept as a replacement
+	extra := nodeInBucket(table, 3, 2000)
+	table.responded(extra)
+	if table.Len() != bucketSize {
+		t.Fatalf("Expected full bucket of %d nodes, got %d", bucketSize, table.Len())
+	}
+
+	for i := 0; i < maxFailures; i++ {
+		table.failed(nodes[0])
+	}
+
+	found := false
+	for _, node := range table.closest(idToTarget(extra.id), numBuckets*bucketSize, familyIPv4) {
+		if node.id == nodes[0].id {
+			t.Errorf("Expected bad node to be replaced")
+		}
+		if node.id == extra.id {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("Expected replacement node to be added to the bucket")
+	}
+}
+
+func TestRoutingTablePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht")
+	table, _ := NewRoutingTable()
+
+	for i := 0; i < 20; i++ {
+		table.responded(nodeInBucket(table, i%5, 1000+i))
+	}
+
+	if err := table.Save(path); err != nil {
+		t.Fatalf("Unexpected error saving routing table: %v", err)
+	}
+
+	restored, err := LoadRoutingTable(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading routing table: %v", err)
+	}
+
+	if restored.selfId != table.selfId {
+		t.Errorf("Expected node id to be kept between runs")
+	}
+
+	if restored.Len() != table.Len() {
+		t.Errorf("Expected %d nodes after loading, got %d", table.Len(), restored.Len())
+	}
+}
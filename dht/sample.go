@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+// Limits of sample_infohashes as specified in BEP 51.
+const (
+	// Maximum number of info hashes in a sample, which keeps the response within a single packet along with
+	// the closest nodes of both address families.
+	maxSamples = 20
+
+	// Longest interval a node may ask us to wait before querying it again.
+	maxSampleInterval = 6 * time.Hour
+
+	// Number of nodes whose interval we keep track of, so that crawling cannot use up our memory.
+	maxSampledNodes = 100000
+)
+
+// InfoHashSample is a sample of the info hashes a node stores peers for, as returned to a sample_infohashes query.
+type InfoHashSample struct {
+	// Node is the address of the node that sent the sample.
+	Node net.UDPAddr
+
+	// InfoHashes are the sampled info hashes.
+	InfoHashes [][20]byte
+
+	// Num is the total number of info hashes the node stores peers for.
+	Num int
+
+	// Interval is how long until the node refreshes its sample. The node is not sampled again before then.
+	Interval time.Duration
+}
+
+// SampleInfoHashes looks up the nodes closest to the target with sample_infohashes queries as specified in BEP 51,
+// so that the info hashes active in the DHT can be indexed by walking the keyspace with different targets. Nodes are
+// not sampled again until the interval they sent has passed, they are only asked for closer nodes instead.
+//
+// It returns the samples of every node that sent one, or an error if there are no nodes to start the lookup from.
+func (s *Server) SampleInfoHashes(target [20]byte) ([]InfoHashSample, error) {
+	results, _, err := s.lookup(target, s.sampleQuery(target))
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []InfoHashSample
+	for _, res := range results {
+		if res.Sample != nil {
+			samples = append(samples, *res.Sample)
+		}
+	}
+
+	return samples, nil
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// sampleQuery returns the lookup query that asks nodes for a sample of their info hashes, or only for the nodes
+// closest to the target if their interval has not passed yet.
+func (s *Server) sampleQuery(target [20]byte) lookupQuery {
+	return func(node compactNode) (dhtResult, error) {
+		if !s.sampleDue(node.addr, s.cfg.Clock.Now()) {
+			nodes, err := s.findNode(node, target)
+			return dhtResult{Nodes: nodes, Token: tokenNode{node: node}}, err
+		}
+
+		resp, err := s.query(node, "sample_infohashes", map[string]interface{}{
+			"target": string(target[:]),
+			"want":   []interface{}{"n4", "n6"},
+		})
+		if err != nil {
+			return dhtResult{}, err
+		}
+
+		interval := min(time.Duration(max(resp.Interval, 0))*time.Second, maxSampleInterval)
+		s.sampled(node.addr, s.cfg.Clock.Now().Add(interval))
+
+		sample := &InfoHashSample{
+			Node:     node.addr,
+			Num:      resp.Num,
+			Interval: interval,
+		}
+		for i := 0; i < len(resp.Samples); i += 20 {
+			sample.InfoHashes = append(sample.InfoHashes, idToTarget(resp.Samples[i:i+20]))
+		}
+
+		return dhtResult{
+			Nodes:  s.nodesOf(resp),
+			Token:  tokenNode{node: node},
+			Sample: sample,
+		}, nil
+	}
+}
+
+// sampleDue reports whether the interval of the node at the address has passed, so that it can be sampled again.
+func (s *Server) sampleDue(addr net.UDPAddr, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !now.Before(s.sampleAfter[addr.String()])
+}
+
+// sampled records that the node at the address should not be sampled again until the given time.
+func (s *Server) sampled(addr net.UDPAddr, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.sampleAfter) >= maxSampledNodes {
+		s.expireSampledLocked(s.cfg.Clock.Now())
+	}
+
+	if len(s.sampleAfter) < maxSampledNodes {
+		s.sampleAfter[addr.String()] = next
+	}
+}
+
+// expireSampled forgets the nodes whose interval has passed.
+func (s *Server) expireSampled(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireSampledLocked(now)
+}
+
+// expireSampledLocked forgets the nodes whose interval has passed. The caller must hold s.mu.
+func (s *Server) expireSampledLocked(now time.Time) {
+	for addr, next := range s.sampleAfter {
+		if !now.Before(next) {
+			delete(s.sampleAfter, addr)
+		}
+	}
+}
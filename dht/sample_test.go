@@ -0,0 +1,36 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSampleInfoHashes(t *testing.T) {
+	storer, storerAddr := startLocalNode(t, Config{SampleInterval: time.Minute})
+	now := time.Now()
+	storer.peers.add([20]byte{1}, net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7000}, false, now)
+	storer.peers.add([20]byte{2}, net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7000}, false, now)
+
+	crawler, _ := startLocalNode(t, Config{})
+	crawler.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	samples, err := crawler.SampleInfoHashes([20]byte{3})
+	if err != nil {
+		t.Fatalf("Unexpected error sampling info hashes: %v", err)
+	}
+
+	if len(samples) != 1 || len(samples[0].InfoHashes) != 2 || samples[0].Num != 2 {
+		t.Fatalf("Expected a sample of 2 info hashes, got %v", samples)
+	}
+
+	if samples[0].Interval != time.Minute {
+		t.Errorf("Expected interval of 1m, got %s", samples[0].Interval)
+	}
+
+	// The node is not sampled again until its interval has passed
+	samples, _ = crawler.SampleInfoHashes([20]byte{4})
+	if len(samples) != 0 {
+		t.Errorf("Expected no samples before the interval has passed, got %v", samples)
+	}
+}
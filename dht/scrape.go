@@ -0,0 +1,36 @@
+package dht
+
+import "github.com/anthony/BT/tracker"
+
+// swarmFilters are the bloom filters of the seeds and of the other peers of a swarm sent by a node,
+// as specified in BEP 33.
+type swarmFilters struct {
+	seeds bloomFilter
+	peers bloomFilter
+}
+
+// Scrape estimates the number of seeders and leechers of the info hash as specified in BEP 33. The nodes closest to the
+// info hash are looked up with get_peers queries asking for the bloom filters of the peers they store, and the filters
+// are merged so that peers that announced to several nodes are only counted once.
+//
+// It returns the estimated size of the swarm in the same form as a tracker scrape, or an error if there are no nodes to
+// start the lookup from.
+func (s *Server) Scrape(infoHash [20]byte) (tracker.ScrapeResult, error) {
+	results, _, err := s.lookup(infoHash, s.getPeersQuery(infoHash, true, false))
+	if err != nil {
+		return tracker.ScrapeResult{}, err
+	}
+
+	var merged swarmFilters
+	for _, res := range results {
+		if res.Filters != nil {
+			merged.seeds.merge(res.Filters.seeds)
+			merged.peers.merge(res.Filters.peers)
+		}
+	}
+
+	return tracker.ScrapeResult{
+		Complete:   merged.seeds.estimate(),
+		Incomplete: merged.peers.estimate(),
+	}, nil
+}
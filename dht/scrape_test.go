@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// The test vector of BEP 33, which inserts 256 IPv4 and 1000 IPv6 addresses into a filter.
+func TestBloomFilterEstimate(t *testing.T) {
+	var f bloomFilter
+	for i := range 256 {
+		f.add(net.IPv4(192, 0, 2, byte(i)))
+	}
+
+	for i := range 1000 {
+		ip := net.ParseIP("2001:db8::")
+		ip[14] = byte(i >> 8)
+		ip[15] = byte(i)
+		f.add(ip)
+	}
+
+	if estimate := f.estimate(); estimate != 1225 {
+		t.Errorf("Expected an estimate of 1225, got %d", estimate)
+	}
+}
+
+func TestScrapeEstimatesSeedersAndLeechers(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	storer, storerAddr := startLocalNode(t, Config{})
+	now := time.Now()
+	storer.peers.add(infoHash, net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 7000}, true, now)
+	storer.peers.add(infoHash, net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7000}, true, now)
+	storer.peers.add(infoHash, net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 7000}, false, now)
+
+	seeder, _ := startLocalNode(t, Config{})
+	seeder.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	// Seeds only look up the peers that are not seeds
+	peers, err := seeder.AnnounceSeed(infoHash, 7000)
+	if err != nil {
+		t.Fatalf("Unexpected error announcing as a seed: %v", err)
+	}
+
+	if len(peers) != 1 || peers[0].String() != "10.0.0.3:7000" {
+		t.Errorf("Expected only the leecher 10.0.0.3:7000, got %v", peers)
+	}
+
+	scraper, _ := startLocalNode(t, Config{})
+	scraper.table.responded(compactNode{id: storer.table.selfId, addr: storerAddr})
+
+	result, err := scraper.Scrape(infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error scraping: %v", err)
+	}
+
+	if result.Complete != 3 || result.Incomplete != 1 {
+		t.Errorf("Expected 3 seeders and 1 leecher, got %+v", result)
+	}
+}
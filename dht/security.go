@@ -0,0 +1,169 @@
+package dht
+
+import (
+	"crypto/rand"
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+// Number of nodes that must report our external IP before we trust it.
+const externalIPVotes = 10
+
+// Masks applied to IPv4 addresses and the first 8 bytes of IPv6 addresses before they are hashed into a node id,
+// as specified in BEP 42.
+var (
+	nodeIdMaskV4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	nodeIdMaskV6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ipVoter decides our external IP in each address family from the `ip` fields of KRPC responses, as specified
+// in BEP 42. Votes are counted in rounds, where every node votes at most once, and the IP with the most votes
+// wins the round.
+type ipVoter struct {
+	mu       sync.Mutex
+	votes    [numFamilies]map[string]int
+	voters   [numFamilies]map[string]bool
+	external [numFamilies]net.IP
+}
+
+// generateSecureNodeId generates a random node id derived from our external IP as specified in BEP 42, so that nodes
+// enforcing BEP 42 trust us. The first 21 bits are taken from a hash of the IP and the last byte is random,
+// with its low 3 bits mixed into the hash.
+//
+// It returns the node id, or an error if random bytes could not be generated.
+func generateSecureNodeId(ip net.IP) (string, error) {
+	var id [20]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+
+	prefix := nodeIdPrefix(ip, id[19])
+	id[0] = byte(prefix >> 24)
+	id[1] = byte(prefix >> 16)
+	id[2] = byte(prefix>>8)&0xf8 | id[2]&0x07
+
+	return string(id[:]), nil
+}
+
+// compliantNodeId reports whether the node id was derived from the IP as specified in BEP 42. Nodes on local
+// networks are exempt, since their IP does not identify them.
+func compliantNodeId(id string, ip net.IP) bool {
+	if len(id) != 20 || ip == nil || isLocalIP(ip) {
+		return true
+	}
+
+	prefix := nodeIdPrefix(ip, id[19])
+
+	return id[0] == byte(prefix>>24) && id[1] == byte(prefix>>16) && id[2]&0xf8 == byte(prefix>>8)&0xf8
+}
+
+// ExternalIP returns our IP as reported by other nodes, preferring our IPv4 address over our IPv6 address,
+// or nil if it is not known yet.
+func (s *Server) ExternalIP() net.IP {
+	if ip := s.ipVotes.externalIP(familyIPv4); ip != nil {
+		return ip
+	}
+
+	return s.ipVotes.externalIP(familyIPv6)
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// reportedIP records the external IP a node reported seeing us at. Once our external IP is known, our node id is
+// regenerated from it if it is not already compliant. The IPv4 address decides our id if we have one, since the same
+// id is used in both DHTs.
+func (s *Server) reportedIP(ip net.IP, voter net.UDPAddr) {
+	external, changed := s.ipVotes.vote(ip, voter)
+	if !changed || isLocalIP(external) {
+		return
+	}
+
+	if familyOf(external) == familyIPv6 && s.ipVotes.externalIP(familyIPv4) != nil {
+		return
+	}
+
+	if compliantNodeId(s.table.id(), external) {
+		return
+	}
+
+	if id, err := generateSecureNodeId(external); err == nil {
+		s.table.setId(id)
+	}
+}
+
+// vote records a node's vote for our external IP. Nodes only vote once per round.
+//
+// It returns our external IP and true if the vote ended a round that changed it.
+func (v *ipVoter) vote(ip net.IP, voter net.UDPAddr) (net.IP, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	family := familyOf(voter.IP)
+	if ip == nil || familyOf(ip) != family {
+		return nil, false
+	}
+
+	if v.votes[family] == nil {
+		v.votes[family] = make(map[string]int)
+		v.voters[family] = make(map[string]bool)
+	}
+
+	if v.voters[family][voter.IP.String()] {
+		return nil, false
+	}
+	v.voters[family][voter.IP.String()] = true
+	v.votes[family][ip.String()]++
+
+	if len(v.voters[family]) < externalIPVotes {
+		return nil, false
+	}
+
+	winner, most := "", 0
+	for candidate, votes := range v.votes[family] {
+		if votes > most {
+			winner, most = candidate, votes
+		}
+	}
+	v.votes[family], v.voters[family] = nil, nil
+
+	external := net.ParseIP(winner)
+	if external.Equal(v.external[family]) {
+		return nil, false
+	}
+	v.external[family] = external
+
+	return external, true
+}
+
+// externalIP returns our external IP in the address family, or nil if it is not known yet.
+func (v *ipVoter) externalIP(family int) net.IP {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.external[family]
+}
+
+// nodeIdPrefix returns the hash of the masked IP and the low 3 bits of r, whose first 21 bits start the node ids
+// derived from the IP.
+func nodeIdPrefix(ip net.IP, r byte) uint32 {
+	mask := nodeIdMaskV6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, nodeIdMaskV4
+	}
+
+	masked := make([]byte, len(mask))
+	for i := range mask {
+		masked[i] = ip[i] & mask[i]
+	}
+	masked[0] |= (r & 0x07) << 5
+
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// isLocalIP reports whether the IP is a loopback, private or link local address.
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestCompliantNodeId(t *testing.T) {
+	// Examples from BEP 42
+	tests := []struct {
+		ip string
+		id string
+	}{
+		{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	}
+
+	for _, test := range tests {
+		id, _ := hex.DecodeString(test.id)
+		if !compliantNodeId(string(id), net.ParseIP(test.ip)) {
+			t.Errorf("Expected node id %s to be compliant with %s", test.id, test.ip)
+		}
+
+		if compliantNodeId(string(id), net.ParseIP("1.2.3.4")) {
+			t.Errorf("Expected node id %s not to be compliant with another IP", test.id)
+		}
+	}
+
+	for _, ip := range []string{"124.31.75.21", "2001:db8::1"} {
+		id, _ := generateSecureNodeId(net.ParseIP(ip))
+		if !compliantNodeId(id, net.ParseIP(ip)) {
+			t.Errorf("Expected generated node id to be compliant with %s", ip)
+		}
+	}
+}
+
+func TestBucketPrefersCompliantNodes(t *testing.T) {
+	table, _ := NewRoutingTable()
+	ip := net.ParseIP("124.31.75.21")
+
+	var nodes []compactNode
+	for i := 0; i < bucketSize; i++ {
+		node := nodeInBucket(table, 0, 1000+i)
+		node.addr.IP = ip
+		nodes = append(nodes, node)
+		table.responded(node)
+	}
+
+	// The bucket is full of nodes whose ids are not derived from their IP, so a compliant node takes the place
+	// of one of them. Only the first bit of the id decides the bucket, so any compliant id with the other first bit fits.
+	var compliant compactNode
+	for {
+		id, _ := generateSecureNodeId(ip)
+		if commonPrefixLen([]byte(id), []byte(table.selfId)) == 0 {
+			compliant = compactNode{id: id, addr: net.UDPAddr{IP: ip, Port: 2000}}
+			break
+		}
+	}
+	table.responded(compliant)
+
+	found := false
+	for _, node := range table.closest(idToTarget(compliant.id), numBuckets*bucketSize, familyIPv4) {
+		if node.id == compliant.id {
+			found = true
+		}
+	}
+
+	if !found || table.Len() != bucketSize {
+		t.Errorf("Expected compliant node to replace a node that is not compliant")
+	}
+}
+
+func TestNodeIdFollowsExternalIP(t *testing.T) {
+	s, err := NewServer(Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+
+	external := net.ParseIP("124.31.75.21")
+	for i := 0; i < externalIPVotes; i++ {
+		s.reportedIP(external, net.UDPAddr{IP: net.IPv4(8, 8, 8, byte(i)), Port: 6881})
+	}
+
+	if !s.ExternalIP().Equal(external) {
+		t.Errorf("Expected external IP %s, got %s", external, s.ExternalIP())
+	}
+
+	if !compliantNodeId(s.table.id(), external) {
+		t.Errorf("Expected node id to be derived from the external IP")
+	}
+}
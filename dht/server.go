@@ -0,0 +1,776 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// Default settings of a DHT node.
+const (
+	DefaultPeerTTL = 30 * time.Minute
+
+	// Items are kept for two hours as recommended by BEP 44, so they must be put again before then to stay in the DHT.
+	DefaultItemTTL = 2 * time.Hour
+
+	// The info hashes returned to sample_infohashes queries are refreshed every six hours, the longest interval
+	// allowed by BEP 51, so that crawlers cannot index our peer store faster than that.
+	DefaultSampleInterval = maxSampleInterval
+
+	// Tokens are valid for ten minutes as recommended by BEP 5, so the secret is rotated every five minutes
+	// and tokens made with the previous secret are still accepted.
+	tokenRotation = 5 * time.Minute
+	tokenLen      = 8
+
+	// Maximum number of peers returned in a get_peers response, which keeps the response within a single packet.
+	maxValues = 50
+)
+
+// KRPC error codes as specified in BEP 5.
+const (
+	krpcErrorGeneric       = 201
+	krpcErrorServer        = 202
+	krpcErrorProtocol      = 203
+	krpcErrorMethodUnknown = 204
+
+	// Errors of put queries as specified in BEP 44
+	krpcErrorValueTooBig      = 205
+	krpcErrorInvalidSignature = 206
+	krpcErrorSaltTooBig       = 207
+	krpcErrorCASMismatch      = 301
+	krpcErrorSeqTooLow        = 302
+)
+
+// Config holds the settings of a DHT node.
+type Config struct {
+	// Addr is the UDP address the node listens on for queries from other nodes.
+	Addr string
+
+	// Addr6 is the UDP address the node listens on for the IPv6 DHT as specified in BEP 32.
+	// An empty address only joins the IPv4 DHT.
+	Addr6 string
+
+	// Table is the routing table of the node. A nil table creates a new one with a random node id.
+	Table *RoutingTable
+
+	// PeerTTL is how long peers announced to us are kept, unless they announce again.
+	PeerTTL time.Duration
+
+	// ItemTTL is how long items put to us are kept, unless they are put again.
+	ItemTTL time.Duration
+
+	// SampleInterval is how often the info hashes returned to sample_infohashes queries are refreshed.
+	SampleInterval time.Duration
+
+	// QueryTimeout is how long to wait for a response to one of our queries.
+	QueryTimeout time.Duration
+
+	// Clock tells the time of the node and its routing table. A nil clock uses the system clock.
+	Clock Clock
+
+	// ListenPacket opens the sockets of ListenAndServe, such as through a proxy. A nil function listens on the network
+	// directly.
+	ListenPacket func(network string, address string) (net.PacketConn, error)
+
+	// Public is set for nodes on the internet, which then ignore nodes and peers at private, loopback and other
+	// addresses that are not routable on the internet.
+	Public bool
+
+	// ReadOnly nodes only make queries and never answer them, as specified in BEP 43, for hosts behind NATs and
+	// firewalls that other nodes cannot reach. Our queries are flagged so that other nodes leave us out of their
+	// routing tables, and lookups work as usual.
+	ReadOnly bool
+
+	// QueryRate is the number of queries per second a single IP may send us before further queries are dropped.
+	QueryRate int
+
+	// BootstrapNodes are the host:port addresses of the routers used to join the DHT. An empty list only uses the
+	// nodes already in the routing table.
+	BootstrapNodes []string
+}
+
+// Server is a DHT node that answers ping, find_node, get_peers and announce_peer queries from other nodes
+// as specified in BEP 5, so that we contribute to the DHT instead of only querying it. The node takes part in
+// the IPv4 and IPv6 DHTs over a socket for each address family, as specified in BEP 32, answers scrapes as specified
+// in BEP 33, stores items with get and put queries as specified in BEP 44, and answers sample_infohashes queries as
+// specified in BEP 51. Read-only nodes as specified in BEP 43 only query other nodes.
+type Server struct {
+	cfg   Config
+	table *RoutingTable
+	peers *peerStore
+	items *itemStore
+
+	ipVotes   ipVoter
+	limiter   *rateLimiter
+	blacklist blacklist
+
+	tokenMu        sync.Mutex
+	secret         [20]byte
+	previousSecret [20]byte
+	lastRotation   time.Time
+
+	mu          sync.Mutex
+	conns       [numFamilies]net.PacketConn
+	transports  [numFamilies]*transport
+	routers     map[string]bool
+	sampleAfter map[string]time.Time
+	ready       chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+}
+
+// krpcQuery is an incoming KRPC message. Only queries are answered, so only the query arguments are decoded, along with
+// the `ro` flag of read-only nodes as specified in BEP 43.
+type krpcQuery struct {
+	T  string    `mapstructure:"t"`
+	Y  string    `mapstructure:"y"`
+	Q  string    `mapstructure:"q"`
+	A  queryArgs `mapstructure:"a"`
+	Ro int       `mapstructure:"ro"`
+}
+
+// Arguments of the queries specified in BEP 5, BEP 33 and BEP 44.
+type queryArgs struct {
+	Id          string      `mapstructure:"id"`
+	Target      string      `mapstructure:"target"`
+	InfoHash    string      `mapstructure:"info_hash"`
+	Port        int         `mapstructure:"port"`
+	ImpliedPort int         `mapstructure:"implied_port"`
+	Token       string      `mapstructure:"token"`
+	Seed        int         `mapstructure:"seed"`
+	Scrape      int         `mapstructure:"scrape"`
+	NoSeed      int         `mapstructure:"noseed"`
+	Want        []string    `mapstructure:"want"`
+	V           interface{} `mapstructure:"v"`
+	K           string      `mapstructure:"k"`
+	Sig         string      `mapstructure:"sig"`
+	Salt        string      `mapstructure:"salt"`
+	Seq         *int        `mapstructure:"seq"`
+	Cas         *int        `mapstructure:"cas"`
+}
+
+// krpcError is a KRPC error sent in response to a query that could not be answered.
+type krpcError struct {
+	code    int
+	message string
+}
+
+// NewServer creates a DHT node with the given config.
+//
+// It returns the node, or an error if a routing table could not be created.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.PeerTTL <= 0 {
+		cfg.PeerTTL = DefaultPeerTTL
+	}
+	if cfg.ItemTTL <= 0 {
+		cfg.ItemTTL = DefaultItemTTL
+	}
+	if cfg.SampleInterval <= 0 || cfg.SampleInterval > maxSampleInterval {
+		cfg.SampleInterval = DefaultSampleInterval
+	}
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = defaultQueryTimeout
+	}
+	if cfg.QueryRate <= 0 {
+		cfg.QueryRate = DefaultQueryRate
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+	if cfg.ListenPacket == nil {
+		cfg.ListenPacket = net.ListenPacket
+	}
+
+	table := cfg.Table
+	if table == nil {
+		var err error
+		table, err = NewRoutingTable()
+		if err != nil {
+			return nil, err
+		}
+	}
+	table.setClock(cfg.Clock)
+
+	s := &Server{
+		cfg:         cfg,
+		table:       table,
+		peers:       newPeerStore(cfg.PeerTTL),
+		items:       newItemStore(cfg.ItemTTL),
+		limiter:     newRateLimiter(cfg.QueryRate),
+		routers:     make(map[string]bool),
+		sampleAfter: make(map[string]time.Time),
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if err := s.rotateSecret(cfg.Clock.Now()); err != nil {
+		return nil, err
+	}
+	s.previousSecret = s.secret
+
+	return s, nil
+}
+
+// Table returns the routing table of the node.
+func (s *Server) Table() *RoutingTable {
+	return s.table
+}
+
+// ListenAndServe listens on the configured UDP addresses and answers queries until the node is closed.
+// Hosts without IPv6 only join the IPv4 DHT.
+//
+// It returns nil once the node is closed, otherwise it returns the error that stopped it.
+func (s *Server) ListenAndServe() error {
+	conn, err := s.cfg.ListenPacket("udp4", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("Error listening on DHT address: %w", err)
+	}
+
+	conns := []net.PacketConn{conn}
+	if s.cfg.Addr6 != "" {
+		if conn6, err := s.cfg.ListenPacket("udp6", s.cfg.Addr6); err == nil {
+			conns = append(conns, conn6)
+		}
+	}
+
+	return s.Serve(conns...)
+}
+
+// Serve answers queries received on the given connections until the node is closed. There can be a connection
+// for each address family, which is told apart by the connection's local address. The connections are also used
+// for all of our own queries, so lookups can only be made while the node is serving. The node bootstraps when it
+// starts serving, and the routing table is kept healthy, tokens are rotated and expired peers are removed in the
+// background while the node is serving.
+//
+// It returns nil once the node is closed, otherwise it returns the error that stopped a connection.
+func (s *Server) Serve(conns ...net.PacketConn) error {
+	if len(conns) == 0 {
+		return fmt.Errorf("No DHT connections to serve")
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil
+	default:
+	}
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		family := familyIPv4
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			family = familyOf(addr.IP)
+		}
+
+		tr := newTransport(conn, s.cfg.QueryTimeout, s.cfg.ReadOnly, s.handlePacket)
+		s.conns[family] = conn
+		s.transports[family] = tr
+
+		go func() { errs <- tr.serve() }()
+	}
+	close(s.ready)
+	s.wg.Add(2)
+	s.mu.Unlock()
+
+	go s.maintain()
+	go func() {
+		defer s.wg.Done()
+		s.Bootstrap()
+	}()
+
+	err := <-errs
+	select {
+	case <-s.done:
+		return nil
+	default:
+		s.Close()
+		return err
+	}
+}
+
+// Close stops the node and waits for its background work to finish.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		conns := s.conns
+		s.mu.Unlock()
+
+		for _, conn := range conns {
+			if conn != nil {
+				if closeErr := conn.Close(); err == nil {
+					err = closeErr
+				}
+			}
+		}
+
+		s.wg.Wait()
+	})
+
+	return err
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// How often the routing table is checked for stale buckets and questionable nodes.
+const maintenanceInterval = time.Minute
+
+// How many stale buckets are refreshed at once, so that a table full of stale buckets does not hold up maintenance
+// for one lookup per bucket nor flood the network with lookups.
+const maxConcurrentRefreshes = 8
+
+// maintain keeps the routing table healthy, rotates the token secret, removes expired peers and items and forgives
+// blacklisted nodes until the node is closed. Questionable nodes in full buckets are pinged so that bad nodes can be replaced, and buckets that have
+// not changed in 15 minutes are refreshed by looking up a random id in the bucket's range, as specified in BEP 5.
+func (s *Server) maintain() {
+	defer s.wg.Done()
+
+	ticks, stop := s.cfg.Clock.NewTicker(maintenanceInterval)
+	defer stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticks:
+			s.tokenMu.Lock()
+			due := now.Sub(s.lastRotation) >= tokenRotation
+			s.tokenMu.Unlock()
+
+			if due {
+				s.rotateSecret(now)
+			}
+
+			s.peers.expire(now)
+			s.items.expire(now)
+			s.expireSampled(now)
+			s.limiter.expire(now)
+			s.blacklist.expire(now)
+
+			var wg sync.WaitGroup
+			for _, node := range s.table.questionableNodes() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.query(node, "ping", map[string]interface{}{})
+				}()
+			}
+			wg.Wait()
+
+			sem := make(chan struct{}, maxConcurrentRefreshes)
+			for _, b := range s.table.staleBuckets() {
+				sem <- struct{}{}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					s.findNodes(randomIdInBucket(s.table.id(), b.index), b.family)
+				}()
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// localPort returns the port of the node's socket of the address family, or zero if there is no such socket.
+func (s *Server) localPort(family int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns[family] == nil {
+		return 0
+	}
+
+	if addr, ok := s.conns[family].LocalAddr().(*net.UDPAddr); ok {
+		return addr.Port
+	}
+
+	return 0
+}
+
+// transport returns the transport of the address family, waiting for the node to start serving if it has not yet.
+//
+// It returns the transport, or an error if the node was closed or has no socket of the address family.
+func (s *Server) transport(family int) (*transport, error) {
+	select {
+	case <-s.ready:
+	case <-s.done:
+		return nil, errTransportClosed
+	}
+
+	if s.transports[family] == nil {
+		return nil, errNoTransport
+	}
+
+	return s.transports[family], nil
+}
+
+// families returns the address families the node has a socket for, waiting for the node to start serving
+// if it has not yet.
+func (s *Server) families() []int {
+	var families []int
+	for family := range numFamilies {
+		if _, err := s.transport(family); err == nil {
+			families = append(families, family)
+		}
+	}
+
+	return families
+}
+
+// handlePacket answers a single KRPC query received by the transport. Read-only nodes drop every query, as do other
+// nodes for queries from blacklisted nodes, from addresses we do not talk to and from IPs that exceed their query rate.
+//
+// It returns the response to send to the node, or nil if the packet should be ignored.
+func (s *Server) handlePacket(packet []byte, addr *net.UDPAddr) []byte {
+	if s.cfg.ReadOnly {
+		return nil
+	}
+
+	now := s.cfg.Clock.Now()
+	if !s.reachable(addr.IP) || s.blacklist.contains(addr.IP, now) || !s.limiter.allow(addr.IP, now) {
+		return nil
+	}
+
+	var query krpcQuery
+	if err := bencode.Decode(packet, &query); err != nil {
+		// Still let the node know its query was malformed if the transaction id can be recovered
+		var header struct {
+			T string `mapstructure:"t"`
+			Y string `mapstructure:"y"`
+		}
+		if bencode.Decode(packet, &header) != nil || header.Y != "q" {
+			return nil
+		}
+
+		return encodeKRPCError(header.T, krpcError{krpcErrorProtocol, "Malformed query"})
+	}
+
+	if query.Y != "q" {
+		return nil
+	}
+
+	resp, kerr := s.handleQuery(query, addr)
+	if kerr != nil {
+		return encodeKRPCError(query.T, *kerr)
+	}
+
+	// Nodes that send valid queries are candidates for the routing table, unless they are routers or read-only nodes,
+	// which cannot be queried
+	if !s.isRouter(*addr) && query.Ro == 0 {
+		s.table.queried(compactNode{id: query.A.Id, addr: *addr})
+	}
+
+	// The node is told the address we see it at, so that it can derive its node id from its IP as specified in BEP 42
+	resp["id"] = s.table.id()
+	data, err := bencode.Encode(map[string]interface{}{
+		"t":  query.T,
+		"y":  "r",
+		"r":  resp,
+		"ip": string(encodeCompactPeerInfo(net.TCPAddr{IP: addr.IP, Port: addr.Port})),
+	})
+	if err != nil {
+		return encodeKRPCError(query.T, krpcError{krpcErrorServer, "Server Error"})
+	}
+
+	return data
+}
+
+// handleQuery answers a query as specified in BEP 5, BEP 33, BEP 44 and BEP 51.
+//
+// It returns the response arguments without our node id, or a KRPC error if the query is invalid.
+func (s *Server) handleQuery(query krpcQuery, addr *net.UDPAddr) (map[string]interface{}, *krpcError) {
+	if len(query.A.Id) != 20 {
+		return nil, &krpcError{krpcErrorProtocol, "Invalid node id"}
+	}
+
+	switch query.Q {
+	case "ping":
+		return map[string]interface{}{}, nil
+
+	case "find_node":
+		if len(query.A.Target) != 20 {
+			return nil, &krpcError{krpcErrorProtocol, "Invalid target"}
+		}
+
+		resp := map[string]interface{}{}
+		s.addClosestNodes(resp, idToTarget(query.A.Target), query.A.Want, addr)
+
+		return resp, nil
+
+	case "get_peers":
+		if len(query.A.InfoHash) != 20 {
+			return nil, &krpcError{krpcErrorProtocol, "Invalid info hash"}
+		}
+
+		infoHash := idToTarget(query.A.InfoHash)
+		resp := map[string]interface{}{
+			"token": s.token(addr.IP),
+		}
+
+		// Peers of the family the query was received over are returned if we have any, otherwise the closest nodes we know of.
+		// Seeds are left out for nodes that are seeding themselves, as specified in BEP 33
+		now := s.cfg.Clock.Now()
+		peers := s.peers.get(infoHash, maxValues, familyOf(addr.IP), query.A.NoSeed != 0, now)
+		if len(peers) > 0 {
+			values := make([]interface{}, 0, len(peers))
+			for _, peer := range peers {
+				values = append(values, string(encodeCompactPeerInfo(peer)))
+			}
+			resp["values"] = values
+		} else {
+			s.addClosestNodes(resp, infoHash, query.A.Want, addr)
+		}
+
+		if query.A.Scrape != 0 {
+			seeds, others := s.peers.bloomFilters(infoHash, now)
+			resp["BFsd"] = string(seeds[:])
+			resp["BFpe"] = string(others[:])
+		}
+
+		return resp, nil
+
+	case "announce_peer":
+		if len(query.A.InfoHash) != 20 {
+			return nil, &krpcError{krpcErrorProtocol, "Invalid info hash"}
+		}
+
+		if !s.validToken(query.A.Token, addr.IP) {
+			return nil, &krpcError{krpcErrorProtocol, "Bad token"}
+		}
+
+		// The source port of the query is used if the node is behind a NAT that does not know its external port
+		port := query.A.Port
+		if query.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+
+		if port <= 0 || port > 65535 {
+			return nil, &krpcError{krpcErrorProtocol, "Invalid port"}
+		}
+
+		s.peers.add(idToTarget(query.A.InfoHash), net.TCPAddr{IP: addr.IP, Port: port}, query.A.Seed != 0, s.cfg.Clock.Now())
+
+		return map[string]interface{}{}, nil
+
+	case "sample_infohashes":
+		if len(query.A.Target) != 20 {
+			return nil, &krpcError{krpcErrorProtocol, "Invalid target"}
+		}
+
+		samples, num := s.peers.sample(maxSamples, s.cfg.SampleInterval, s.cfg.Clock.Now())
+		encoded := make([]byte, 0, len(samples)*20)
+		for _, infoHash := range samples {
+			encoded = append(encoded, infoHash[:]...)
+		}
+
+		resp := map[string]interface{}{
+			"interval": int(s.cfg.SampleInterval / time.Second),
+			"num":      num,
+			"samples":  string(encoded),
+		}
+		s.addClosestNodes(resp, idToTarget(query.A.Target), query.A.Want, addr)
+
+		return resp, nil
+
+	case "get":
+		if len(query.A.Target) != 20 {
+			return nil, &krpcError{krpcErrorProtocol, "Invalid target"}
+		}
+
+		target := idToTarget(query.A.Target)
+		resp := map[string]interface{}{
+			"token": s.token(addr.IP),
+		}
+		s.addClosestNodes(resp, target, query.A.Want, addr)
+
+		if item, ok := s.items.get(target, s.cfg.Clock.Now()); ok {
+			s.addItem(resp, item, query.A.Seq)
+		}
+
+		return resp, nil
+
+	case "put":
+		if !s.validToken(query.A.Token, addr.IP) {
+			return nil, &krpcError{krpcErrorProtocol, "Bad token"}
+		}
+
+		item := Item{Value: query.A.V}
+		if query.A.K != "" {
+			if query.A.Seq == nil {
+				return nil, &krpcError{krpcErrorProtocol, "Missing sequence number"}
+			}
+
+			item.PublicKey = ed25519.PublicKey(query.A.K)
+			item.Salt = query.A.Salt
+			item.Seq = *query.A.Seq
+			item.Signature = []byte(query.A.Sig)
+		}
+
+		if err := item.Verify(); err != nil {
+			return nil, putError(err)
+		}
+
+		if err := s.items.put(item.Target(), item, query.A.Cas, s.cfg.Clock.Now()); err != nil {
+			return nil, putError(err)
+		}
+
+		return map[string]interface{}{}, nil
+
+	default:
+		return nil, &krpcError{krpcErrorMethodUnknown, "Method Unknown"}
+	}
+}
+
+// addClosestNodes adds the K closest nodes we know of to the target to the response, in `nodes` for IPv4 nodes and
+// `nodes6` for IPv6 nodes. The querying node can ask for either or both with `want` as specified in BEP 32,
+// otherwise it gets the nodes of the family it sent the query over.
+func (s *Server) addClosestNodes(resp map[string]interface{}, target [20]byte, want []string, addr *net.UDPAddr) {
+	wanted := [numFamilies]bool{}
+	for _, w := range want {
+		switch w {
+		case "n4":
+			wanted[familyIPv4] = true
+		case "n6":
+			wanted[familyIPv6] = true
+		}
+	}
+
+	if !wanted[familyIPv4] && !wanted[familyIPv6] {
+		wanted[familyOf(addr.IP)] = true
+	}
+
+	if wanted[familyIPv4] {
+		resp["nodes"] = s.closestNodes(target, familyIPv4)
+	}
+	if wanted[familyIPv6] {
+		resp["nodes6"] = s.closestNodes(target, familyIPv6)
+	}
+}
+
+// addItem adds a stored item to a get response. The value and signature of a mutable item are left out if the
+// querying node already has the item's sequence number, as specified in BEP 44.
+func (s *Server) addItem(resp map[string]interface{}, item Item, seq *int) {
+	if !item.Mutable() {
+		resp["v"] = item.Value
+		return
+	}
+
+	resp["seq"] = item.Seq
+	if seq == nil || item.Seq > *seq {
+		resp["v"] = item.Value
+		resp["k"] = string(item.PublicKey)
+		resp["sig"] = string(item.Signature)
+	}
+}
+
+// closestNodes returns the K closest nodes of the address family we know of to the target in the compact node info format.
+func (s *Server) closestNodes(target [20]byte, family int) string {
+	var nodes []byte
+	for _, node := range s.table.closest(target, bucketSize, family) {
+		nodes = append(nodes, encodeCompactNodeInfo(node)...)
+	}
+
+	return string(nodes)
+}
+
+// token returns the token a node at the given IP must send back to announce to us. Tokens are derived from the IP
+// and a secret, so that only nodes that received a token from us can announce, without storing the tokens.
+func (s *Server) token(ip net.IP) string {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	return makeToken(s.secret, ip)
+}
+
+// validToken checks the token was made for the given IP with the current or the previous secret.
+func (s *Server) validToken(token string, ip net.IP) bool {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	return hmac.Equal([]byte(token), []byte(makeToken(s.secret, ip))) ||
+		hmac.Equal([]byte(token), []byte(makeToken(s.previousSecret, ip)))
+}
+
+// rotateSecret replaces the token secret, keeping the current secret so its tokens are still accepted.
+//
+// It returns an error if a new secret could not be generated.
+func (s *Server) rotateSecret(now time.Time) error {
+	var secret [20]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return fmt.Errorf("Error generating token secret: %w", err)
+	}
+
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	s.previousSecret = s.secret
+	s.secret = secret
+	s.lastRotation = now
+
+	return nil
+}
+
+// makeToken derives the token for an IP from the secret.
+func makeToken(secret [20]byte, ip net.IP) string {
+	mac := hmac.New(sha1.New, secret[:])
+	mac.Write(ip.To16())
+
+	return string(mac.Sum(nil)[:tokenLen])
+}
+
+// encodeKRPCError encodes a KRPC error message for the given transaction id.
+func encodeKRPCError(transactionId string, kerr krpcError) []byte {
+	data, _ := bencode.Encode(map[string]interface{}{
+		"t": transactionId,
+		"y": "e",
+		"e": []interface{}{kerr.code, kerr.message},
+	})
+
+	return data
+}
+
+// putError returns the KRPC error for an item that could not be stored, as specified in BEP 44.
+func putError(err error) *krpcError {
+	switch {
+	case errors.Is(err, errValueTooBig):
+		return &krpcError{krpcErrorValueTooBig, err.Error()}
+	case errors.Is(err, errInvalidSignature):
+		return &krpcError{krpcErrorInvalidSignature, err.Error()}
+	case errors.Is(err, errSaltTooBig):
+		return &krpcError{krpcErrorSaltTooBig, err.Error()}
+	case errors.Is(err, errCASMismatch):
+		return &krpcError{krpcErrorCASMismatch, err.Error()}
+	case errors.Is(err, errSeqTooLow):
+		return &krpcError{krpcErrorSeqTooLow, err.Error()}
+	case errors.Is(err, errStoreFull):
+		return &krpcError{krpcErrorServer, err.Error()}
+	default:
+		return &krpcError{krpcErrorProtocol, err.Error()}
+	}
+}
+
+// encodeCompactPeerInfo encodes a peer in the 6 byte compact peer info format as specified in BEP 5,
+// or the 18 byte format for IPv6 peers as specified in BEP 32.
+func encodeCompactPeerInfo(addr net.TCPAddr) []byte {
+	buf := make([]byte, 0, compactPeerLenV6)
+	buf = append(buf, compactIP(addr.IP)...)
+
+	return binary.BigEndian.AppendUint16(buf, uint16(addr.Port))
+}
@@ -0,0 +1,142 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// Struct for decoding the responses of the test node.
+type testResp struct {
+	T string        `mapstructure:"t"`
+	Y string        `mapstructure:"y"`
+	R dhtResp       `mapstructure:"r"`
+	E []interface{} `mapstructure:"e"`
+}
+
+// startTestServer starts a DHT node on a local UDP port and returns a connection to it.
+func startTestServer(t *testing.T) (*Server, net.Conn) {
+	s, err := NewServer(Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+
+	go s.Serve(pc)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error dialing DHT node: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return s, conn
+}
+
+// query sends a query to the test node and decodes its response.
+func query(t *testing.T, conn net.Conn, method string, args map[string]interface{}) testResp {
+	data, err := bencode.Encode(map[string]interface{}{
+		"t": "tx",
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding query: %v", err)
+	}
+
+	conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The node may query us in the meantime, such as while bootstrapping, so its queries are skipped
+	var resp testResp
+	buf := make([]byte, 4096)
+	for resp.Y == "" || resp.Y == "q" {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error reading response to %s: %v", method, err)
+		}
+
+		resp = testResp{}
+		if err := bencode.Decode(buf[:n], &resp); err != nil {
+			t.Fatalf("Unexpected error decoding response to %s: %v", method, err)
+		}
+	}
+
+	if resp.T != "tx" {
+		t.Errorf("Expected transaction id tx, got %q", resp.T)
+	}
+
+	return resp
+}
+
+func TestServerAnswersQueries(t *testing.T) {
+	s, conn := startTestServer(t)
+	remoteId := string(make([]byte, 20))
+	infoHash := "abcdefghijklmnopqrst"
+
+	resp := query(t, conn, "ping", map[string]interface{}{"id": remoteId})
+	if resp.Y != "r" || resp.R.Id != s.table.selfId {
+		t.Fatalf("Expected ping response with our node id, got %+v", resp)
+	}
+
+	resp = query(t, conn, "get_peers", map[string]interface{}{"id": remoteId, "info_hash": infoHash})
+	if resp.R.Token == "" || len(resp.R.Values) != 0 {
+		t.Fatalf("Expected token and no peers, got %+v", resp)
+	}
+
+	announce := query(t, conn, "announce_peer", map[string]interface{}{
+		"id":        remoteId,
+		"info_hash": infoHash,
+		"port":      6881,
+		"token":     resp.R.Token,
+	})
+	if announce.Y != "r" {
+		t.Fatalf("Expected announce to be accepted, got %+v", announce)
+	}
+
+	resp = query(t, conn, "get_peers", map[string]interface{}{"id": remoteId, "info_hash": infoHash})
+	if len(resp.R.Values) != 1 {
+		t.Fatalf("Expected announced peer to be returned, got %+v", resp)
+	}
+
+	if peer := parseCompactPeerInfo(resp.R.Values[0]); peer.String() != "127.0.0.1:6881" {
+		t.Errorf("Expected peer 127.0.0.1:6881, got %s", peer.String())
+	}
+
+	// The node that queried us is now a candidate in the routing table
+	if s.table.Len() != 1 {
+		t.Errorf("Expected querying node to be added to the routing table, got %d nodes", s.table.Len())
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	_, conn := startTestServer(t)
+	remoteId := string(make([]byte, 20))
+
+	tests := []struct {
+		method string
+		args   map[string]interface{}
+		code   int
+	}{
+		{"announce_peer", map[string]interface{}{"id": remoteId, "info_hash": "abcdefghijklmnopqrst", "port": 6881, "token": "bad"}, krpcErrorProtocol},
+		{"find_node", map[string]interface{}{"id": remoteId, "target": "short"}, krpcErrorProtocol},
+		{"ping", map[string]interface{}{"id": "short"}, krpcErrorProtocol},
+		{"get_peers", map[string]interface{}{"id": remoteId, "info_hash": 5}, krpcErrorProtocol},
+		{"vote", map[string]interface{}{"id": remoteId}, krpcErrorMethodUnknown},
+	}
+
+	for _, test := range tests {
+		resp := query(t, conn, test.method, test.args)
+		if resp.Y != "e" || len(resp.E) != 2 || resp.E[0] != test.code {
+			t.Errorf("Expected error %d for %s, got %+v", test.code, test.method, resp)
+		}
+	}
+}
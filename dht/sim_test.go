@@ -0,0 +1,234 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/dht/simnet"
+)
+
+// simulation is a network of in-memory DHT nodes sharing a virtual clock.
+type simulation struct {
+	network *simnet.Network
+	clock   *simnet.Clock
+	nodes   []*Server
+}
+
+// startSimulation starts n DHT nodes on a simulated network, where every node joins the DHT through the first node.
+// The nodes join over a perfect network, after which the latency, jitter and loss of cfg apply.
+func startSimulation(t *testing.T, n int, cfg simnet.Config) *simulation {
+	sim := &simulation{
+		network: simnet.NewNetwork(simnet.Config{Seed: cfg.Seed}),
+		clock:   simnet.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+
+	for range n {
+		sim.join(t, Config{})
+	}
+
+	sim.network.SetConditions(cfg.Latency, cfg.Jitter, cfg.Loss)
+
+	return sim
+}
+
+// join starts another node on the simulated network, and joins the DHT through the first node. The node's address,
+// routing table and sockets are filled into cfg, and nodes without a clock use the simulation's clock. Node ids are
+// derived from the index of the node, so that every run builds the same DHT.
+func (sim *simulation) join(t *testing.T, cfg Config) *Server {
+	i := len(sim.nodes)
+	id := sha1.Sum([]byte(fmt.Sprintf("node %d", i)))
+
+	cfg.Addr = simAddr(i).String()
+	cfg.Table = newRoutingTable(string(id[:]))
+	cfg.QueryTimeout = 200 * time.Millisecond
+	cfg.ListenPacket = sim.network.ListenPacket
+	if cfg.Clock == nil {
+		cfg.Clock = sim.clock
+	}
+
+	node, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node %d: %v", i, err)
+	}
+
+	go node.ListenAndServe()
+	t.Cleanup(func() { node.Close() })
+
+	// Packets to an address nobody listens on yet are dropped, so the node must be serving before others join through it
+	select {
+	case <-node.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DHT node %d did not start serving", i)
+	}
+
+	if i > 0 {
+		node.AddNodes([]string{simAddr(0).String()})
+		if err := node.Bootstrap(); err != nil {
+			t.Fatalf("Unexpected error bootstrapping DHT node %d: %v", i, err)
+		}
+	}
+
+	sim.nodes = append(sim.nodes, node)
+
+	return node
+}
+
+// simAddr returns the address of the node with the given index in a simulation.
+func simAddr(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 6881}
+}
+
+// node returns the compact node info of the node with the given index in the simulation.
+func (sim *simulation) node(i int) compactNode {
+	return compactNode{id: sim.nodes[i].table.id(), addr: *simAddr(i)}
+}
+
+// waitFor waits until the condition holds, failing the test if it does not within a few seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSimulatedAnnounceAndLookup(t *testing.T) {
+	sim := startSimulation(t, 200, simnet.Config{Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.05, Seed: 1})
+	infoHash := sha1.Sum([]byte("torrent"))
+
+	if _, err := sim.nodes[10].Announce(infoHash, 7000); err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	peers, err := sim.nodes[150].GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error getting peers: %v", err)
+	}
+
+	found := false
+	for _, peer := range peers {
+		found = found || peer.String() == "10.0.0.10:7000"
+	}
+	if !found {
+		t.Errorf("Expected announced peer 10.0.0.10:7000, got %v", peers)
+	}
+}
+
+func TestSimulatedTokenRotation(t *testing.T) {
+	sim := startSimulation(t, 20, simnet.Config{Seed: 1})
+	infoHash := sha1.Sum([]byte("torrent"))
+	announcer, storer := sim.nodes[1], sim.nodes[2]
+
+	res, err := announcer.getPeers(sim.node(2), infoHash, false, false)
+	if err != nil {
+		t.Fatalf("Unexpected error getting a token: %v", err)
+	}
+
+	rotated := func() bool {
+		storer.tokenMu.Lock()
+		defer storer.tokenMu.Unlock()
+
+		return storer.lastRotation.Equal(sim.clock.Now())
+	}
+
+	// Tokens made with the previous secret are still accepted after a rotation
+	sim.clock.Advance(tokenRotation)
+	waitFor(t, "the token secret to rotate", rotated)
+
+	if err := announcer.announcePeer(sim.node(2), infoHash, 7000, false, res.Token.token); err != nil {
+		t.Fatalf("Expected token to be accepted after one rotation, got %v", err)
+	}
+
+	sim.clock.Advance(tokenRotation)
+	waitFor(t, "the token secret to rotate again", rotated)
+
+	if err := announcer.announcePeer(sim.node(2), infoHash, 7000, false, res.Token.token); err == nil {
+		t.Errorf("Expected token to be rejected after two rotations")
+	}
+}
+
+func TestSimulatedBucketRefresh(t *testing.T) {
+	sim := startSimulation(t, 50, simnet.Config{Seed: 1})
+
+	// The node runs on its own clock, so that only its buckets go stale while the rest of the DHT stays idle
+	clock := simnet.NewClock(sim.clock.Now())
+	table := sim.join(t, Config{Clock: clock}).table
+
+	table.mu.Lock()
+	var stale []int
+	for i, b := range table.buckets[familyIPv4] {
+		if len(b.nodes) > 0 {
+			stale = append(stale, i)
+		}
+	}
+	table.mu.Unlock()
+
+	// Without any traffic every bucket goes stale, and is refreshed by querying nodes in its range
+	clock.Advance(refreshInterval + maintenanceInterval)
+	refreshedAt := clock.Now()
+
+	waitFor(t, "every bucket to be refreshed", func() bool {
+		table.mu.Lock()
+		defer table.mu.Unlock()
+
+		for _, i := range stale {
+			heard := false
+			for _, node := range table.buckets[familyIPv4][i].nodes {
+				heard = heard || !node.lastResponse.Before(refreshedAt)
+			}
+			if !heard {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+func TestSimulatedReadOnlyNode(t *testing.T) {
+	sim := startSimulation(t, 50, simnet.Config{Seed: 1})
+	infoHash := sha1.Sum([]byte("torrent"))
+
+	if _, err := sim.nodes[10].Announce(infoHash, 7000); err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	readOnly := sim.join(t, Config{ReadOnly: true})
+	i := len(sim.nodes) - 1
+
+	// Lookups work as usual
+	peers, err := readOnly.GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error getting peers: %v", err)
+	}
+
+	found := false
+	for _, peer := range peers {
+		found = found || peer.String() == "10.0.0.10:7000"
+	}
+	if !found {
+		t.Errorf("Expected announced peer 10.0.0.10:7000, got %v", peers)
+	}
+
+	// The node does not answer queries, and other nodes leave it out of their routing tables
+	if _, err := sim.nodes[1].query(sim.node(i), "ping", map[string]interface{}{}); !errors.Is(err, errQueryTimeout) {
+		t.Errorf("Expected ping of read-only node to time out, got %v", err)
+	}
+
+	for j, node := range sim.nodes[:i] {
+		for _, n := range node.table.closest(idToTarget(readOnly.table.id()), bucketSize, familyIPv4) {
+			if n.addr.String() == simAddr(i).String() {
+				t.Fatalf("Expected read-only node to be left out of node %d's routing table", j)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package simnet
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a virtual clock that only moves when it is advanced, so that hours of expiry, token rotation and routing
+// table maintenance can be simulated in an instant. It implements dht.Clock.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers map[*ticker]bool
+}
+
+// ticker delivers the time of the clock every period.
+type ticker struct {
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+// NewClock creates a virtual clock that starts at the given time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{
+		now:     start,
+		tickers: make(map[*ticker]bool),
+	}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTicker returns a channel that delivers the time of the clock every time it is advanced past another period,
+// along with a function that stops the ticker. Like time.Ticker, a tick is dropped if the previous one has not been
+// received yet, so advancing the clock by several periods at once delivers a single tick.
+func (c *Clock) NewTicker(period time.Duration) (<-chan time.Time, func()) {
+	if period <= 0 {
+		panic("simnet: non-positive interval for NewTicker")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &ticker{
+		c:      make(chan time.Time, 1),
+		period: period,
+		next:   c.now.Add(period),
+	}
+	c.tickers[t] = true
+
+	stop := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.tickers, t)
+	}
+
+	return t.c, stop
+}
+
+// Advance moves the clock forward, delivering a tick to every ticker whose next period has passed.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	for t := range c.tickers {
+		if c.now.Before(t.next) {
+			continue
+		}
+
+		select {
+		case t.c <- c.now:
+		default:
+		}
+
+		for !c.now.Before(t.next) {
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
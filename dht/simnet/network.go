@@ -0,0 +1,256 @@
+package simnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of packets a socket buffers before further packets to it are dropped, like a full UDP receive buffer.
+const inboxSize = 1024
+
+// First port handed out to sockets that listen on port zero.
+const firstEphemeralPort = 49152
+
+var errClosed = errors.New("Simulated socket is closed")
+
+// Config holds the conditions of a simulated network.
+type Config struct {
+	// Latency is how long every packet takes to arrive.
+	Latency time.Duration
+
+	// Jitter is the most a packet is delayed on top of the latency, chosen at random for every packet.
+	Jitter time.Duration
+
+	// Loss is the fraction of packets that are dropped, between 0 and 1.
+	Loss float64
+
+	// Seed seeds the random loss and jitter, so that a simulation drops and delays the same packets every run
+	// as long as they are sent in the same order.
+	Seed int64
+}
+
+// Network is an in-memory UDP network, so that many DHT nodes can talk to each other within a single process
+// without real sockets.
+type Network struct {
+	mu       sync.Mutex
+	cfg      Config
+	random   *rand.Rand
+	conns    map[string]*Conn
+	nextPort int
+}
+
+// Conn is a UDP socket on a simulated network. It implements net.PacketConn.
+type Conn struct {
+	network *Network
+	addr    *net.UDPAddr
+	inbox   chan packet
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// packet is a packet waiting to be read, along with the address it was sent from.
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// NewNetwork creates a simulated network with the given conditions.
+func NewNetwork(cfg Config) *Network {
+	return &Network{
+		cfg:      cfg,
+		random:   rand.New(rand.NewSource(cfg.Seed)),
+		conns:    make(map[string]*Conn),
+		nextPort: firstEphemeralPort,
+	}
+}
+
+// SetConditions changes the latency, jitter and loss of the network. Packets already in flight are not affected.
+func (n *Network) SetConditions(latency time.Duration, jitter time.Duration, loss float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.cfg.Latency = latency
+	n.cfg.Jitter = jitter
+	n.cfg.Loss = loss
+}
+
+// ListenPacket opens a socket on the network, with the same arguments as net.ListenPacket. The address must have an
+// IP of the network's family, and a port of zero picks a free port.
+//
+// It returns the socket, or an error if the address is invalid or already in use.
+func (n *Network) ListenPacket(network string, address string) (net.PacketConn, error) {
+	if network != "udp4" && network != "udp6" {
+		return nil, fmt.Errorf("Simulated network only supports udp4 and udp6, got %q", network)
+	}
+
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.IP == nil || addr.IP.IsUnspecified() || (addr.IP.To4() != nil) != (network == "udp4") {
+		return nil, fmt.Errorf("Simulated sockets need an IP of the %s family, got %q", network, address)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if addr.Port == 0 {
+		for n.conns[(&net.UDPAddr{IP: addr.IP, Port: n.nextPort}).String()] != nil {
+			n.nextPort++
+		}
+		addr.Port = n.nextPort
+		n.nextPort++
+	}
+
+	if n.conns[addr.String()] != nil {
+		return nil, fmt.Errorf("Simulated address %s is already in use", addr)
+	}
+
+	conn := &Conn{
+		network: n,
+		addr:    addr,
+		inbox:   make(chan packet, inboxSize),
+		closed:  make(chan struct{}),
+	}
+	n.conns[addr.String()] = conn
+
+	return conn, nil
+}
+
+// ReadFrom reads the next packet sent to the socket, waiting until one arrives, the socket is closed or the read
+// deadline passes.
+func (c *Conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case pkt := <-c.inbox:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-c.closed:
+		return 0, nil, errClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo sends the packet to the socket at the address, unless the network drops it. Like UDP, packets to addresses
+// nobody listens on are silently dropped.
+func (c *Conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("Simulated sockets can only send to UDP addresses, got %v", addr)
+	}
+
+	delay, lost := c.network.conditions()
+	if lost {
+		return len(p), nil
+	}
+
+	pkt := packet{data: append([]byte(nil), p...), from: c.addr}
+	if delay == 0 {
+		c.network.deliver(to, pkt)
+	} else {
+		time.AfterFunc(delay, func() { c.network.deliver(to, pkt) })
+	}
+
+	return len(p), nil
+}
+
+// Close closes the socket, so that its address can be listened on again and pending reads return an error.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.network.mu.Lock()
+		if c.network.conns[c.addr.String()] == c {
+			delete(c.network.conns, c.addr.String())
+		}
+		c.network.mu.Unlock()
+	})
+
+	return nil
+}
+
+// LocalAddr returns the address of the socket.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets the read deadline of the socket. Writes never block, so they have no deadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the time after which reads fail with a timeout. A zero time means reads do not time out.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes never block.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// conditions draws how long the next packet takes to arrive, and whether it is lost.
+func (n *Network) conditions() (time.Duration, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.cfg.Loss > 0 && n.random.Float64() < n.cfg.Loss {
+		return 0, true
+	}
+
+	delay := n.cfg.Latency
+	if n.cfg.Jitter > 0 {
+		delay += time.Duration(n.random.Int63n(int64(n.cfg.Jitter)))
+	}
+
+	return delay, false
+}
+
+// deliver puts the packet in the inbox of the socket at the address, dropping it if nobody listens there or the
+// socket's inbox is full.
+func (n *Network) deliver(to *net.UDPAddr, pkt packet) {
+	n.mu.Lock()
+	conn := n.conns[to.String()]
+	n.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	select {
+	case conn.inbox <- pkt:
+	default:
+	}
+}
@@ -0,0 +1,99 @@
+package simnet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNetworkDeliversPackets(t *testing.T) {
+	network := NewNetwork(Config{Latency: time.Millisecond})
+
+	a, err := network.ListenPacket("udp4", "10.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+	b, err := network.ListenPacket("udp4", "10.0.0.2:6881")
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+
+	if _, err := network.ListenPacket("udp4", "10.0.0.2:6881"); err == nil {
+		t.Errorf("Expected error listening on an address in use")
+	}
+
+	a.WriteTo([]byte("ping"), b.LocalAddr())
+
+	buf := make([]byte, 16)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error reading: %v", err)
+	}
+
+	if string(buf[:n]) != "ping" || from.String() != a.LocalAddr().String() {
+		t.Errorf("Expected ping from %s, got %q from %s", a.LocalAddr(), buf[:n], from)
+	}
+
+	// Reads time out like a real socket once nothing else arrives
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var netErr net.Error
+	if _, _, err := b.ReadFrom(buf); !errors.As(err, &netErr) || !netErr.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+}
+
+func TestNetworkLossIsSeeded(t *testing.T) {
+	delivered := func() int {
+		network := NewNetwork(Config{Loss: 0.5, Seed: 7})
+		a, _ := network.ListenPacket("udp4", "10.0.0.1:6881")
+		b, _ := network.ListenPacket("udp4", "10.0.0.2:6881")
+
+		for range 100 {
+			a.WriteTo([]byte("x"), b.LocalAddr())
+		}
+
+		return len(b.(*Conn).inbox)
+	}
+
+	first := delivered()
+	if first == 0 || first == 100 {
+		t.Fatalf("Expected some packets to be lost, got %d of 100 delivered", first)
+	}
+
+	if second := delivered(); second != first {
+		t.Errorf("Expected the same packets to be lost with the same seed, got %d and %d delivered", first, second)
+	}
+}
+
+func TestClockTicks(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	ticks, stop := clock.NewTicker(time.Minute)
+	defer stop()
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-ticks:
+		t.Fatalf("Expected no tick before the period passed")
+	default:
+	}
+
+	// Advancing by several periods delivers a single tick with the current time
+	clock.Advance(5 * time.Minute)
+	select {
+	case now := <-ticks:
+		if !now.Equal(time.Unix(330, 0)) {
+			t.Errorf("Expected tick at 5m30s, got %s", now)
+		}
+	default:
+		t.Fatalf("Expected a tick once the period passed")
+	}
+
+	select {
+	case <-ticks:
+		t.Errorf("Expected a single tick")
+	default:
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/anthony/BT/dht"
+	"github.com/anthony/BT/dht/crawler"
+	"github.com/anthony/BT/download"
+)
+
+// runDHTCommand handles the `dht` subcommand, which gets and puts items in the DHT as specified in BEP 44,
+// scrapes the size of a swarm as specified in BEP 33, or crawls the DHT for active info hashes as specified in BEP 51.
+//
+// `dht get <target>` gets the immutable item stored under a hex encoded target, and `dht get <public key>` gets the
+// mutable item of a hex encoded ed25519 public key. `dht put <value>` puts the string value as an immutable item,
+// or as a mutable item signed with the key in the file given with -key. `dht scrape <info hash>` prints the estimated
+// number of seeders and leechers of a hex encoded info hash. `dht crawl` indexes the info hashes
+// sampled from the DHT into the JSONL file given with -index until it is interrupted.
+func runDHTCommand(args []string) {
+	if len(args) == 0 || (args[0] != "get" && args[0] != "put" && args[0] != "scrape" && args[0] != "crawl") {
+		fmt.Println("Usage: dht get [flags] <target or public key>")
+		fmt.Println("       dht put [flags] <value>")
+		fmt.Println("       dht scrape [flags] <info hash>")
+		fmt.Println("       dht crawl [flags]")
+		os.Exit(1)
+	}
+
+	cfg := download.DefaultConfig()
+	flags := flag.NewFlagSet("dht "+args[0], flag.ExitOnError)
+	port := flags.Int("port", 0, "UDP port of our DHT node, 0 for a random port")
+	bootstrap := flags.String("bootstrap", strings.Join(cfg.DHTBootstrapNodes, ","), "comma separated host:port routers used to join the DHT")
+	readOnly := flags.Bool("read-only", cfg.DHTReadOnly, "only query the DHT without answering queries, for hosts behind NATs and firewalls")
+	salt := flags.String("salt", "", "salt of the mutable item, so that a key can publish several items")
+	keyPath := flags.String("key", "", "file of the hex encoded ed25519 seed mutable items are signed with, created if it does not exist")
+	seq := flags.Int("seq", -1, "sequence number of the mutable item, by default one more than the current item")
+	indexPath := flags.String("index", "index.jsonl", "JSONL file the crawler appends discovered info hashes to")
+	workers := flags.Int("workers", crawler.DefaultMetadataWorkers, "number of info hashes whose metadata the crawler fetches at once")
+	flags.Parse(args[1:])
+
+	if (args[0] == "crawl") != (flags.NArg() == 0) || flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	statePath := ""
+	if cfg.StateDir != "" {
+		statePath = filepath.Join(cfg.StateDir, "dht")
+	}
+
+	node, err := startDHTNode(*port, *bootstrap, *readOnly, statePath)
+	if err != nil {
+		fmt.Printf("Error: Failed to start DHT node, %s\n", err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "get":
+		err = dhtGet(node, flags.Arg(0), *salt)
+	case "put":
+		err = dhtPut(node, flags.Arg(0), *keyPath, *salt, *seq)
+	case "scrape":
+		err = dhtScrape(node, flags.Arg(0))
+	case "crawl":
+		err = dhtCrawl(node, *indexPath, *workers)
+	}
+
+	node.Close()
+	if statePath != "" {
+		if saveErr := node.Table().Save(statePath); saveErr != nil {
+			fmt.Printf("Error saving DHT routing table: %s\n", saveErr)
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// startDHTNode starts a DHT node with the routing table persisted at statePath, and waits for it to bootstrap.
+// A read-only node only queries other nodes.
+//
+// It returns the node, or an error if the routing table could not be loaded or the node could not join the DHT.
+func startDHTNode(port int, bootstrap string, readOnly bool, statePath string) (*dht.Server, error) {
+	var table *dht.RoutingTable
+	var err error
+	if statePath != "" {
+		table, err = dht.LoadRoutingTable(statePath)
+	} else {
+		table, err = dht.NewRoutingTable()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var routers []string
+	for _, router := range strings.Split(bootstrap, ",") {
+		if router = strings.TrimSpace(router); router != "" {
+			routers = append(routers, router)
+		}
+	}
+
+	node, err := dht.NewServer(dht.Config{
+		Addr:           fmt.Sprintf(":%d", port),
+		Addr6:          fmt.Sprintf("[::]:%d", port),
+		Table:          table,
+		BootstrapNodes: routers,
+		Public:         true,
+		ReadOnly:       readOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go node.ListenAndServe()
+
+	if err := node.Bootstrap(); err != nil {
+		node.Close()
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// dhtGet gets the item of a hex encoded target or public key and prints its value.
+func dhtGet(node *dht.Server, key string, salt string) error {
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("Invalid target or public key %q", key)
+	}
+
+	switch len(decoded) {
+	case 20:
+		value, err := node.GetImmutable([20]byte(decoded))
+		if err != nil {
+			return err
+		}
+
+		printItemValue(value)
+	case ed25519.PublicKeySize:
+		item, err := node.GetMutable(ed25519.PublicKey(decoded), salt)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Sequence number: %d\n", item.Seq)
+		printItemValue(item.Value)
+	default:
+		return fmt.Errorf("Invalid target or public key %q, expected 20 or 32 hex encoded bytes", key)
+	}
+
+	return nil
+}
+
+// dhtPut puts the value as an immutable item, or as a mutable item if a key file is given. Unless a sequence number
+// is given, mutable items replace the current item with one more than its sequence number, using it as the CAS so
+// that concurrent updates are not lost.
+func dhtPut(node *dht.Server, value string, keyPath string, salt string, seq int) error {
+	if keyPath == "" {
+		target, err := node.Put(dht.Item{Value: value})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Stored immutable item under target %x\n", target)
+		return nil
+	}
+
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	cas := -1
+	if seq < 0 {
+		seq = 0
+		if current, err := node.GetMutable(key.Public().(ed25519.PublicKey), salt); err == nil {
+			cas = current.Seq
+			seq = current.Seq + 1
+		}
+	}
+
+	item, err := dht.NewMutableItem(key, salt, seq, value)
+	if err != nil {
+		return err
+	}
+
+	var target [20]byte
+	if cas >= 0 {
+		target, err = node.CompareAndPut(item, cas)
+	} else {
+		target, err = node.Put(item)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Stored mutable item %d of public key %x under target %x\n", seq, item.PublicKey, target)
+	return nil
+}
+
+// dhtScrape estimates the size of the swarm of a hex encoded info hash and prints it.
+func dhtScrape(node *dht.Server, key string) error {
+	infoHash, err := hex.DecodeString(key)
+	if err != nil || len(infoHash) != 20 {
+		return fmt.Errorf("Invalid info hash %q, expected 20 hex encoded bytes", key)
+	}
+
+	result, err := node.Scrape([20]byte(infoHash))
+	if err != nil {
+		return err
+	}
+
+	printScrape(result)
+	return nil
+}
+
+// dhtCrawl runs a crawler that appends the info hashes it discovers to the index file until it is interrupted.
+func dhtCrawl(node *dht.Server, indexPath string, workers int) error {
+	index, err := os.OpenFile(indexPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening index: %w", err)
+	}
+	defer index.Close()
+
+	c, err := crawler.New(crawler.Config{
+		Node:            node,
+		Index:           index,
+		MetadataWorkers: workers,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stop crawling when interrupted
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(done)
+	}()
+
+	fmt.Printf("Crawling the DHT into %s\n", indexPath)
+	return c.Run(done)
+}
+
+// loadSigningKey reads the hex encoded ed25519 seed in the file, generating a new key and saving its seed
+// if the file does not exist.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("Error saving key: %w", err)
+		}
+
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Invalid key file %q, expected a hex encoded ed25519 seed", path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// printItemValue prints the value of an item, printing strings as is.
+func printItemValue(value interface{}) {
+	if s, ok := value.(string); ok {
+		fmt.Println(s)
+		return
+	}
+
+	fmt.Printf("%v\n", value)
+}
@@ -1,99 +1,368 @@
 package download
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/anthony/BT/dht"
 	"github.com/anthony/BT/peer"
+	"github.com/anthony/BT/piece"
+	"github.com/anthony/BT/proxy"
 	"github.com/anthony/BT/torrent"
 	"github.com/anthony/BT/tracker"
 )
 
-// DownloadFile takes in the path to a torrent file and downloads the file(s) specified in the torrent file.
-func DownloadFile(source string) {
-	tf, err := torrent.ExtractInfo(source)
+// Longest we wait for a peer to send us the metadata of a magnet link.
+const metadataTimeout = 30 * time.Second
+
+// Config holds the settings of a download session.
+type Config struct {
+	// Port we listen for peers on, which is reported to trackers and the DHT. Zero picks a random port.
+	Port int
+
+	// DHTPort is the UDP port our DHT node sends queries from and answers queries from other nodes on.
+	// Zero picks a random port.
+	DHTPort int
+
+	// DHTBootstrapNodes are the host:port addresses of the routers used to join the DHT.
+	DHTBootstrapNodes []string
+
+	// DHTReadOnly makes our DHT node read-only as specified in BEP 43, so that it looks up peers without answering
+	// queries, for hosts behind NATs and firewalls that other nodes cannot reach.
+	DHTReadOnly bool
+
+	// SeedRatio is how many times the size of a torrent we upload after downloading it before we stop seeding,
+	// and SeedTime is the longest we seed for. Seeding stops at whichever target is reached first, and a zero
+	// target is no target. Zero for both stops straight after downloading.
+	SeedRatio float64
+	SeedTime  time.Duration
+
+	// UploadSlots is the number of peers we upload to at once.
+	UploadSlots int
+
+	// StateDir is the directory state is persisted to between runs. An empty directory disables persistence.
+	StateDir string
+
+	// Proxy is the url of a SOCKS5 or HTTP CONNECT proxy that all connections are made through.
+	// An empty url connects directly.
+	Proxy string
+
+	// TrackerHTTP configures the HTTP client used for HTTP and HTTPS trackers.
+	TrackerHTTP tracker.HTTPConfig
+}
+
+// Session downloads torrents and keeps the state shared between them, such as the health of trackers
+// and the DHT routing table.
+type Session struct {
+	cfg      Config
+	peerId   [20]byte
+	dialer   proxy.Dialer
+	trackers *tracker.Manager
+	listener *peer.Listener
+
+	dhtTable     *dht.RoutingTable
+	dhtServer    *dht.Server
+	dhtStatePath string
+}
+
+// Status is a snapshot of the state of a session.
+type Status struct {
+	Trackers []tracker.Status
+	DHTNodes int
+}
+
+// DefaultConfig returns the default session config, which persists state to the user's cache directory.
+func DefaultConfig() Config {
+	cfg := Config{
+		Port:              6881,
+		DHTPort:           6881,
+		DHTBootstrapNodes: dht.DefaultBootstrapNodes,
+		SeedRatio:         1,
+		SeedTime:          time.Hour,
+		UploadSlots:       peer.DefaultUploadSlots,
+		TrackerHTTP:       tracker.DefaultHTTPConfig(),
+	}
+
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		cfg.StateDir = filepath.Join(cacheDir, "bt")
+	}
+
+	return cfg
+}
+
+// NewSession creates a download session with the given config, restoring any persisted state, and starts listening
+// for peers. Every tracker, peer and DHT connection of the session is made through the proxy in the config.
+//
+// It returns the session, or an error if the proxy is invalid, the persisted state could not be loaded or the port
+// could not be listened on.
+func NewSession(cfg Config) (*Session, error) {
+	s := &Session{cfg: cfg}
+	rand.Read(s.peerId[:])
+
+	dialer, err := proxy.FromURL(cfg.Proxy)
 	if err != nil {
-		fmt.Printf("Error: Failed to extract torrent file metadata, %s\n", err)
+		return nil, err
+	}
+	s.dialer = dialer
+
+	trackerStatePath := ""
+	if cfg.StateDir != "" {
+		if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating state directory: %w", err)
+		}
+		trackerStatePath = filepath.Join(cfg.StateDir, "trackers")
+		s.dhtStatePath = filepath.Join(cfg.StateDir, "dht")
+	}
+
+	trackers, err := tracker.NewManager(trackerStatePath, cfg.TrackerHTTP, dialer)
+	if err != nil {
+		return nil, err
+	}
+	s.trackers = trackers
+
+	if s.dhtStatePath != "" {
+		s.dhtTable, err = dht.LoadRoutingTable(s.dhtStatePath)
+	} else {
+		s.dhtTable, err = dht.NewRoutingTable()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.dhtServer, err = dht.NewServer(dht.Config{
+		Addr:           fmt.Sprintf(":%d", cfg.DHTPort),
+		Addr6:          fmt.Sprintf("[::]:%d", cfg.DHTPort),
+		Table:          s.dhtTable,
+		BootstrapNodes: cfg.DHTBootstrapNodes,
+		Public:         true,
+		ReadOnly:       cfg.DHTReadOnly,
+		ListenPacket: func(network string, address string) (net.PacketConn, error) {
+			return dialer.ListenPacket(context.Background(), network, address)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.listener, err = peer.Listen(fmt.Sprintf(":%d", cfg.Port), s.peerId)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := s.dhtServer.ListenAndServe(); err != nil {
+			fmt.Printf("Error running DHT node: %s\n", err)
+		}
+	}()
+
+	go func() {
+		if err := s.listener.Serve(); err != nil {
+			fmt.Printf("Error accepting peers: %s\n", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// Close stops the session's background work, including the DHT node and the peer listener, and persists the DHT
+// routing table.
+//
+// It returns an error if the routing table could not be saved.
+func (s *Session) Close() error {
+	s.listener.Close()
+	s.dhtServer.Close()
+
+	return s.saveDHT()
+}
+
+// Status returns a snapshot of the session's state, including the health of every tracker it has announced to.
+func (s *Session) Status() Status {
+	return Status{
+		Trackers: s.trackers.Status(),
+		DHTNodes: s.dhtTable.Len(),
+	}
+}
+
+// DownloadFile takes in the path to a torrent file and downloads the file(s) specified in the torrent file, printing
+// the status of the session once it is done.
+func DownloadFile(source string, cfg Config) {
+	session, err := NewSession(cfg)
+	if err != nil {
+		fmt.Printf("Error: Failed to create session, %s\n", err)
 		os.Exit(1)
 	}
 
-	var peerId [20]byte
-	rand.Read(peerId[:])
-	const port = 6881
+	err = session.Download(source)
+	printStatus(session.Status())
+	if closeErr := session.Close(); closeErr != nil {
+		fmt.Printf("Error saving DHT routing table: %s\n", closeErr)
+	}
 
-	var peerAddrs []net.TCPAddr
-	var wg sync.WaitGroup
-	var mut sync.Mutex
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Download downloads the file(s) specified in the given torrent file or magnet link.
+//
+// It returns an error if the torrent could not be read, no peers could be found or the swarm stayed empty.
+func (s *Session) Download(source string) error {
+	tf, err := torrent.ExtractInfo(source)
+	if err != nil {
+		return fmt.Errorf("Failed to extract torrent file metadata, %w", err)
+	}
+
+	peerId := s.peerId
+	port := s.listener.Port()
 
-	// Request peers from all trackers in the announce list
-	wg.Add(len(tf.AnnounceList))
+	// Request peers from the healthiest tracker in each tier of the announce list
+	peerAddrs := s.trackers.AnnounceTiers(tf.AnnounceTiers, tf.InfoHash, peerId, port)
+
+	announceUrls := make(map[string]bool)
 	for _, trackerUrl := range tf.AnnounceList {
-		go func() {
-			defer wg.Done()
-			addr, err := tracker.RequestPeers(trackerUrl, tf.InfoHash, peerId, port)
-			if err != nil {
-				return
-			}
+		announceUrls[trackerUrl] = true
+	}
 
-			mut.Lock()
-			peerAddrs = append(peerAddrs, addr...)
-			mut.Unlock()
-		}()
+	for _, status := range s.trackers.Status() {
+		if !announceUrls[status.Url] {
+			continue
+		}
+
+		switch {
+		case status.Health.LastWarning != "":
+			fmt.Printf("Warning from tracker %s: %s\n", status.Url, status.Health.LastWarning)
+		case !status.Working && status.Health.LastError != "":
+			fmt.Printf("Tracker %s is not working, retrying in %s: %s\n", status.Url, time.Until(status.Health.RetryAt).Round(time.Second), status.Health.LastError)
+		}
 	}
 
-	wg.Wait()
+	if err := s.trackers.Save(); err != nil {
+		fmt.Printf("Error saving tracker state: %s\n", err)
+	}
 
 	fmt.Println("////////////////////////////////////////////")
 	fmt.Println("////// Getting peers to download from //////")
 	fmt.Println("////////////////////////////////////////////")
 
-	peers := requestPeers(peerAddrs, tf, peerId)
-	if len(peers.Peers) == 0 {
-		fmt.Println("No peers available for download")
-		os.Exit(1)
-	}
+	peers := requestPeers(s.dialer, peerAddrs, tf, peerId)
 
-	// If the DHT table is supported, extract addtional peers from the DHT network to
-	// increase the number of available peers for download.
-	var extraPeers []net.TCPAddr
+	// Extract addtional peers from the DHT network to increase the number of available peers for download.
+	// The nodes listed in the torrent file and the DHT nodes of connected peers are added to the routing table first,
+	// so that the lookup can start from them as well as from the persisted routing table.
+	dhtNodes := tf.Nodes
 	for _, client := range peers.Peers {
-		if client.SupportsDHT {
-			addrs, err := dht.GetPeersFromDHT(client, tf.InfoHash)
-			if err != nil {
-				continue
-			}
-
-			// Break at the first instance of a successful DHT request to avoid making multiple DHT requests
-			extraPeers = append(extraPeers, addrs...)
-			break
+		if client.SupportsDHT && client.DHT.Port != 0 {
+			dhtNodes = append(dhtNodes, net.JoinHostPort(client.Ip, strconv.Itoa(client.DHT.Port)))
 		}
 	}
-	peers.Peers = append(peers.Peers, requestPeers(extraPeers, tf, peerId).Peers...)
+	s.dhtServer.AddNodes(dhtNodes)
+
+	// Announcing to the DHT looks up its peers as well, and we stay announced while the torrent is downloading
+	extraPeers, _ := s.dhtServer.Announce(tf.InfoHash, port)
+	peers.Peers = append(peers.Peers, requestPeers(s.dialer, extraPeers, tf, peerId).Peers...)
+
+	announceDone := make(chan struct{})
+	defer close(announceDone)
+	go s.dhtServer.KeepAnnounced(tf.InfoHash, port, announceDone, nil)
+
+	if err := s.saveDHT(); err != nil {
+		fmt.Printf("Error saving DHT routing table: %s\n", err)
+	}
+
+	if len(peers.Peers) == 0 {
+		return fmt.Errorf("No peers available for download")
+	}
 
 	// If the torrent file is a magnet link, we need to request the metadata for the torrent file
 	// from the peers before we can download the file(s) specified in the torrent file.
 	if strings.HasPrefix(source, "magnet") {
 		for _, client := range peers.Peers {
+			// Peers that never send the metadata must not stall the download
+			client.Conn.SetDeadline(time.Now().Add(metadataTimeout))
 			metadata, err := client.RequestMetadata(tf.InfoHash)
+			client.Conn.SetDeadline(time.Time{})
 			if err != nil {
 				fmt.Printf("Error requesting metadata from peer %s: %s\n", client.Ip, err)
+				continue
 			}
 
-			tf.Info.Pieces += string(metadata)
+			info, err := torrent.ParseInfoDict(metadata)
+			if err != nil {
+				fmt.Printf("Error parsing metadata from peer %s: %s\n", client.Ip, err)
+				continue
+			}
+
+			tf.Info = info
+			tf.Name = info.Name
+			break
 		}
 	}
 
 	tf.CalculatePiecesHash()
 
-	peers.DownloadFromPeers(tf, peerId)
+	// Peers that found us through trackers and the DHT can connect to us once we know the pieces of the torrent
+	storage := piece.NewStorage(tf.Info.Length, tf.Info.PieceLength)
+	incoming := s.listener.Register(tf.InfoHash, storage)
+	defer s.listener.Unregister(tf.InfoHash)
+
+	peers.UploadSlots = s.cfg.UploadSlots
+	peers.AddDHTNode = func(addr string) {
+		s.dhtServer.AddNodes([]string{addr})
+	}
+	if err := peers.DownloadFromPeers(tf, peerId, storage, incoming); err != nil {
+		return err
+	}
+	peers.Seed(incoming, s.cfg.SeedRatio, s.cfg.SeedTime)
+
+	return nil
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// printStatus prints the health of every tracker and the size of the DHT routing table.
+func printStatus(status Status) {
+	fmt.Println("////////////////////////////////////////////")
+	fmt.Println("//////         Session status         //////")
+	fmt.Println("////////////////////////////////////////////")
+
+	for _, tracker := range status.Trackers {
+		health := tracker.Health
+		state := "working"
+		switch {
+		case tracker.Never:
+			state = fmt.Sprintf("not retried until %s", tracker.NeverUntil.Format(time.DateTime))
+		case !tracker.Working:
+			state = "not working"
+		}
+
+		fmt.Printf("Tracker %s: %s, %d successes, %d failures, %s latency\n", tracker.Url, state, health.Successes, health.Failures, health.Latency.Round(time.Millisecond))
+		if health.LastError != "" {
+			fmt.Printf("  Last error: %s\n", health.LastError)
+		}
+	}
+
+	fmt.Println("DHT nodes in routing table:", status.DHTNodes)
+}
+
+// saveDHT persists the DHT routing table, if the session has a state directory.
+func (s *Session) saveDHT() error {
+	if s.dhtStatePath == "" {
+		return nil
+	}
+
+	return s.dhtTable.Save(s.dhtStatePath)
 }
 
-func requestPeers(peerAddrs []net.TCPAddr, tf torrent.TorrentFile, peerId [20]byte) peer.Peers {
+func requestPeers(dialer proxy.Dialer, peerAddrs []net.TCPAddr, tf torrent.TorrentFile, peerId [20]byte) peer.Peers {
 	peerAddrs = peer.RemoveDuplicatePeers(peerAddrs)
 	var peers peer.Peers
 
@@ -105,7 +374,7 @@ func requestPeers(peerAddrs []net.TCPAddr, tf torrent.TorrentFile, peerId [20]by
 	for _, ip := range peerAddrs {
 		go func() {
 			defer wg.Done()
-			client, err := peer.NewPeerClient(ip, tf, peerId)
+			client, err := peer.NewPeerClient(dialer, ip, tf, peerId)
 			if err != nil {
 				return
 			}
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"crypto/sha1"
 	"fmt"
 
 	"github.com/anthony/BT/bencode"
@@ -13,9 +14,19 @@ const (
 	metadataReject   = 2
 )
 
+// Metadata is sent in 16kiB pieces as specified in BEP_9. Metadata larger than maxMetadataSize is refused,
+// so that peers cannot make us allocate arbitrary amounts of memory.
+const (
+	metadataPieceSize = 16 * 1024
+	maxMetadataSize   = 8 * 1024 * 1024
+)
+
+// Extended message id we ask peers to send ut_metadata messages to us with, as advertised in our extension handshake.
+const utMetadataId = 1
+
 type extensionMessage struct {
 	M struct {
-		Metadata int `mapstructure:"metadata"`
+		Metadata int `mapstructure:"ut_metadata"`
 	} `mapstructure:"m"`
 
 	MetadataSize int `mapstructure:"metadata_size"`
@@ -27,13 +38,27 @@ type metadataMessage struct {
 	TotalSize   int `mapstructure:"total_size"`
 }
 
+// SendExtendedHandshake sends our extension handshake as specified in BEP_10, which tells the peer the message id
+// to send us metadata messages with.
+func (c *Client) SendExtendedHandshake() error {
+	handshake, err := bencode.Encode(map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": utMetadataId,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.SendMessage(Message{Id: Extension, Payload: append([]byte{0}, handshake...)})
+}
+
 func (c *Client) ExtendedPeerHandshake(payload []byte) error {
 	// Check if the peer supports the extension handshake
-	extMsgId := payload[0]
-	payload = payload[1:]
-	if extMsgId != 0 {
+	if len(payload) == 0 || payload[0] != 0 {
 		return fmt.Errorf("Peer does not support the extension handshake")
 	}
+	payload = payload[1:]
 
 	var extHandshakeMsg extensionMessage
 	err := bencode.Decode(payload, &extHandshakeMsg)
@@ -47,33 +72,43 @@ func (c *Client) ExtendedPeerHandshake(payload []byte) error {
 	return nil
 }
 
+// RequestMetadata requests the info dictionary of the torrent from the peer piece by piece with the ut_metadata
+// extension as specified in BEP_9. Messages the peer sends in between the metadata pieces are kept as unread, for the
+// download from the peer that follows.
+//
+// It returns the info dictionary, or an error if the peer does not support metadata exchange, rejects a request or
+// sends metadata that does not match the info hash.
 func (c *Client) RequestMetadata(infoHash [20]byte) ([]byte, error) {
+	// The extension handshake of the peer is only read once we need it
+	if c.SupportsExtension && c.MetadataExtension.MessageID == 0 {
+		if err := c.recieveExtendedHandshake(); err != nil {
+			return nil, err
+		}
+	}
+
 	if c.MetadataExtension.MessageID == 0 || c.MetadataExtension.MetadataSize == 0 {
 		return nil, fmt.Errorf("Peer does not support metadata exchange")
 	}
 
-	metadataPieceSize := 16 * 1024 // 16kiB per piece as specified in BEP_9
-	metadata := make([]byte, c.MetadataExtension.MetadataSize)
+	if c.MetadataExtension.MetadataSize > maxMetadataSize {
+		return nil, fmt.Errorf("Metadata of %d bytes is too large", c.MetadataExtension.MetadataSize)
+	}
 
-	recieved := 0
-	for piece := 0; recieved < c.MetadataExtension.MetadataSize; piece++ {
+	metadata := make([]byte, 0, c.MetadataExtension.MetadataSize)
+	for piece := 0; len(metadata) < c.MetadataExtension.MetadataSize; piece++ {
 		err := c.SendRequestMetadata(piece)
 		if err != nil {
 			return nil, fmt.Errorf("Error sending metadata request: %w", err)
 		}
 
-		resp, err := c.RecieveMessage()
+		resp, err := c.recieveMetadataMessage()
 		if err != nil {
 			return nil, err
 		}
 
-		if resp.Id != Extension {
-			return nil, fmt.Errorf("Expected extension message in response to metadata request")
-		}
-
 		respPayload := resp.Payload[1:]
 
-		// Extract the bencoded dictionary from the response
+		// Extract the bencoded dictionary from the response, the piece of metadata follows it
 		var dictResp []byte
 		for i := 1; i < len(respPayload); i++ {
 			if string(respPayload[i-1:i+1]) == "ee" {
@@ -90,14 +125,20 @@ func (c *Client) RequestMetadata(infoHash [20]byte) ([]byte, error) {
 
 		switch extResp.MessageType {
 		case metadataResponse:
-			// Check the size of the piece is correct. Unless it is the last piece.
-			if extResp.TotalSize != metadataPieceSize {
+			data := respPayload[len(dictResp):]
+
+			// Every piece is 16kiB, except for the last piece
+			if extResp.Piece != piece || extResp.TotalSize != c.MetadataExtension.MetadataSize {
+				return nil, fmt.Errorf("Metadata piece mismatch")
+			}
+			if len(data) > metadataPieceSize || (len(data) < metadataPieceSize && len(metadata)+len(data) != extResp.TotalSize) {
 				return nil, fmt.Errorf("Metadata piece size mismatch")
 			}
+			if len(metadata)+len(data) > extResp.TotalSize {
+				return nil, fmt.Errorf("Metadata larger than announced")
+			}
 
-			metadata = append(metadata, resp.Payload[len(dictResp):]...)
-
-			recieved += (len(resp.Payload) - len(dictResp) - 1)
+			metadata = append(metadata, data...)
 		case metadataReject:
 			return nil, fmt.Errorf("Peer rejected metadata request")
 		default:
@@ -105,5 +146,57 @@ func (c *Client) RequestMetadata(infoHash [20]byte) ([]byte, error) {
 		}
 	}
 
+	if sha1.Sum(metadata) != infoHash {
+		return nil, fmt.Errorf("Metadata does not match the info hash")
+	}
+
 	return metadata, nil
 }
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// recieveExtendedHandshake reads messages from the peer until it receives its extension handshake.
+//
+// It returns an error if a message could not be read or the extension handshake is malformed.
+func (c *Client) recieveExtendedHandshake() error {
+	msg, err := c.recieveExtensionMessage(0)
+	if err != nil {
+		return err
+	}
+
+	return c.ExtendedPeerHandshake(msg.Payload)
+}
+
+// recieveMetadataMessage reads messages from the peer until it receives a ut_metadata message.
+//
+// It returns the message, or an error if a message could not be read.
+func (c *Client) recieveMetadataMessage() (*Message, error) {
+	return c.recieveExtensionMessage(utMetadataId)
+}
+
+// recieveExtensionMessage reads messages from the peer until it receives an extended message with the id. Other
+// messages, such as the bitfield and haves, can be sent before it and are kept as unread.
+//
+// It returns the message, or an error if a message could not be read or the peer sent too many other messages.
+func (c *Client) recieveExtensionMessage(id byte) (*Message, error) {
+	for {
+		msg, err := c.RecieveMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		// Keep-alives carry nothing
+		if msg == nil {
+			continue
+		}
+
+		if msg.Id == Extension && len(msg.Payload) > 1 && msg.Payload[0] == id {
+			return msg, nil
+		}
+
+		if len(c.Unread) >= maxUnreadMessages {
+			return nil, fmt.Errorf("Peer sent too many messages before extended message %d", id)
+		}
+		c.Unread = append(c.Unread, msg)
+	}
+}
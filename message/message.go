@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 
@@ -23,6 +24,18 @@ const (
 	DHT           = 0x09 // DHT message id
 )
 
+// Limits on the length of the messages peers send us, which are checked before a message is read so that peers cannot
+// make us allocate arbitrary amounts of memory. Blocks are never larger than the blocks we request, while bitfields
+// and extension messages of large torrents need more room.
+const (
+	maxBlockLength   = 16 * 1024
+	maxMessageLength = 4 * 1024 * 1024
+)
+
+// Number of messages that can be read ahead of the reader of a peer, after which the peer is considered to be flooding
+// us.
+const maxUnreadMessages = 1000
+
 type Message struct {
 	Id      byte
 	Payload []byte
@@ -42,44 +55,48 @@ type Client struct {
 	DHT         struct {
 		Port int
 	}
+
+	// Unread holds the messages that were read ahead of whoever reads the peer next, such as while waiting for
+	// metadata, so that they are handled before the messages read after them
+	Unread []*Message
 }
 
 // Methods for sending messages with the specific message ids and payloads as specified in the BitTorrent protocol specification.
 
 func (c *Client) SendHave(pieceIndex int) error {
-	payload := make([]byte, 4)
-	binary.BigEndian.PutUint32(payload[0:4], uint32(pieceIndex))
-
-	return c.sendMessage(Message{Id: Have, Payload: payload})
+	return c.SendMessage(NewHave(pieceIndex))
 }
 
 func (c *Client) SendInterested() error {
-	return c.sendMessage(Message{Id: Interested})
+	return c.SendMessage(Message{Id: Interested})
 }
 
 func (c *Client) SendUnchoke() error {
-	return c.sendMessage(Message{Id: Unchoke})
+	return c.SendMessage(Message{Id: Unchoke})
 }
 
 func (c *Client) SendChoke() error {
-	return c.sendMessage(Message{Id: Choke})
+	return c.SendMessage(Message{Id: Choke})
 }
 
 func (c *Client) SendNotInterested() error {
-	return c.sendMessage(Message{Id: NotInterested})
+	return c.SendMessage(Message{Id: NotInterested})
 }
 
 func (c *Client) SendRequestBlock(index int, begin int, length int) error {
-	payload := make([]byte, 12)
-	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return c.SendMessage(NewRequest(index, begin, length))
+}
 
-	return c.sendMessage(Message{Id: Request, Payload: payload})
+func (c *Client) SendBitfield(bitfield []byte) error {
+	return c.SendMessage(Message{Id: Bitfield, Payload: bitfield})
+}
+
+func (c *Client) SendPiece(index int, begin int, block []byte) error {
+	return c.SendMessage(NewPiece(index, begin, block))
 }
 
 func (c *Client) SendRequestMetadata(piece int) error {
-	requestDict := map[string]int{
+	requestDict := map[string]interface{}{
 		"msg_type": metdataRequest,
 		"piece":    piece,
 	}
@@ -89,7 +106,32 @@ func (c *Client) SendRequestMetadata(piece int) error {
 		return err
 	}
 
-	return c.sendMessage(Message{Id: Extension, Payload: payload})
+	// Extended messages start with the id the peer gave the extension in its handshake
+	payload = append([]byte{byte(c.MetadataExtension.MessageID)}, payload...)
+
+	return c.SendMessage(Message{Id: Extension, Payload: payload})
+}
+
+// SendMessage sends a message to the peer with the specified message id and payload.
+//
+// It returns an error if the message could not be written to the connection.
+func (c *Client) SendMessage(msg Message) error {
+	// Construct payload that contains:
+	// - 4 byte for message length
+	// - 1 byte for message id
+	// - payload of variable length
+	// As specified in the BitTorrent protocol specification (BEP_3)
+	buf := make([]byte, 5+len(msg.Payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(msg.Payload)))
+	buf[4] = msg.Id
+	copy(buf[5:], msg.Payload)
+
+	_, err := c.Conn.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // Recieve a message from the peer and if successful,
@@ -97,7 +139,7 @@ func (c *Client) SendRequestMetadata(piece int) error {
 // otherwise return any error encountered.
 func (c *Client) RecieveMessage() (*Message, error) {
 	lengthBuf := make([]byte, 4)
-	_, err := c.Conn.Read(lengthBuf)
+	_, err := io.ReadFull(c.Conn, lengthBuf)
 	if err != nil {
 		return nil, err
 	}
@@ -110,13 +152,22 @@ func (c *Client) RecieveMessage() (*Message, error) {
 		return nil, nil
 	}
 
+	if msgLen > maxMessageLength {
+		return nil, fmt.Errorf("Message of %d bytes is too long", msgLen)
+	}
+
 	// Message ID
 	id := make([]byte, 1)
-	_, err = c.Conn.Read(id)
+	_, err = io.ReadFull(c.Conn, id)
 	if err != nil {
 		return nil, err
 	}
 
+	// Piece messages hold the id, the index and offset of the block and the block
+	if id[0] == Piece && msgLen > 9+maxBlockLength {
+		return nil, fmt.Errorf("Piece message of %d bytes is too long", msgLen)
+	}
+
 	// Payload
 	payload := make([]byte, msgLen-1)
 	_, err = io.ReadFull(c.Conn, payload)
@@ -132,58 +183,63 @@ func (c *Client) RecieveMessage() (*Message, error) {
 	return &resp, nil
 }
 
-// readMessage reads a message from the peer client, and updates the state of the client and piece download progress accordingly.
-//
-// It returns an error if there is an issue reading the message or if the message is invalid.
-func (c *Client) ReadMessage() error {
-	msg, err := c.RecieveMessage()
+// Constructors of the messages with a payload, for messages that are queued rather than sent straight away.
 
-	if err != nil {
-		return err
-	}
+// NewHave creates a have message, telling the peer we have the piece with the index.
+func NewHave(index int) Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
 
-	switch msg.Id {
-	case Choke:
-		c.IsChoked = true
-	case Unchoke:
-		c.IsChoked = false
-	case Bitfield:
-		c.Bitfield = msg.Payload
-	case Have:
-		pieceIndex := binary.BigEndian.Uint32(msg.Payload[0:4])
-		setPiece(c.Bitfield, int(pieceIndex))
-	}
+	return Message{Id: Have, Payload: payload}
+}
 
-	return nil
+// NewRequest creates a request message for the block of the piece with the index at the offset begin.
+func NewRequest(index int, begin int, length int) Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+	return Message{Id: Request, Payload: payload}
 }
 
-///////////////////////////// Helper functions /////////////////////////////
+// NewPiece creates a piece message holding the block of the piece with the index at the offset begin.
+func NewPiece(index int, begin int, block []byte) Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
 
-// Helper function to send a message to the peer with the specified message id and payload.
-func (c *Client) sendMessage(msg Message) error {
-	// Construct payload that contains:
-	// - 4 byte for message length
-	// - 1 byte for message id
-	// - payload of variable length
-	// As specified in the BitTorrent protocol specification (BEP_3)
-	buf := make([]byte, 5+len(msg.Payload))
-	binary.BigEndian.PutUint32(buf, uint32(1+len(msg.Payload)))
-	buf[4] = msg.Id
-	copy(buf[5:], msg.Payload)
+	return Message{Id: Piece, Payload: payload}
+}
 
-	_, err := c.Conn.Write(buf)
-	if err != nil {
-		return err
+// ParseRequest parses the payload of a request or cancel message, which both hold the index of the piece, the offset
+// of the block within the piece and the length of the block.
+//
+// It returns the index, offset and length, or an error if the payload is malformed.
+func ParseRequest(payload []byte) (int, int, int, error) {
+	if len(payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Invalid request payload length %d", len(payload))
 	}
 
-	return nil
+	index := binary.BigEndian.Uint32(payload[0:4])
+	begin := binary.BigEndian.Uint32(payload[4:8])
+	length := binary.BigEndian.Uint32(payload[8:12])
+
+	return int(index), int(begin), int(length), nil
 }
 
-// setPiece sets the bit corresponding to the specified piece index in the
-// given bitfield to indicate that they have that piece.
-func setPiece(bf []byte, index int) {
-	byteIndex := index / 8
-	bitIndex := index % 8
+// ParsePiece parses the payload of a piece message, which holds the index of the piece, the offset of the block
+// within the piece and the block.
+//
+// It returns the index, offset and block, or an error if the payload is malformed.
+func ParsePiece(payload []byte) (int, int, []byte, error) {
+	if len(payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("Invalid piece payload length %d", len(payload))
+	}
+
+	index := binary.BigEndian.Uint32(payload[0:4])
+	begin := binary.BigEndian.Uint32(payload[4:8])
 
-	bf[byteIndex] |= 1 << (7 - bitIndex)
+	return int(index), int(begin), payload[8:], nil
 }
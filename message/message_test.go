@@ -0,0 +1,41 @@
+package message
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRecieveMessageRejectsLongMessages(t *testing.T) {
+	tests := map[string]struct {
+		header []byte
+		valid  bool
+	}{
+		"largest block":       {[]byte{0, 0, 0x40, 0x09, Piece}, true},
+		"block too long":      {[]byte{0, 0, 0x40, 0x0a, Piece}, false},
+		"bitfield":            {[]byte{0, 0x01, 0, 0x01, Bitfield}, true},
+		"4 GiB length prefix": {[]byte{0xff, 0xff, 0xff, 0xff, Bitfield}, false},
+		"extension too long":  {[]byte{0, 0x40, 0, 0x01, Extension}, false},
+	}
+
+	for name, test := range tests {
+		conn, remote := net.Pipe()
+		client := &Client{Conn: conn}
+
+		// The payload is only sent if the message is read, as the pipe blocks until it is
+		go func() {
+			remote.Write(test.header)
+			remote.Write(make([]byte, 0x400000))
+			remote.Close()
+		}()
+
+		msg, err := client.RecieveMessage()
+		if test.valid && (err != nil || msg.Id != test.header[4]) {
+			t.Errorf("%s: Expected message %d, got %+v and error %v", name, test.header[4], msg, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: Expected error for message too long", name)
+		}
+
+		conn.Close()
+	}
+}
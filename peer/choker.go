@@ -0,0 +1,137 @@
+package peer
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Settings of the choking algorithm as described in BEP_3. The peers we upload to are reconsidered every 10 seconds,
+// and the optimistic unchoke moves on to another peer every third round, so that every 30 seconds.
+const (
+	DefaultUploadSlots = 4
+	chokeInterval      = 10 * time.Second
+	optimisticRounds   = 3
+)
+
+// choker decides which peers we upload to. It is tit-for-tat: while downloading we upload to the interested peers
+// that give us the best download rates, and while seeding to the peers we upload to the fastest. One upload slot is
+// kept for an optimistic unchoke of a random peer, so that new peers get the chance to show their rate.
+type choker struct {
+	slots      int
+	round      int
+	optimistic *peerConn
+}
+
+// choke runs a round of the choking algorithm, unchoking the interested peers with the best rates since the last
+// round and the optimistic unchoke, and choking everyone else. The optimistic unchoke is rotated every third round,
+// or sooner if it disconnected, lost interest or earned a slot by its rate.
+func (p *Peers) choke() {
+	p.removeClosedPeers()
+
+	// Rates are the bytes transferred since the last round, which is the same interval for every peer
+	rates := make(map[*peerConn]int64)
+	var interested []*peerConn
+	for _, c := range p.conns {
+		downloaded, sent := atomic.LoadInt64(&c.downloaded), atomic.LoadInt64(&c.sent)
+		rates[c] = downloaded - c.lastDownloaded
+		if p.seeding() {
+			rates[c] = sent - c.lastSent
+		}
+		c.lastDownloaded, c.lastSent = downloaded, sent
+
+		if c.state().peerInterested {
+			interested = append(interested, c)
+		}
+	}
+
+	sort.SliceStable(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	ch := &p.choker
+	unchoke := make(map[*peerConn]bool)
+	for _, c := range interested[:min(max(ch.slots-1, 0), len(interested))] {
+		unchoke[c] = true
+	}
+
+	if ch.optimistic != nil {
+		if ch.round%optimisticRounds == 0 || ch.optimistic.closed() || !ch.optimistic.state().peerInterested || unchoke[ch.optimistic] {
+			ch.optimistic = nil
+		}
+	}
+
+	if ch.optimistic == nil {
+		var candidates []*peerConn
+		for _, c := range interested {
+			if !unchoke[c] {
+				candidates = append(candidates, c)
+			}
+		}
+
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+	ch.round++
+
+	for _, c := range p.conns {
+		c.setChoking(!unchoke[c])
+	}
+}
+
+// fillUploadSlots unchokes interested peers while there are free upload slots, so that peers do not have to wait for
+// the next round of the choker when we have upload capacity to spare.
+func (p *Peers) fillUploadSlots() {
+	p.removeClosedPeers()
+
+	unchoked := 0
+	for _, c := range p.conns {
+		if !c.state().amChoking {
+			unchoked++
+		}
+	}
+
+	for _, c := range p.conns {
+		if unchoked >= p.choker.slots {
+			return
+		}
+
+		if state := c.state(); state.amChoking && state.peerInterested {
+			c.setChoking(false)
+			unchoked++
+		}
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// removeClosedPeers forgets the peers that have disconnected, so that they no longer take up upload slots.
+func (p *Peers) removeClosedPeers() {
+	connected := p.conns[:0]
+	for _, c := range p.conns {
+		if c.closed() {
+			continue
+		}
+
+		connected = append(connected, c)
+	}
+
+	clear(p.conns[len(connected):])
+	p.conns = connected
+}
+
+// seeding reports whether the download has completed, after which peers are ranked by our upload rate to them.
+func (p *Peers) seeding() bool {
+	select {
+	case <-p.complete:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+package peer
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+// addTestPeer adds a peer whose messages from us are discarded, and which is interested in us if interested is set.
+func addTestPeer(t *testing.T, p *Peers, interested bool) *peerConn {
+	conn, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	t.Cleanup(func() { conn.Close() })
+
+	c := newPeerConn(&message.Client{Conn: conn}, p.storage.NumPieces(), p.events, p.quit)
+	c.status.peerInterested = interested
+	go c.writeLoop()
+	p.conns = append(p.conns, c)
+
+	return c
+}
+
+// unchokedPeers returns the peers we do not choke.
+func unchokedPeers(p *Peers) map[*peerConn]bool {
+	unchoked := make(map[*peerConn]bool)
+	for _, c := range p.conns {
+		if !c.state().amChoking {
+			unchoked[c] = true
+		}
+	}
+
+	return unchoked
+}
+
+func TestChokerUnchokesFastestPeers(t *testing.T) {
+	p := &Peers{UploadSlots: 4}
+	p.start(piece.NewStorage(32, 32))
+
+	var peers []*peerConn
+	for i := range 6 {
+		c := addTestPeer(t, p, true)
+		atomic.AddInt64(&c.downloaded, int64(600-100*i))
+		peers = append(peers, c)
+	}
+	uninterested := addTestPeer(t, p, false)
+	atomic.AddInt64(&uninterested.downloaded, 1000)
+
+	// While downloading the three peers we download from the fastest are unchoked, along with an optimistic unchoke
+	p.choke()
+	unchoked := unchokedPeers(p)
+	if len(unchoked) != 4 || !unchoked[peers[0]] || !unchoked[peers[1]] || !unchoked[peers[2]] || unchoked[uninterested] {
+		t.Fatalf("Expected the three fastest interested peers and an optimistic unchoke, got %v", unchoked)
+	}
+
+	optimistic := p.choker.optimistic
+	if optimistic != peers[3] && optimistic != peers[4] && optimistic != peers[5] {
+		t.Fatalf("Expected optimistic unchoke of a slower peer, got %v", optimistic)
+	}
+
+	// The optimistic unchoke stays for three rounds, even though no data was exchanged since
+	for range 2 {
+		p.choke()
+		if p.choker.optimistic != optimistic || !unchokedPeers(p)[optimistic] {
+			t.Fatalf("Expected optimistic unchoke to stay for three rounds")
+		}
+	}
+
+	// While seeding the peers we upload to the fastest are unchoked instead
+	close(p.complete)
+	for i, c := range peers {
+		atomic.AddInt64(&c.sent, int64(100*i))
+	}
+
+	p.choke()
+	unchoked = unchokedPeers(p)
+	if len(unchoked) != 4 || !unchoked[peers[5]] || !unchoked[peers[4]] || !unchoked[peers[3]] {
+		t.Errorf("Expected the three peers we upload to the fastest to be unchoked while seeding, got %v", unchoked)
+	}
+
+	// Peers that lose interest are choked
+	peers[5].update(&message.Message{Id: message.NotInterested})
+	p.choke()
+	if unchokedPeers(p)[peers[5]] {
+		t.Errorf("Expected peer that is not interested to be choked")
+	}
+}
+
+func TestChokerFillsFreeUploadSlots(t *testing.T) {
+	p := &Peers{UploadSlots: 2}
+	p.start(piece.NewStorage(32, 32))
+
+	var peers []*peerConn
+	for range 3 {
+		peers = append(peers, addTestPeer(t, p, false))
+	}
+
+	// Peers that become interested are unchoked straight away while there are free upload slots
+	for i, c := range peers {
+		msg := &message.Message{Id: message.Interested}
+		if c.update(msg) {
+			p.handleEvent(event{conn: c, msg: msg})
+		}
+
+		if unchoked := unchokedPeers(p); unchoked[c] != (i < 2) || len(unchoked) != min(i+1, 2) {
+			t.Errorf("Expected peer %d to be unchoked: %t, got %v", i, i < 2, unchoked)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package peer
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anthony/BT/message"
+)
+
+// Number of messages that can wait in the queue of a peer. Peers that read slower than we queue messages, such as the
+// haves of the pieces we complete, are disconnected rather than buffered for without limit.
+const maxQueuedMessages = 1000
+
+// event is a message from a peer that changes what we can download from it or upload to it, or a block it sent us.
+// A nil message tells that the peer disconnected.
+type event struct {
+	conn *peerConn
+	msg  *message.Message
+}
+
+// outgoing is a message waiting in the queue of a peer. If written is set, it is told the result of writing the message.
+type outgoing struct {
+	msg     message.Message
+	written chan<- error
+}
+
+// connState is the state of a connection as described in BEP_3. Both sides of a connection start out choking and
+// not interested.
+type connState struct {
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+}
+
+// peerConn is the connection to a peer after the handshake. A reader goroutine reads every message the peer sends and
+// keeps the state of the connection and the pieces the peer has up to date, passing the messages on as events, and a
+// writer goroutine sends the messages in our queue, so that no one waits on a slow peer.
+type peerConn struct {
+	client    *message.Client
+	uploader  *uploader
+	dhtNode   func(addr string)
+	numPieces int
+	events    chan<- event
+	quit      <-chan struct{}
+
+	mu       sync.Mutex
+	status   connState
+	bitfield []byte
+	queue    []outgoing
+
+	// Bytes downloaded from and uploaded to the peer, which the choker ranks peers by. The totals at the last round
+	// of the choker tell the rates since, and are only used by the choker.
+	downloaded     int64
+	sent           int64
+	lastDownloaded int64
+	lastSent       int64
+
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPeerConn creates the connection to a peer of a torrent with the given number of pieces, taking the bitfield and
+// whether the peer chokes us from the messages it sent after the handshake. Events are sent on events until quit is
+// closed.
+func newPeerConn(client *message.Client, numPieces int, events chan<- event, quit <-chan struct{}) *peerConn {
+	bitfield := make([]byte, (numPieces+7)/8)
+	if len(client.Bitfield) == len(bitfield) {
+		copy(bitfield, client.Bitfield)
+	}
+
+	return &peerConn{
+		client:    client,
+		numPieces: numPieces,
+		events:    events,
+		quit:      quit,
+		status: connState{
+			amChoking:   true,
+			peerChoking: client.IsChoked,
+		},
+		bitfield: bitfield,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// readLoop reads the messages of the peer until it disconnects. Requests are passed to the uploader, the extension
+// handshake and DHT port of the peer are taken whenever they arrive, and the messages that change the state of the
+// connection and blocks are sent as events.
+func (c *peerConn) readLoop() {
+	defer c.emit(nil)
+	defer c.close()
+
+	// Messages read during the metadata request come first
+	unread := c.client.Unread
+	c.client.Unread = nil
+	for _, msg := range unread {
+		c.handle(msg)
+	}
+
+	for {
+		msg, err := c.client.RecieveMessage()
+		if err != nil {
+			return
+		}
+
+		// Keep alive messages carry nothing
+		if msg != nil {
+			c.handle(msg)
+		}
+	}
+}
+
+// writeLoop sends the messages in the queue until the connection is closed.
+func (c *peerConn) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		}
+
+		for {
+			c.mu.Lock()
+			if len(c.queue) == 0 {
+				c.mu.Unlock()
+				break
+			}
+			out := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+
+			err := c.client.SendMessage(out.msg)
+			if out.written != nil {
+				out.written <- err
+			}
+
+			if err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// send queues a message to the peer.
+func (c *peerConn) send(msg message.Message) {
+	c.enqueue(outgoing{msg: msg})
+}
+
+// write queues a message to the peer and waits until it is written.
+//
+// It returns an error if the message could not be written or the connection was closed.
+func (c *peerConn) write(msg message.Message) error {
+	written := make(chan error, 1)
+	c.enqueue(outgoing{msg: msg, written: written})
+
+	select {
+	case err := <-written:
+		return err
+	case <-c.done:
+		return net.ErrClosed
+	}
+}
+
+// update applies a message of the peer to the state of the connection.
+//
+// It returns whether the message is of interest to the scheduler or the choker.
+func (c *peerConn) update(msg *message.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch msg.Id {
+	case message.Choke:
+		c.status.peerChoking = true
+	case message.Unchoke:
+		c.status.peerChoking = false
+	case message.Interested:
+		c.status.peerInterested = true
+	case message.NotInterested:
+		c.status.peerInterested = false
+	case message.Have:
+		if len(msg.Payload) != 4 {
+			return false
+		}
+
+		// Haves of pieces the peer already told us about change nothing
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		if index >= c.numPieces || hasBit(c.bitfield, index) {
+			return false
+		}
+		c.bitfield[index/8] |= 1 << (7 - index%8)
+	case message.Bitfield:
+		if len(msg.Payload) != len(c.bitfield) {
+			return false
+		}
+		copy(c.bitfield, msg.Payload)
+	case message.Piece:
+	default:
+		return false
+	}
+
+	return true
+}
+
+// state returns the state of the connection.
+func (c *peerConn) state() connState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// pieces returns a copy of the bitfield of the pieces the peer has.
+func (c *peerConn) pieces() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]byte(nil), c.bitfield...)
+}
+
+// setChoking chokes or unchokes the peer, and tells the peer if that changed. The requests of a peer we choke are
+// dropped, as specified in BEP_3.
+func (c *peerConn) setChoking(choking bool) {
+	c.mu.Lock()
+	changed := c.status.amChoking != choking
+	c.status.amChoking = choking
+	c.mu.Unlock()
+
+	if choking && c.uploader != nil {
+		c.uploader.clear()
+	}
+
+	if !changed {
+		return
+	}
+
+	if choking {
+		c.send(message.Message{Id: message.Choke})
+	} else {
+		c.send(message.Message{Id: message.Unchoke})
+	}
+}
+
+// setInterested tells the peer whether we are interested in its pieces, if that changed.
+func (c *peerConn) setInterested(interested bool) {
+	c.mu.Lock()
+	changed := c.status.amInterested != interested
+	c.status.amInterested = interested
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if interested {
+		c.send(message.Message{Id: message.Interested})
+	} else {
+		c.send(message.Message{Id: message.NotInterested})
+	}
+}
+
+// addDownloaded counts bytes downloaded from the peer towards its rate.
+func (c *peerConn) addDownloaded(n int) {
+	atomic.AddInt64(&c.downloaded, int64(n))
+}
+
+// close disconnects the peer.
+func (c *peerConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.client.Conn.Close()
+	})
+}
+
+// closed reports whether the peer has disconnected.
+func (c *peerConn) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// enqueue adds a message to the queue and wakes up the writer. Peers with a full queue are disconnected.
+func (c *peerConn) enqueue(out outgoing) {
+	c.mu.Lock()
+	if len(c.queue) >= maxQueuedMessages {
+		c.mu.Unlock()
+		c.close()
+
+		return
+	}
+	c.queue = append(c.queue, out)
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// handle takes a message the peer sent us.
+func (c *peerConn) handle(msg *message.Message) {
+	switch msg.Id {
+	case message.Request, message.Cancel:
+		if c.uploader != nil {
+			c.uploader.handleMessage(msg)
+		}
+
+	case message.Extension:
+		if c.client.SupportsExtension && len(msg.Payload) > 0 && msg.Payload[0] == 0 {
+			c.client.ExtendedPeerHandshake(msg.Payload)
+		}
+
+	case message.DHT:
+		c.takeDHTPort(msg.Payload)
+
+	default:
+		if c.update(msg) {
+			c.emit(msg)
+		}
+	}
+}
+
+// takeDHTPort takes the port the DHT node of the peer listens on from a port message, as specified in BEP_5, and
+// passes the address of the node on without waiting for it to be added to the routing table.
+func (c *peerConn) takeDHTPort(payload []byte) {
+	if !c.client.SupportsDHT || len(payload) != 2 {
+		return
+	}
+
+	port := int(binary.BigEndian.Uint16(payload))
+	if port == 0 {
+		return
+	}
+	c.client.DHT.Port = port
+
+	if c.dhtNode != nil {
+		go c.dhtNode(net.JoinHostPort(c.client.Ip, strconv.Itoa(port)))
+	}
+}
+
+// emit sends an event of the peer, unless the download and seeding are over.
+func (c *peerConn) emit(msg *message.Message) {
+	select {
+	case c.events <- event{conn: c, msg: msg}:
+	case <-c.quit:
+	}
+}
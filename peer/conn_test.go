@@ -0,0 +1,100 @@
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+	"github.com/anthony/BT/message"
+)
+
+func TestReaderTakesExtensionHandshakeAndDHTPort(t *testing.T) {
+	conn, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+
+	client := &message.Client{Conn: conn, Ip: "1.2.3.4", SupportsExtension: true, SupportsDHT: true}
+	peer := &message.Client{Conn: remote}
+
+	quit := make(chan struct{})
+	close(quit)
+
+	dhtNodes := make(chan string, 1)
+	c := newPeerConn(client, 8, nil, quit)
+	c.dhtNode = func(addr string) { dhtNodes <- addr }
+	go c.readLoop()
+
+	// The extension handshake and DHT port may come at any time, such as after other messages
+	handshake, _ := bencode.Encode(map[string]interface{}{
+		"m":             map[string]interface{}{"ut_metadata": 3},
+		"metadata_size": 100,
+	})
+	peer.SendInterested()
+	peer.SendMessage(message.Message{Id: message.Extension, Payload: append([]byte{0}, handshake...)})
+	peer.SendMessage(message.Message{Id: message.DHT, Payload: []byte{0x1a, 0xe1}})
+
+	select {
+	case addr := <-dhtNodes:
+		if addr != "1.2.3.4:6881" {
+			t.Errorf("Expected DHT node 1.2.3.4:6881, got %s", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected DHT node of the peer to be added")
+	}
+
+	if client.MetadataExtension.MessageID != 3 || client.MetadataExtension.MetadataSize != 100 || !c.state().peerInterested {
+		t.Errorf("Expected extension handshake and interest of the peer to be taken, got %+v", client.MetadataExtension)
+	}
+}
+
+func TestReaderHandlesUnreadMessagesFirst(t *testing.T) {
+	conn, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+
+	// Messages read while requesting metadata are left unread on the client
+	client := &message.Client{Conn: conn, Unread: []*message.Message{
+		{Id: message.Bitfield, Payload: []byte{0x80}},
+		{Id: message.Unchoke},
+	}}
+	peer := &message.Client{Conn: remote}
+
+	events := make(chan event, 3)
+	c := newPeerConn(client, 8, events, make(chan struct{}))
+	go c.readLoop()
+
+	peer.SendMessage(message.NewHave(1))
+
+	for _, id := range []byte{message.Bitfield, message.Unchoke, message.Have} {
+		select {
+		case ev := <-events:
+			if ev.msg == nil || ev.msg.Id != id {
+				t.Fatalf("Expected message %d, got %+v", id, ev.msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected message %d", id)
+		}
+	}
+
+	if len(client.Unread) != 0 || !hasBit(c.pieces(), 0) || !hasBit(c.pieces(), 1) || c.state().peerChoking {
+		t.Errorf("Expected unread messages to be applied to the connection")
+	}
+}
+
+func TestSlowPeerIsDisconnected(t *testing.T) {
+	conn, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+
+	// The peer never reads, so nothing leaves the queue
+	c := newPeerConn(&message.Client{Conn: conn}, 8, nil, nil)
+	for i := range maxQueuedMessages {
+		c.send(message.NewHave(i))
+	}
+	if c.closed() {
+		t.Fatalf("Expected peer with a full queue to stay connected")
+	}
+
+	c.send(message.NewHave(0))
+	if !c.closed() || len(c.queue) != maxQueuedMessages {
+		t.Errorf("Expected peer to be disconnected once its queue overflows")
+	}
+}
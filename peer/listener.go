@@ -0,0 +1,199 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+// Number of peers that connected to us that can wait for their torrent's download to take them, after which further
+// peers of the torrent are turned away.
+const incomingBacklog = 50
+
+// Listener accepts connections from peers on a single TCP port for any number of torrents. The info hash of a peer's
+// handshake tells which torrent it wants, and peers that complete the handshake are handed to the download of that
+// torrent.
+type Listener struct {
+	listener net.Listener
+	peerId   [20]byte
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+}
+
+// swarm is a torrent peers are accepted for.
+type swarm struct {
+	peers   chan *message.Client
+	storage *piece.Storage
+}
+
+// Listen listens for peers on the TCP address, which we identify to as the given peer id. A port of zero picks a
+// random port.
+//
+// It returns the listener, or an error if the address could not be listened on.
+func Listen(addr string, peerId [20]byte) (*Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening for peers: %w", err)
+	}
+
+	return &Listener{
+		listener: listener,
+		peerId:   peerId,
+		swarms:   make(map[[20]byte]*swarm),
+	}, nil
+}
+
+// Port returns the port the listener accepts peers on, which is reported to trackers and the DHT.
+func (l *Listener) Port() int {
+	if addr, ok := l.listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+
+	return 0
+}
+
+// Register accepts peers for the torrent with the info hash, until it is unregistered. Peers are sent the bitfield of
+// the pieces in storage after the handshake.
+//
+// It returns the channel the peers that connect to us for the torrent are received on.
+func (l *Listener) Register(infoHash [20]byte, storage *piece.Storage) <-chan *message.Client {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.swarms[infoHash] == nil {
+		l.swarms[infoHash] = &swarm{
+			peers:   make(chan *message.Client, incomingBacklog),
+			storage: storage,
+		}
+	}
+
+	return l.swarms[infoHash].peers
+}
+
+// Unregister stops accepting peers for the torrent with the info hash, and disconnects the peers still waiting
+// to be received.
+func (l *Listener) Unregister(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sw := l.swarms[infoHash]
+	if sw == nil {
+		return
+	}
+	delete(l.swarms, infoHash)
+
+	for {
+		select {
+		case client := <-sw.peers:
+			client.Conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Serve accepts peers until the listener is closed. Every peer is handshaked in the background, and peers
+// of torrents that are not registered are disconnected.
+//
+// It returns nil once the listener is closed, otherwise it returns the error that stopped it.
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go l.handleConn(conn)
+	}
+}
+
+// Close stops accepting peers.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// handleConn performs the BitTorrent handshake with a peer that connected to us, sends it our bitfield and extension
+// handshake and hands the peer to the download of the torrent it asked for straight away. The peer is disconnected if
+// the handshake fails, the torrent is not registered or too many peers are already waiting for the torrent's download.
+func (l *Listener) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reserved, infoHash, err := readHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	sw := l.lookup(infoHash)
+	if sw == nil {
+		conn.Close()
+		return
+	}
+
+	if err := sendHandshake(conn, infoHash, l.peerId); err != nil {
+		conn.Close()
+		return
+	}
+
+	// Unlike the peers we connect to, the extensions of peers that connect to us are taken from their handshake
+	client := &message.Client{
+		Ip:                conn.RemoteAddr().(*net.TCPAddr).IP.String(),
+		Conn:              conn,
+		IsChoked:          true,
+		SupportsExtension: reserved[5]&0x10 != 0,
+		SupportsDHT:       reserved[7]&0x01 != 0,
+	}
+
+	// The bitfield is the first message after the handshake, and is left out if we do not have any pieces yet
+	bitfield := sw.storage.Bitfield()
+	if hasPieces(bitfield) {
+		if err := client.SendBitfield(bitfield); err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	if client.SupportsExtension {
+		if err := client.SendExtendedHandshake(); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The messages of the peer, starting with its bitfield if it has any pieces, are left for the reader of its
+	// connection, so that none are lost to the handshake
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.swarms[infoHash] != sw {
+		conn.Close()
+		return
+	}
+
+	select {
+	case sw.peers <- client:
+	default:
+		conn.Close()
+	}
+}
+
+// lookup returns the torrent with the info hash, or nil if peers are not accepted for it.
+func (l *Listener) lookup(infoHash [20]byte) *swarm {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.swarms[infoHash]
+}
@@ -0,0 +1,96 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+// startListener starts a listener on a local port that accepts peers for the info hash.
+//
+// It returns the address of the listener, and the channel the peers that connect to it are received on.
+func startListener(t *testing.T, infoHash [20]byte, storage *piece.Storage) (string, <-chan *message.Client) {
+	l, err := Listen("127.0.0.1:0", [20]byte{'u', 's'})
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+
+	incoming := l.Register(infoHash, storage)
+	go l.Serve()
+	t.Cleanup(func() { l.Close() })
+
+	return l.listener.Addr().String(), incoming
+}
+
+// dialListener connects to the listener and sends a handshake with the given protocol identifier and info hash.
+func dialListener(t *testing.T, addr string, protocol string, infoHash [20]byte) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unexpected error connecting to listener: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	msg := append([]byte{byte(len(protocol))}, protocol...)
+	msg = append(msg, make([]byte, 8)...)
+	msg = append(msg, infoHash[:]...)
+	msg = append(msg, bytes.Repeat([]byte{'p'}, 20)...)
+	conn.Write(msg)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn
+}
+
+func TestListenerAttachesPeerToSwarm(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	addr, incoming := startListener(t, infoHash, piece.NewStorage(20, 10))
+
+	conn := dialListener(t, addr, protocolId, infoHash)
+
+	reserved, gotInfoHash, err := readHandshake(conn)
+	if err != nil {
+		t.Fatalf("Unexpected error reading handshake: %v", err)
+	}
+	if gotInfoHash != infoHash || reserved[5]&0x10 == 0 || reserved[7]&0x01 == 0 {
+		t.Errorf("Expected handshake for %x with extension and DHT support, got %x with reserved bytes %x", infoHash, gotInfoHash, reserved)
+	}
+
+	// The peer is handed over straight after the handshake, leaving its messages for the reader of the connection
+	select {
+	case client := <-incoming:
+		if client.Ip != "127.0.0.1" || client.SupportsExtension || client.SupportsDHT {
+			t.Errorf("Expected peer at 127.0.0.1 without extensions, got %+v", client)
+		}
+
+		conn.Write([]byte{0, 0, 0, 2, message.Bitfield, 0x80})
+		expectMessage(t, client, message.Bitfield, []byte{0x80})
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected peer to be attached to the swarm")
+	}
+}
+
+func TestListenerRejectsPeers(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	addr, _ := startListener(t, infoHash, piece.NewStorage(20, 10))
+
+	tests := map[string]struct {
+		protocol string
+		infoHash [20]byte
+	}{
+		"unknown torrent":  {protocolId, [20]byte{4, 5, 6}},
+		"invalid protocol": {"BitTorrent protocoI", infoHash},
+	}
+
+	for name, test := range tests {
+		conn := dialListener(t, addr, test.protocol, test.infoHash)
+
+		// The peer is disconnected without a handshake
+		if n, err := conn.Read(make([]byte, handshakeLen)); err != io.EOF {
+			t.Errorf("%s: Expected peer to be disconnected, got %d bytes and error %v", name, n, err)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package peer
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -11,79 +10,139 @@ import (
 
 	"github.com/anthony/BT/message"
 	"github.com/anthony/BT/piece"
+	"github.com/anthony/BT/proxy"
 	"github.com/anthony/BT/torrent"
 )
 
+// Length of the handshake message, and the protocol identifier it starts with, as specified in BEP_3.
+const (
+	handshakeLen = 68
+	protocolId   = "BitTorrent protocol"
+)
+
+// Longest a download waits for a peer to connect while it has none, by default.
+const DefaultSwarmTimeout = 2 * time.Minute
+
 type Peers struct {
 	Peers []*message.Client
+
+	// UploadSlots is the number of peers we upload to at once, including the optimistic unchoke. Zero uses
+	// DefaultUploadSlots.
+	UploadSlots int
+
+	// AddDHTNode is given the address of the DHT node of every peer that tells us its DHT port, which may happen at any
+	// time during the download. Nil ignores the ports.
+	AddDHTNode func(addr string)
+
+	// SwarmTimeout is how long the download waits for a peer to connect while no peer is connected before it gives
+	// up. Zero uses DefaultSwarmTimeout.
+	SwarmTimeout time.Duration
+
+	storage   *piece.Storage
+	uploaded  int64
+	complete  chan struct{}
+	conns     []*peerConn
+	choker    choker
+	scheduler *scheduler
+	events    chan event
+	quit      chan struct{}
 }
 
 // DownloadFromPeers takes in a torrent file and peer id and attempts to download all the pieces of the file
-// from available peers. Upon downloading all the pieces, it reconstructs the original file and writes it to disk.
-func (p *Peers) DownloadFromPeers(tf torrent.TorrentFile, peerId [20]byte) {
-	// Initialise worker queue and file data channel
-	workerQueue := make(chan piece.PieceWork, len(tf.PiecesHash))
-	results := make(chan piece.PieceResult)
-
-	fmt.Println("////////////////////////////////////////////")
-	fmt.Println("//////       Starting download        //////")
-	fmt.Println("////////////////////////////////////////////")
-
-	fmt.Println("There are", len(p.Peers), "peers available for download")
-
-	// Start download workers for each peer
-	for _, client := range p.Peers {
-		go func() {
-			defer client.Conn.Close()
-			for pw := range workerQueue {
-				data, err := piece.TryDownloadPiece(client, pw)
-				if err != nil {
-					workerQueue <- pw
-
-					if err == io.EOF {
-						return
-					}
-
-					continue
-				}
-
-				results <- piece.PieceResult{
-					Index: pw.Index,
-					Data:  data,
-				}
-			}
-		}()
-	}
+// from available peers into storage. Peers received from incoming, which connected to us, join the download as they
+// arrive. Every peer is told of the pieces we complete, and the requests of the peers the choker unchokes are answered
+// from storage. Upon downloading all the pieces, it reconstructs the original file and writes it to disk.
+//
+// It returns an error if no peer was connected for the swarm timeout, in which case every peer is disconnected.
+func (p *Peers) DownloadFromPeers(tf torrent.TorrentFile, peerId [20]byte, storage *piece.Storage, incoming <-chan *message.Client) error {
+	p.start(storage)
 
-	// Send all the piece to the worker queue
+	// Split the torrent into pieces for the scheduler
+	work := make([]piece.PieceWork, len(tf.PiecesHash))
 	for i, hash := range tf.PiecesHash {
 		length := tf.Info.PieceLength
 		if i == len(tf.PiecesHash)-1 {
 			length = tf.Info.Length - (tf.Info.PieceLength * (len(tf.PiecesHash) - 1))
 		}
 
-		workerQueue <- piece.PieceWork{
+		work[i] = piece.PieceWork{
 			Index:     i,
 			PieceHash: hash,
 			PieceSize: length,
 		}
 	}
+	p.scheduler = newScheduler(storage, work)
+
+	fmt.Println("////////////////////////////////////////////")
+	fmt.Println("//////       Starting download        //////")
+	fmt.Println("////////////////////////////////////////////")
+
+	fmt.Println("There are", len(p.Peers), "peers available for download")
+
+	for _, client := range p.Peers {
+		p.addPeer(client)
+	}
+
+	// Peers are unchoked by their download rate to us while downloading
+	chokeTicker := time.NewTicker(chokeInterval)
+	defer chokeTicker.Stop()
+
+	timeoutTicker := time.NewTicker(requestTimeout / 3)
+	defer timeoutTicker.Stop()
 
-	// Combine pieces into final file data as they are downloaded
-	finalData := make([]byte, tf.Info.Length)
-	for i := 0; i < len(tf.PiecesHash); i++ {
-		result := <-results
+	// The download gives up once it has been without peers for the swarm timeout
+	var swarmTimer *time.Timer
+	defer func() {
+		if swarmTimer != nil {
+			swarmTimer.Stop()
+		}
+	}()
+
+	// The scheduler stores pieces as they are downloaded, and tells every peer we have them
+	for storage.Completed() < len(work) {
+		var swarmTimeout <-chan time.Time
+		if len(p.scheduler.wanted) == 0 {
+			if swarmTimer == nil {
+				swarmTimer = time.NewTimer(p.SwarmTimeout)
+			}
+			swarmTimeout = swarmTimer.C
+		} else if swarmTimer != nil {
+			swarmTimer.Stop()
+			swarmTimer = nil
+		}
+
+		select {
+		case <-swarmTimeout:
+			p.stop()
+			return fmt.Errorf("No peers connected for %s", p.SwarmTimeout)
+
+		case client := <-incoming:
+			p.Peers = append(p.Peers, client)
+			p.addPeer(client)
+
+		case <-chokeTicker.C:
+			p.choke()
+
+		case <-timeoutTicker.C:
+			p.scheduler.dropStalledPeers(time.Now())
 
-		copy(finalData[result.Index*tf.Info.PieceLength:], result.Data)
-		fmt.Printf("%0.2f%% complete\n", float64(i)/float64(len(tf.PiecesHash))*100)
+		case ev := <-p.events:
+			if p.handleEvent(ev) {
+				fmt.Printf("%0.2f%% complete\n", float64(storage.Completed())/float64(len(work))*100)
+			}
+		}
 	}
+	p.scheduler = nil
+	close(p.complete)
+
+	// Reconstruct the original file data from the stored pieces
+	finalData := storage.Data()
 
 	// Determine whether the file to be downloaded is a single file or multiple files and write to disk
 	if len(tf.Info.Files) == 0 {
 		err := os.WriteFile(tf.Info.Name, finalData, 0644)
 		if err != nil {
-			fmt.Printf("Error: Failed to write file to disk, %s\n", err)
-			os.Exit(1)
+			return fmt.Errorf("Failed to write file to disk, %w", err)
 		}
 	} else {
 		index := 0
@@ -91,19 +150,19 @@ func (p *Peers) DownloadFromPeers(tf torrent.TorrentFile, peerId [20]byte) {
 			dir := filepath.Dir(path.Path)
 			err := os.MkdirAll(dir, 0755)
 			if err != nil {
-				fmt.Printf("Error: Failed to create directory, %s\n", err)
-				os.Exit(1)
+				return fmt.Errorf("Failed to create directory, %w", err)
 			}
 
 			err = os.WriteFile(path.Path, finalData[index:path.Length], 0644)
 			if err != nil {
-				fmt.Printf("Error: Failed to write file to disk, %s\n", err)
-				os.Exit(1)
+				return fmt.Errorf("Failed to write file to disk, %w", err)
 			}
 
 			index += path.Length
 		}
 	}
+
+	return nil
 }
 
 // RemoveDuplicatePeers takes in a list of peers and returns a new list with duplicate peers removed.
@@ -121,19 +180,26 @@ func RemoveDuplicatePeers(peers []net.TCPAddr) []net.TCPAddr {
 	return uniquePeers
 }
 
-// NewPeerClient attempts to establish a connection with the peer, perform the BitTorrent handshake, and
-// recieve the initial bitfield message from the peer if it is sent.
+// NewPeerClient attempts to establish a connection with the peer through the dialer and perform the BitTorrent
+// handshake. The messages the peer sends after the handshake, such as its bitfield, are read by the download or the
+// metadata request.
 //
 // If the handshake is successful, it returns a new Client representing the peer. Otherwise, it returns an error.
-func NewPeerClient(addr net.TCPAddr, tf torrent.TorrentFile, peerId [20]byte) (*message.Client, error) {
-	conn, err := net.DialTimeout("tcp", addr.String(), 5*time.Second)
+func NewPeerClient(dialer proxy.Dialer, addr net.TCPAddr, tf torrent.TorrentFile, peerId [20]byte) (*message.Client, error) {
+	if addr.IP == nil || addr.IP.IsUnspecified() || addr.Port == 0 {
+		return nil, fmt.Errorf("Invalid peer address: %s", addr.String())
+	}
+
+	// The TCP address formats IPv6 addresses in brackets, so peers of either family can be dialed
+	conn, err := proxy.DialTimeout(dialer, "tcp", addr.String(), 5*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("dialing: %w", err)
 	}
 
 	client := &message.Client{
-		Ip:   addr.IP.String(),
-		Conn: conn,
+		Ip:       addr.IP.String(),
+		Conn:     conn,
+		IsChoked: true,
 	}
 
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
@@ -141,6 +207,7 @@ func NewPeerClient(addr net.TCPAddr, tf torrent.TorrentFile, peerId [20]byte) (*
 
 	err = handshakePeer(client, tf.InfoHash, peerId)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -149,24 +216,110 @@ func NewPeerClient(addr net.TCPAddr, tf torrent.TorrentFile, peerId [20]byte) (*
 
 //////////////////////////////// Helper Functions /////////////////////////////////
 
+// start prepares the peers for downloading into storage and uploading from it.
+func (p *Peers) start(storage *piece.Storage) {
+	if p.UploadSlots <= 0 {
+		p.UploadSlots = DefaultUploadSlots
+	}
+	if p.SwarmTimeout <= 0 {
+		p.SwarmTimeout = DefaultSwarmTimeout
+	}
+
+	p.storage = storage
+	p.complete = make(chan struct{})
+	p.choker = choker{slots: p.UploadSlots}
+	p.events = make(chan event)
+	p.quit = make(chan struct{})
+}
+
+// stop disconnects every peer and stops the events of the peers.
+func (p *Peers) stop() {
+	close(p.quit)
+	for _, c := range p.conns {
+		c.close()
+	}
+}
+
+// addPeer starts downloading from and uploading to the peer, with the peer choked until the choker unchokes it. The
+// peer joins the scheduler before its messages are read, so that the scheduler sees every change to its pieces.
+func (p *Peers) addPeer(client *message.Client) {
+	c := newPeerConn(client, p.storage.NumPieces(), p.events, p.quit)
+	c.uploader = newUploader(c, p.storage, &p.uploaded)
+	c.dhtNode = p.AddDHTNode
+	p.conns = append(p.conns, c)
+
+	if p.scheduler != nil {
+		p.scheduler.add(c)
+	}
+
+	go c.writeLoop()
+	go c.uploader.run()
+	go c.readLoop()
+}
+
+// handleEvent passes an event of a peer to the scheduler while downloading. Peers that become interested in us are
+// unchoked straight away if an upload slot is free.
+//
+// It returns whether the event completed a piece.
+func (p *Peers) handleEvent(ev event) bool {
+	if ev.msg != nil && ev.msg.Id == message.Interested {
+		p.fillUploadSlots()
+	}
+
+	return p.scheduler != nil && p.scheduler.handle(ev)
+}
+
 // handShakePeer performs the BitTorrent handshake with a peer as specified by the BitTorrent protocol.
 // It sends a handshake message to the peer and waits for a response.
 //
 // If the handshake is successful, it returns nil. Otherwise, it returns an error.
 func handshakePeer(client *message.Client, infoHash [20]byte, peerId [20]byte) error {
+	// Send initial handshake
+	err := sendHandshake(client.Conn, infoHash, peerId)
+	if err != nil {
+		return err
+	}
+
+	// Read handshake response from peer
+	// It should be in the same format as the sent msg
+	reserved, peerInfoHash, err := readHandshake(client.Conn)
+	if err != nil {
+		return err
+	}
+
+	if peerInfoHash != infoHash {
+		return fmt.Errorf("Info hash mismatch in handshake response from peer")
+	}
+
+	client.SupportsExtension = reserved[5]&0x10 != 0
+	client.SupportsDHT = reserved[7]&0x01 != 0
+
+	// Peers that support the extension protocol need our extension handshake to send us metadata. The messages of the
+	// peer, including its own extension handshake and bitfield, are left for whoever reads the peer next, so that
+	// none are lost to the handshake
+	if client.SupportsExtension {
+		if err := client.SendExtendedHandshake(); err != nil {
+			return fmt.Errorf("sending extension handshake: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// sendHandshake sends our handshake for the torrent to the peer.
+//
+// It returns an error if the handshake could not be sent.
+func sendHandshake(conn net.Conn, infoHash [20]byte, peerId [20]byte) error {
 	// Create handshake message
-	msg := make([]byte, 68)
+	msg := make([]byte, handshakeLen)
 
-	msg[0] = 19                            // Length of protocol
-	copy(msg[1:20], "BitTorrent protocol") // Protocol identifier
+	msg[0] = byte(len(protocolId)) // Length of protocol
+	copy(msg[1:20], protocolId)    // Protocol identifier
 
 	// The reserved bytes are used to indicate support for extensions to the BitTorrent protocol.
 	// Currently, we support only:
 	// - Extended handshake (BEP_10) which allows us to request metadata from peers when dowloading from a magnet link.
 	// - DHT (BEP_5) which allows us to discover peers without the need for a tracker.
-	client.SupportsExtension = true
-	client.SupportsDHT = true
-
 	extensionBytes := make([]byte, 8)
 	extensionBytes[5] |= 0x10
 	extensionBytes[7] |= 0x01
@@ -175,65 +328,33 @@ func handshakePeer(client *message.Client, infoHash [20]byte, peerId [20]byte) e
 	copy(msg[28:48], infoHash[:])    // Info hash
 	copy(msg[48:68], peerId[:])      // Peer ID
 
-	// Send initial handshake
-	_, err := client.Conn.Write(msg)
-	if err != nil {
+	if _, err := conn.Write(msg); err != nil {
 		return fmt.Errorf("sending handshake: %w", err)
 	}
 
-	// Read handshake response from peer
-	// It should be in the same format as the sent msg
-	response := make([]byte, 68)
-	_, err = client.Conn.Read(response)
-	if err != nil {
-		return fmt.Errorf("reading handshake response: %w", err)
-	}
-
-	// Check that the response is in the correct format and contains the expected info hash
-	if int(response[0]) != 19 || string(response[1:20]) != "BitTorrent protocol" {
-		return fmt.Errorf("Invalid handshake response from peer")
-	}
-
-	if string(response[28:48]) != string(infoHash[:]) {
-		return fmt.Errorf("Info hash mismatch in handshake response from peer")
-	}
-
-	// Continously read messages from the peer since clients send bitfield messages and other messages in random order after the handshake.
-	for i := 0; i < 50; i++ {
-		resp, err := client.RecieveMessage()
-		if err != nil {
-			break
-		}
-
-		switch resp.Id {
-		case message.Bitfield:
-			client.Bitfield = resp.Payload
-		case message.Extension:
-			if client.SupportsExtension {
-				err = client.ExtendedPeerHandshake(resp.Payload)
-				if err != nil {
-					return fmt.Errorf("Error performing extended peer handshake: %w", err)
-				}
-			}
-		case message.DHT:
-			if client.SupportsDHT {
-				client.DHT.Port = int(binary.BigEndian.Uint16(resp.Payload))
-			}
-		}
-	}
+	return nil
+}
 
-	// Error checking to ensure the peer sent the expected messages after the handshake.
-	if len(client.Bitfield) == 0 {
-		return fmt.Errorf("Peer did not send bitfield message after handshake")
+// readHandshake reads the handshake of the peer and checks it is for the BitTorrent protocol.
+//
+// It returns the reserved bytes and the info hash of the handshake, or an error if the handshake could not be read
+// or is for another protocol.
+func readHandshake(conn net.Conn) ([8]byte, [20]byte, error) {
+	var reserved [8]byte
+	var infoHash [20]byte
+
+	msg := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return reserved, infoHash, fmt.Errorf("reading handshake: %w", err)
 	}
 
-	if client.SupportsExtension && client.MetadataExtension.MetadataSize == 0 {
-		return fmt.Errorf("Peer did not send valid extension handshake message after handshake")
+	// Check that the handshake is in the correct format
+	if int(msg[0]) != len(protocolId) || string(msg[1:20]) != protocolId {
+		return reserved, infoHash, fmt.Errorf("Invalid handshake from peer")
 	}
 
-	if client.SupportsDHT && client.DHT.Port == 0 {
-		return fmt.Errorf("Peer did not send DHT port in handshake response")
-	}
+	copy(reserved[:], msg[20:28])
+	copy(infoHash[:], msg[28:48])
 
-	return nil
+	return reserved, infoHash, nil
 }
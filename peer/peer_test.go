@@ -0,0 +1,31 @@
+package peer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/piece"
+	"github.com/anthony/BT/torrent"
+)
+
+func TestDownloadGivesUpOnEmptySwarm(t *testing.T) {
+	tf := torrent.TorrentFile{
+		PiecesHash: make([][20]byte, 1),
+		Info:       torrent.InfoDict{Name: "empty", PieceLength: 4, Length: 4},
+	}
+
+	p := &Peers{SwarmTimeout: 50 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.DownloadFromPeers(tf, [20]byte{}, piece.NewStorage(4, 4), nil)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Expected an error for a download without peers")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the download to give up without peers")
+	}
+}
@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"math/rand"
+
+	"github.com/anthony/BT/piece"
+)
+
+// picker chooses the pieces to download rarest first, so that the pieces few peers have are spread before those
+// peers leave. The availability of every piece is counted from the bitfields and haves of the peers, which the picker
+// keeps its own copy of, since the reader of a peer may already have applied messages the scheduler did not handle yet.
+type picker struct {
+	availability []int
+	bitfields    map[*peerConn][]byte
+}
+
+// newPicker creates a picker for a torrent with the given number of pieces.
+func newPicker(numPieces int) *picker {
+	return &picker{
+		availability: make([]int, numPieces),
+		bitfields:    make(map[*peerConn][]byte),
+	}
+}
+
+// addPeer counts the pieces of a peer that joined the download.
+func (pk *picker) addPeer(c *peerConn, bitfield []byte) {
+	pk.bitfields[c] = make([]byte, (len(pk.availability)+7)/8)
+	pk.setBitfield(c, bitfield)
+}
+
+// removePeer stops counting the pieces of a peer that disconnected.
+func (pk *picker) removePeer(c *peerConn) {
+	pk.setBitfield(c, nil)
+	delete(pk.bitfields, c)
+}
+
+// setBitfield replaces the pieces of the peer with those of the bitfield.
+func (pk *picker) setBitfield(c *peerConn, bitfield []byte) {
+	for i := range pk.availability {
+		had, has := pk.hasPiece(c, i), hasBit(bitfield, i)
+		if had == has {
+			continue
+		}
+
+		if has {
+			pk.availability[i]++
+			pk.bitfields[c][i/8] |= 1 << (7 - i%8)
+		} else {
+			pk.availability[i]--
+			pk.bitfields[c][i/8] &^= 1 << (7 - i%8)
+		}
+	}
+}
+
+// have counts a piece the peer told us it has.
+//
+// It returns whether the piece is new to us for the peer.
+func (pk *picker) have(c *peerConn, index int) bool {
+	if index < 0 || index >= len(pk.availability) || pk.hasPiece(c, index) {
+		return false
+	}
+
+	pk.availability[index]++
+	pk.bitfields[c][index/8] |= 1 << (7 - index%8)
+
+	return true
+}
+
+// hasPiece reports whether the peer has the piece with the index.
+func (pk *picker) hasPiece(c *peerConn, index int) bool {
+	return hasBit(pk.bitfields[c], index)
+}
+
+// pick chooses the next piece to download from the peer among the pieces it has that are wanted. Pieces that were
+// partially downloaded are finished first, and otherwise the rarest piece is picked, with ties broken at random so that
+// peers do not all download the same pieces.
+//
+// It returns the index of the piece, or false if the peer has no wanted piece.
+func (pk *picker) pick(c *peerConn, wanted func(index int) bool, partial map[int]*piece.PieceProgress) (int, bool) {
+	best, bestPartial := -1, -1
+	ties, partialTies := 0, 0
+
+	for i := range pk.availability {
+		if !pk.hasPiece(c, i) || !wanted(i) {
+			continue
+		}
+
+		if partial[i] != nil {
+			bestPartial, partialTies = pickRarer(pk.availability, bestPartial, partialTies, i)
+		}
+		best, ties = pickRarer(pk.availability, best, ties, i)
+	}
+
+	if bestPartial >= 0 {
+		return bestPartial, true
+	}
+
+	return best, best >= 0
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// pickRarer compares a candidate piece to the best piece so far, counting the pieces tied for the lowest availability
+// so that every tied piece is kept with the same probability.
+//
+// It returns the best piece and the number of pieces tied with it.
+func pickRarer(availability []int, best int, ties int, candidate int) (int, int) {
+	switch {
+	case best < 0 || availability[candidate] < availability[best]:
+		return candidate, 1
+	case availability[candidate] == availability[best]:
+		ties++
+		if rand.Intn(ties) == 0 {
+			return candidate, ties
+		}
+
+		return best, ties
+	default:
+		return best, ties
+	}
+}
+
+// hasBit reports whether the bitfield has the piece with the index.
+func hasBit(bitfield []byte, index int) bool {
+	return index >= 0 && index/8 < len(bitfield) && bitfield[index/8]&(1<<(7-index%8)) != 0
+}
@@ -0,0 +1,57 @@
+package peer
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+func TestPickerPicksRarestFirst(t *testing.T) {
+	pk := newPicker(4)
+	all := func(index int) bool { return true }
+
+	var peers []*peerConn
+	for _, bitfield := range []byte{0xf0, 0xc0, 0x80, 0x00} {
+		c := newPeerConn(&message.Client{}, 4, nil, nil)
+		pk.addPeer(c, []byte{bitfield})
+		peers = append(peers, c)
+	}
+
+	// Pieces 2 and 3 are the rarest, and ties are broken at random
+	picked := make(map[int]int)
+	for range 100 {
+		index, _ := pk.pick(peers[0], all, nil)
+		picked[index]++
+	}
+	if len(picked) != 2 || picked[2] == 0 || picked[3] == 0 {
+		t.Errorf("Expected the rarest pieces 2 and 3 to be picked at random, got %v", picked)
+	}
+
+	// Peers are only given pieces they have, and that are wanted
+	if index, ok := pk.pick(peers[1], all, nil); !ok || index != 1 {
+		t.Errorf("Expected piece 1, the rarest piece of the peer, got %d", index)
+	}
+	if _, ok := pk.pick(peers[3], all, nil); ok {
+		t.Errorf("Expected no piece for a peer without pieces")
+	}
+	if index, ok := pk.pick(peers[0], func(index int) bool { return index < 2 }, nil); !ok || index != 1 {
+		t.Errorf("Expected piece 1, the rarest wanted piece, got %d", index)
+	}
+
+	// Partially downloaded pieces are finished first, however common they are
+	partial := map[int]*piece.PieceProgress{0: piece.NewPieceProgress(piece.PieceWork{Index: 0, PieceSize: 4})}
+	if index, ok := pk.pick(peers[0], all, partial); !ok || index != 0 {
+		t.Errorf("Expected partially downloaded piece 0, got %d", index)
+	}
+
+	// Availability follows haves and disconnects
+	if !pk.have(peers[3], 3) || pk.have(peers[3], 3) {
+		t.Errorf("Expected only the first have of a piece to be counted")
+	}
+	pk.removePeer(peers[0])
+	if expected := []int{2, 1, 0, 1}; !slices.Equal(pk.availability, expected) {
+		t.Errorf("Expected availability %v, got %v", expected, pk.availability)
+	}
+}
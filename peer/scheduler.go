@@ -0,0 +1,243 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+// Peers that have not sent any of the blocks we requested for this long are disconnected, so that the piece they were
+// downloading can be downloaded from another peer.
+const requestTimeout = 15 * time.Second
+
+// scheduler decides which pieces are downloaded from which peers. It is driven by the events of the peers on the
+// download loop, so its state needs no locking. Every peer downloads one piece at a time, picked by the picker among
+// the pieces the peer has, with up to piece.MaxPipelineRequests blocks requested at once, and only while the peer does
+// not choke us. Pieces whose peer choked us or disconnected keep the blocks that were received, and are finished first
+// by the next peer that has them.
+type scheduler struct {
+	storage *piece.Storage
+	work    []piece.PieceWork
+	picker  *picker
+
+	// Number of pieces every peer has that we do not have, which makes us interested in the peer while not zero
+	wanted map[*peerConn]int
+
+	downloading map[*peerConn]*piece.PieceProgress
+	lastBlock   map[*peerConn]time.Time
+	active      map[int]bool
+	partial     map[int]*piece.PieceProgress
+}
+
+// newScheduler creates a scheduler that downloads the pieces of work into storage.
+func newScheduler(storage *piece.Storage, work []piece.PieceWork) *scheduler {
+	return &scheduler{
+		storage:     storage,
+		work:        work,
+		picker:      newPicker(len(work)),
+		wanted:      make(map[*peerConn]int),
+		downloading: make(map[*peerConn]*piece.PieceProgress),
+		lastBlock:   make(map[*peerConn]time.Time),
+		active:      make(map[int]bool),
+		partial:     make(map[int]*piece.PieceProgress),
+	}
+}
+
+// add starts downloading from the peer of the connection, telling it whether we are interested in its pieces.
+func (s *scheduler) add(c *peerConn) {
+	s.picker.addPeer(c, c.pieces())
+	s.countWanted(c)
+	s.request(c)
+}
+
+// handle takes an event of a peer. Pieces are requested once the peer unchokes us, and released when it chokes us or
+// disconnects. The pieces the peer tells us it has may make us interested in it.
+//
+// It returns whether the event completed a piece.
+func (s *scheduler) handle(ev event) bool {
+	c := ev.conn
+	if _, ok := s.wanted[c]; !ok {
+		return false
+	}
+
+	if ev.msg == nil {
+		s.release(c)
+		s.picker.removePeer(c)
+		delete(s.wanted, c)
+		delete(s.lastBlock, c)
+
+		return false
+	}
+
+	switch ev.msg.Id {
+	case message.Choke:
+		// The peer drops our requests when it chokes us, as specified in BEP_3
+		s.release(c)
+
+	case message.Unchoke:
+		s.request(c)
+
+	case message.Have:
+		index := int(binary.BigEndian.Uint32(ev.msg.Payload))
+		if s.picker.have(c, index) && !s.storage.Has(index) {
+			s.wanted[c]++
+			c.setInterested(true)
+			s.request(c)
+		}
+
+	case message.Bitfield:
+		s.picker.setBitfield(c, ev.msg.Payload)
+		s.countWanted(c)
+		s.request(c)
+
+	case message.Piece:
+		return s.receive(c, ev.msg)
+	}
+
+	return false
+}
+
+// dropStalledPeers disconnects the peers that did not send any of the blocks we requested within the request timeout.
+// Their pieces are released once their disconnect is handled.
+func (s *scheduler) dropStalledPeers(now time.Time) {
+	for c, pp := range s.downloading {
+		if pp.Backlog > 0 && now.Sub(s.lastBlock[c]) > requestTimeout {
+			c.close()
+		}
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// receive stores a block the peer sent us, and once its piece is complete and verified stores the piece and tells
+// every peer we have it.
+//
+// It returns whether the block completed a piece.
+func (s *scheduler) receive(c *peerConn, msg *message.Message) bool {
+	index, begin, block, err := message.ParsePiece(msg.Payload)
+	if err != nil {
+		return false
+	}
+
+	pp := s.downloading[c]
+	if pp == nil || pp.Index != index || !pp.PutBlock(begin, block) {
+		return false
+	}
+	c.addDownloaded(len(block))
+	s.lastBlock[c] = time.Now()
+
+	if !pp.Done() {
+		s.request(c)
+		return false
+	}
+
+	delete(s.downloading, c)
+	delete(s.active, index)
+
+	// Pieces that fail verification are downloaded again from scratch
+	if err := pp.Verify(); err != nil {
+		fmt.Println(err)
+		s.request(c)
+
+		return false
+	}
+
+	s.storage.Put(index, pp.BlockData)
+	for other := range s.wanted {
+		other.send(message.NewHave(index))
+
+		if s.picker.hasPiece(other, index) {
+			s.wanted[other]--
+			other.setInterested(s.wanted[other] > 0)
+		}
+	}
+	s.request(c)
+
+	return true
+}
+
+// request fills the pipeline of requests to the peer, picking a new piece for the peer if it is not downloading one.
+func (s *scheduler) request(c *peerConn) {
+	if state := c.state(); state.peerChoking || !state.amInterested || c.closed() {
+		return
+	}
+
+	pp := s.downloading[c]
+	if pp == nil {
+		pp = s.pick(c)
+		if pp == nil {
+			return
+		}
+
+		s.downloading[c] = pp
+		s.active[pp.Index] = true
+		s.lastBlock[c] = time.Now()
+	}
+
+	for pp.Backlog < piece.MaxPipelineRequests {
+		begin, length, ok := pp.NextRequest()
+		if !ok {
+			break
+		}
+
+		c.send(message.NewRequest(pp.Index, begin, length))
+	}
+}
+
+// pick chooses the next piece to download from the peer among the pieces we neither have nor download from another
+// peer, resuming the piece if it was partially downloaded.
+//
+// It returns the piece, or nil if the peer has no piece for us.
+func (s *scheduler) pick(c *peerConn) *piece.PieceProgress {
+	wanted := func(index int) bool {
+		return !s.active[index] && !s.storage.Has(index)
+	}
+
+	index, ok := s.picker.pick(c, wanted, s.partial)
+	if !ok {
+		return nil
+	}
+
+	if pp := s.partial[index]; pp != nil {
+		delete(s.partial, index)
+		return pp
+	}
+
+	return piece.NewPieceProgress(s.work[index])
+}
+
+// release gives up the piece the peer is downloading, keeping its received blocks for the next peer that picks it,
+// and lets the idle peers pick it.
+func (s *scheduler) release(c *peerConn) {
+	pp := s.downloading[c]
+	if pp == nil {
+		return
+	}
+
+	pp.Release()
+	delete(s.downloading, c)
+	delete(s.active, pp.Index)
+	s.partial[pp.Index] = pp
+
+	for other := range s.wanted {
+		if other != c && s.downloading[other] == nil {
+			s.request(other)
+		}
+	}
+}
+
+// countWanted counts the pieces the peer has that we do not have, and tells the peer whether we are interested in it.
+func (s *scheduler) countWanted(c *peerConn) {
+	wanted := 0
+	for _, pw := range s.work {
+		if s.picker.hasPiece(c, pw.Index) && !s.storage.Has(pw.Index) {
+			wanted++
+		}
+	}
+
+	s.wanted[c] = wanted
+	c.setInterested(wanted > 0)
+}
@@ -0,0 +1,78 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"reflect"
+	"testing"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+// expectQueued takes the messages queued to the peer, and fails the test unless they are the expected messages.
+func expectQueued(t *testing.T, c *peerConn, expected ...message.Message) {
+	t.Helper()
+
+	var queued []message.Message
+	for _, out := range c.queue {
+		queued = append(queued, out.msg)
+	}
+	c.queue = nil
+
+	if !reflect.DeepEqual(queued, expected) {
+		t.Fatalf("Expected queued messages %v, got %v", expected, queued)
+	}
+}
+
+func TestSchedulerFollowsPeerState(t *testing.T) {
+	data := []byte("01234567")
+	storage := piece.NewStorage(len(data), 4)
+	work := []piece.PieceWork{
+		{Index: 0, PieceHash: sha1.Sum(data[:4]), PieceSize: 4},
+		{Index: 1, PieceHash: sha1.Sum(data[4:]), PieceSize: 4},
+	}
+
+	s := newScheduler(storage, work)
+	c := newPeerConn(&message.Client{Bitfield: []byte{0x80}, IsChoked: true}, len(work), nil, nil)
+
+	deliver := func(msg message.Message) bool {
+		return c.update(&msg) && s.handle(event{conn: c, msg: &msg})
+	}
+
+	// We are interested in a peer with pieces we do not have, but only request them once it unchokes us
+	s.add(c)
+	expectQueued(t, c, message.Message{Id: message.Interested})
+
+	deliver(message.Message{Id: message.Unchoke})
+	expectQueued(t, c, message.NewRequest(0, 0, 4))
+
+	// Requests are dropped by a peer that chokes us, so they are sent again once it unchokes us
+	deliver(message.Message{Id: message.Choke})
+	deliver(message.Message{Id: message.Unchoke})
+	expectQueued(t, c, message.NewRequest(0, 0, 4))
+
+	// Completed pieces are announced, and we lose interest in a peer without any more pieces for us
+	if !deliver(message.NewPiece(0, 0, data[:4])) || !storage.Has(0) {
+		t.Fatalf("Expected piece 0 to be completed")
+	}
+	expectQueued(t, c, message.NewHave(0), message.Message{Id: message.NotInterested})
+
+	deliver(message.NewHave(1))
+	expectQueued(t, c, message.Message{Id: message.Interested}, message.NewRequest(1, 0, 4))
+
+	// Pieces that fail verification are requested again
+	if deliver(message.NewPiece(1, 0, []byte("abcd"))) || storage.Has(1) {
+		t.Fatalf("Expected piece 1 with the wrong data to be discarded")
+	}
+	expectQueued(t, c, message.NewRequest(1, 0, 4))
+
+	// Duplicate haves and blocks of pieces that were not requested change nothing
+	if c.update(&message.Message{Id: message.Have, Payload: []byte{0, 0, 0, 1}}) || deliver(message.NewPiece(0, 0, data[:4])) {
+		t.Errorf("Expected duplicate have and unrequested block to be ignored")
+	}
+	expectQueued(t, c)
+
+	if !deliver(message.NewPiece(1, 0, data[4:])) || storage.Completed() != 2 {
+		t.Errorf("Expected both pieces to be completed")
+	}
+}
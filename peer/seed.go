@@ -0,0 +1,200 @@
+package peer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+// Limits on the requests of a peer. Blocks larger than the block size we request ourselves are not sent, as most
+// clients do, and requests beyond the queue size are dropped, so that a peer cannot make us queue arbitrary amounts
+// of data.
+const (
+	maxRequestLength  = piece.MaxBlockSize
+	maxQueuedRequests = 250
+)
+
+// blockRequest is a block a peer requested from us.
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// uploader sends the blocks a peer requests from us in the order they were requested. Requests wait in a queue, so
+// that blocks the peer cancels before their turn are never sent, and are only queued while we do not choke the peer.
+type uploader struct {
+	conn     *peerConn
+	storage  *piece.Storage
+	uploaded *int64
+
+	mu       sync.Mutex
+	requests []blockRequest
+
+	wake chan struct{}
+}
+
+// Seed uploads the pieces we have to the peers that are still connected, and to the peers received from incoming,
+// until we have uploaded ratio times the length of the torrent or duration has passed, whichever comes first. A zero
+// ratio or duration is no target, and if both are zero the peers are disconnected straight away.
+func (p *Peers) Seed(incoming <-chan *message.Client, ratio float64, duration time.Duration) {
+	defer p.stop()
+
+	if ratio <= 0 && duration <= 0 {
+		return
+	}
+
+	fmt.Println("////////////////////////////////////////////")
+	fmt.Println("//////        Starting seeding        //////")
+	fmt.Println("////////////////////////////////////////////")
+
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Peers are unchoked by upload rate from now on
+	chokeTicker := time.NewTicker(chokeInterval)
+	defer chokeTicker.Stop()
+	p.choke()
+
+	target := int64(ratio * float64(p.storage.Length()))
+	for {
+		select {
+		case client := <-incoming:
+			p.Peers = append(p.Peers, client)
+			p.addPeer(client)
+
+		case <-chokeTicker.C:
+			p.choke()
+
+		case ev := <-p.events:
+			p.handleEvent(ev)
+
+		case <-ticker.C:
+			if ratio > 0 && atomic.LoadInt64(&p.uploaded) >= target {
+				fmt.Printf("Reached seed ratio of %.2f after uploading %d bytes\n", ratio, atomic.LoadInt64(&p.uploaded))
+				return
+			}
+
+		case <-timeout:
+			fmt.Printf("Stopped seeding after %s, uploaded %d bytes\n", duration, atomic.LoadInt64(&p.uploaded))
+			return
+		}
+	}
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// newUploader creates an uploader for the peer of the connection.
+func newUploader(conn *peerConn, storage *piece.Storage, uploaded *int64) *uploader {
+	return &uploader{
+		conn:     conn,
+		storage:  storage,
+		uploaded: uploaded,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// handleMessage takes a request or cancel message of the peer. Requests are queued unless we choke the peer, and
+// cancelled requests are removed from the queue.
+func (u *uploader) handleMessage(msg *message.Message) {
+	index, begin, length, err := message.ParseRequest(msg.Payload)
+	if err != nil {
+		return
+	}
+
+	switch msg.Id {
+	case message.Request:
+		if length > maxRequestLength || u.conn.state().amChoking {
+			return
+		}
+
+		u.mu.Lock()
+		if len(u.requests) < maxQueuedRequests {
+			u.requests = append(u.requests, blockRequest{index, begin, length})
+		}
+		u.mu.Unlock()
+
+		select {
+		case u.wake <- struct{}{}:
+		default:
+		}
+
+	case message.Cancel:
+		u.mu.Lock()
+		for i, req := range u.requests {
+			if req == (blockRequest{index, begin, length}) {
+				u.requests = append(u.requests[:i], u.requests[i+1:]...)
+				break
+			}
+		}
+		u.mu.Unlock()
+	}
+}
+
+// run sends the requested blocks from storage until the peer disconnects. Every block is written before the next is
+// read from storage, so that a slow peer does not pile up blocks in the queue of its connection.
+func (u *uploader) run() {
+	for {
+		select {
+		case <-u.conn.done:
+			return
+		case <-u.wake:
+		}
+
+		for {
+			u.mu.Lock()
+			if len(u.requests) == 0 {
+				u.mu.Unlock()
+				break
+			}
+			req := u.requests[0]
+			u.requests = u.requests[1:]
+			u.mu.Unlock()
+
+			// Requests may have been queued just before we choked the peer
+			if u.conn.state().amChoking {
+				continue
+			}
+
+			block, err := u.storage.ReadBlock(req.index, req.begin, req.length)
+			if err != nil {
+				continue
+			}
+
+			if err := u.conn.write(message.NewPiece(req.index, req.begin, block)); err != nil {
+				return
+			}
+			atomic.AddInt64(u.uploaded, int64(len(block)))
+			atomic.AddInt64(&u.conn.sent, int64(len(block)))
+		}
+	}
+}
+
+// clear drops the queued requests.
+func (u *uploader) clear() {
+	u.mu.Lock()
+	u.requests = nil
+	u.mu.Unlock()
+}
+
+// hasPieces reports whether the bitfield has any piece.
+func hasPieces(bitfield []byte) bool {
+	for _, b := range bitfield {
+		if b != 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package peer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/message"
+	"github.com/anthony/BT/piece"
+)
+
+// expectMessage receives the next message from the peer, and fails the test unless it has the id and payload.
+func expectMessage(t *testing.T, client *message.Client, id byte, payload []byte) {
+	t.Helper()
+
+	msg, err := client.RecieveMessage()
+	if err != nil {
+		t.Fatalf("Unexpected error receiving message %d: %v", id, err)
+	}
+
+	if msg == nil || msg.Id != id || !bytes.Equal(msg.Payload, payload) {
+		t.Fatalf("Expected message %d with payload %x, got %+v", id, payload, msg)
+	}
+}
+
+func TestSeedAnswersRequests(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+
+	storage := piece.NewStorage(len(data), 32)
+	storage.Put(0, data[:32])
+	storage.Put(1, data[32:])
+
+	addr, incoming := startListener(t, infoHash, storage)
+
+	seeding := make(chan struct{})
+	p := &Peers{}
+	p.start(storage)
+	go func() {
+		p.Seed(incoming, 1, time.Minute)
+		close(seeding)
+	}()
+
+	leecher := &message.Client{Conn: dialListener(t, addr, protocolId, infoHash)}
+	if _, _, err := readHandshake(leecher.Conn); err != nil {
+		t.Fatalf("Unexpected error reading handshake: %v", err)
+	}
+
+	// Leechers get our bitfield straight after the handshake, and can tell us they are interested straight away
+	// without sending a bitfield of their own
+	expectMessage(t, leecher, message.Bitfield, []byte{0xc0})
+
+	leecher.SendInterested()
+	expectMessage(t, leecher, message.Unchoke, nil)
+
+	leecher.SendRequestBlock(0, 0, 32)
+	expectMessage(t, leecher, message.Piece, append([]byte{0, 0, 0, 0, 0, 0, 0, 0}, data[:32]...))
+
+	leecher.SendRequestBlock(1, 4, 4)
+	expectMessage(t, leecher, message.Piece, append([]byte{0, 0, 0, 1, 0, 0, 0, 4}, data[36:40]...))
+
+	// Blocks outside of the torrent are not sent
+	leecher.SendRequestBlock(1, 4, 32)
+	leecher.SendRequestBlock(1, 0, 4)
+	expectMessage(t, leecher, message.Piece, append([]byte{0, 0, 0, 1, 0, 0, 0, 0}, data[32:36]...))
+
+	// Seeding stops once we have uploaded as much as the size of the torrent
+	select {
+	case <-seeding:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected seeding to stop after reaching the ratio")
+	}
+
+	if _, err := leecher.RecieveMessage(); err == nil {
+		t.Errorf("Expected leecher to be disconnected once seeding stopped")
+	}
+}
+
+func TestUploaderCancelsRequests(t *testing.T) {
+	storage := piece.NewStorage(32, 32)
+	var uploaded int64
+	c := newPeerConn(&message.Client{}, storage.NumPieces(), nil, nil)
+	u := newUploader(c, storage, &uploaded)
+
+	request := func(id byte, index int, begin int, length int) *message.Message {
+		return &message.Message{Id: id, Payload: []byte{0, 0, 0, byte(index), 0, 0, 0, byte(begin), 0, 0, 0, byte(length)}}
+	}
+
+	// Requests are only queued once the peer is unchoked
+	u.handleMessage(request(message.Request, 0, 0, 16))
+	if len(u.requests) != 0 {
+		t.Fatalf("Expected requests of a choked peer to be dropped, got %v", u.requests)
+	}
+
+	c.status.amChoking = false
+	u.handleMessage(request(message.Request, 0, 0, 16))
+	u.handleMessage(request(message.Request, 0, 16, 16))
+	u.handleMessage(request(message.Cancel, 0, 0, 16))
+
+	if len(u.requests) != 1 || u.requests[0] != (blockRequest{0, 16, 16}) {
+		t.Errorf("Expected only the request that was not cancelled, got %v", u.requests)
+	}
+}
@@ -3,11 +3,7 @@ package piece
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
-	"time"
-
-	"github.com/anthony/BT/message"
 )
 
 const MaxBlockSize = 16384
@@ -19,116 +15,119 @@ type PieceWork struct {
 	PieceSize int
 }
 
+// PieceProgress is a piece being downloaded block by block. Blocks are requested in order, and the requests that were
+// not answered can be released to be requested again, possibly from another peer, without losing the blocks that
+// were received.
 type PieceProgress struct {
 	Index      int
-	Client     *message.Client
+	PieceHash  [20]byte
 	BlockData  []byte
 	Downloaded int
-	Requested  int
 	Backlog    int
-}
 
-type PieceResult struct {
-	Index int
-	Data  []byte
+	requested []bool
+	received  []bool
 }
 
-// TryDownloadPiece attempts to download the specified piece from the given peer client.
-//
-// It returns the piece data if the download is successful, or an error if the download fails.
-func TryDownloadPiece(client *message.Client, pw PieceWork) ([]byte, error) {
-	if !hasPiece(client.Bitfield, pw.Index) {
-		return nil, fmt.Errorf("Peer does not have piece %d", pw.Index)
-	}
+// NewPieceProgress starts the download of a piece, with none of its blocks requested.
+func NewPieceProgress(pw PieceWork) *PieceProgress {
+	numBlocks := (pw.PieceSize + MaxBlockSize - 1) / MaxBlockSize
 
-	state := PieceProgress{
-		Client:    client,
-		BlockData: make([]byte, pw.PieceSize),
+	return &PieceProgress{
 		Index:     pw.Index,
+		PieceHash: pw.PieceHash,
+		BlockData: make([]byte, pw.PieceSize),
+		requested: make([]bool, numBlocks),
+		received:  make([]bool, numBlocks),
 	}
+}
 
-	// Send an interested message to the peer to indicate that we want to download pieces from it
-	client.SendInterested()
-
-	if client.IsChoked {
-		client.SendUnchoke()
-	}
-
-	blockSize := MaxBlockSize
-	if pw.PieceSize < blockSize {
-		blockSize = pw.PieceSize
-	}
+// NextRequest marks the first block that was neither requested nor received as requested.
+//
+// It returns the offset and length of the block, or false if there are no more blocks to request.
+func (p *PieceProgress) NextRequest() (int, int, bool) {
+	for i := range p.requested {
+		if p.requested[i] || p.received[i] {
+			continue
+		}
 
-	client.Conn.SetDeadline(time.Now().Add(15 * time.Second))
-	defer client.Conn.SetDeadline(time.Time{})
+		p.requested[i] = true
+		p.Backlog++
 
-	for state.Downloaded < pw.PieceSize {
-		// Fill the pipeline with requests, up to the maximum allowed
-		for !client.IsChoked && state.Backlog < MaxPipelineRequests && state.Requested < pw.PieceSize {
-			if pw.PieceSize-state.Requested < blockSize {
-				blockSize = pw.PieceSize - state.Requested
-			}
+		begin := i * MaxBlockSize
 
-			client.SendRequestBlock(pw.Index, state.Requested, blockSize)
+		return begin, p.blockLength(begin), true
+	}
 
-			state.Requested += blockSize
-			state.Backlog++
-		}
+	return 0, 0, false
+}
 
-		if client.IsChoked {
-			client.SendUnchoke()
-		}
+// PutBlock stores a block the peer sent us. Peers may be hostile, so blocks that do not match a block of the piece
+// are ignored.
+//
+// It returns whether the block was stored.
+func (p *PieceProgress) PutBlock(begin int, block []byte) bool {
+	if begin < 0 || begin >= len(p.BlockData) || begin%MaxBlockSize != 0 || len(block) != p.blockLength(begin) {
+		return false
+	}
 
-		resp, err := client.RecieveMessage()
-		if err != nil {
-			return nil, err
-		}
+	i := begin / MaxBlockSize
+	if p.received[i] {
+		return false
+	}
 
-		// Keep alive message is receieved, continue to wait for the next message
-		if resp == nil {
-			continue
-		}
+	// Blocks that were requested before a release may still arrive, and are kept all the same
+	if p.requested[i] {
+		p.requested[i] = false
+		p.Backlog--
+	}
 
-		if resp.Id == message.Piece {
-			index := binary.BigEndian.Uint32(resp.Payload[0:4])
-			begin := binary.BigEndian.Uint32(resp.Payload[4:8])
+	copy(p.BlockData[begin:], block)
+	p.received[i] = true
+	p.Downloaded += len(block)
 
-			// Check that the piece index in the message matches the expected piece index for this download
-			if int(index) != state.Index {
-				continue
-			}
+	return true
+}
 
-			// Append the received block to the piece's block data
-			n := copy(state.BlockData[begin:], resp.Payload[8:])
+// Release forgets the requests that were not answered, such as when the peer chokes us, so that their blocks are
+// requested again.
+func (p *PieceProgress) Release() {
+	clear(p.requested)
+	p.Backlog = 0
+}
 
-			state.Downloaded += n
-			if n != 0 {
-				state.Backlog--
-			}
-		}
-	}
+// Done reports whether every block of the piece has been received.
+func (p *PieceProgress) Done() bool {
+	return p.Downloaded == len(p.BlockData)
+}
 
-	// Verify the piece hash matches the expected hash from the torrent file
-	pieceHash := sha1.Sum(state.BlockData)
-	if !bytes.Equal(pieceHash[:], pw.PieceHash[:]) {
-		return nil, fmt.Errorf("Hash mismatch for piece %d", pw.Index)
+// Verify checks the downloaded piece against its hash from the torrent file.
+//
+// It returns an error if the hashes do not match.
+func (p *PieceProgress) Verify() error {
+	pieceHash := sha1.Sum(p.BlockData)
+	if !bytes.Equal(pieceHash[:], p.PieceHash[:]) {
+		return fmt.Errorf("Hash mismatch for piece %d", p.Index)
 	}
 
-	// Notify the peer that we have successfully downloaded the piece
-	client.SendHave(pw.Index)
-
-	return state.BlockData, nil
+	return nil
 }
 
 /////////////////////////////// Helper Functions /////////////////////////////////
 
+// blockLength returns the length of the block at the offset, which is shorter than the block size at the end of the
+// piece.
+func (p *PieceProgress) blockLength(begin int) int {
+	return min(MaxBlockSize, len(p.BlockData)-begin)
+}
+
 // hasPiece checks if the peer has the specified piece based on the peer's bitfield.
 func hasPiece(bf []byte, index int) bool {
-	if bf == nil {
+	byteIndex := index / 8
+	if byteIndex >= len(bf) {
 		return false
 	}
 
-	byteIndex := index / 8
 	bitIndex := index % 8
 
 	return bf[byteIndex]&(1<<(7-bitIndex)) != 0
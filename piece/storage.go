@@ -0,0 +1,100 @@
+package piece
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Storage holds the pieces of a torrent we have downloaded, so that they can be written to disk once the download
+// completes and uploaded to other peers in the meantime.
+type Storage struct {
+	pieceLength int
+
+	mu        sync.RWMutex
+	data      []byte
+	bitfield  []byte
+	completed int
+}
+
+// NewStorage creates an empty storage for a torrent of the given length, split into pieces of the given length.
+func NewStorage(length int, pieceLength int) *Storage {
+	numPieces := (length + pieceLength - 1) / pieceLength
+
+	return &Storage{
+		pieceLength: pieceLength,
+		data:        make([]byte, length),
+		bitfield:    make([]byte, (numPieces+7)/8),
+	}
+}
+
+// Put stores the data of a verified piece.
+func (s *Storage) Put(index int, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copy(s.data[index*s.pieceLength:], data)
+	if !hasPiece(s.bitfield, index) {
+		s.bitfield[index/8] |= 1 << (7 - index%8)
+		s.completed++
+	}
+}
+
+// Bitfield returns a copy of the bitfield of the pieces we have, as sent to peers in a bitfield message.
+func (s *Storage) Bitfield() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]byte(nil), s.bitfield...)
+}
+
+// Has reports whether we have the piece with the index.
+func (s *Storage) Has(index int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return hasPiece(s.bitfield, index)
+}
+
+// NumPieces returns the number of pieces of the torrent.
+func (s *Storage) NumPieces() int {
+	return (len(s.data) + s.pieceLength - 1) / s.pieceLength
+}
+
+// Completed returns the number of pieces we have.
+func (s *Storage) Completed() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.completed
+}
+
+// Length returns the length of the torrent.
+func (s *Storage) Length() int {
+	return len(s.data)
+}
+
+// Data returns the data of the whole torrent, which is only complete once every piece has been stored.
+func (s *Storage) Data() []byte {
+	return s.data
+}
+
+// ReadBlock reads a block of a piece we have, as requested by a peer.
+//
+// It returns a copy of the block, or an error if we do not have the piece or the block is outside of the piece.
+func (s *Storage) ReadBlock(index int, begin int, length int) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if index < 0 || index >= len(s.bitfield)*8 || !hasPiece(s.bitfield, index) {
+		return nil, fmt.Errorf("Piece %d is not in storage", index)
+	}
+
+	pieceLength := min(s.pieceLength, len(s.data)-index*s.pieceLength)
+	if begin < 0 || length <= 0 || begin+length > pieceLength {
+		return nil, fmt.Errorf("Block at %d of length %d is outside of piece %d", begin, length, index)
+	}
+
+	start := index*s.pieceLength + begin
+
+	return append([]byte(nil), s.data[start:start+length]...), nil
+}
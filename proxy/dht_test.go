@@ -0,0 +1,48 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/anthony/BT/dht"
+	"github.com/anthony/BT/proxy"
+)
+
+// The DHT depends on the proxy package through the tracker package, so DHT tests through a proxy live outside of it.
+
+func TestSOCKS5DHT(t *testing.T) {
+	target, err := dht.NewServer(dht.Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	go target.Serve(pc)
+	defer target.Close()
+
+	// The node's IPv4 socket goes through the proxy, so its queries must still be sent over the IPv4 transport
+	dialer := &proxy.SOCKS5{Addr: proxy.StartSOCKS5Server(t, "user", "secret"), Username: "user", Password: "secret"}
+	node, err := dht.NewServer(dht.Config{
+		ListenPacket: func(network string, address string) (net.PacketConn, error) {
+			return dialer.ListenPacket(context.Background(), network, address)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node: %v", err)
+	}
+	go node.ListenAndServe()
+	defer node.Close()
+
+	node.AddNodes([]string{pc.LocalAddr().String()})
+	if node.Table().Len() != 1 {
+		t.Fatalf("Expected the node reached through the proxy in the routing table, got %d nodes", node.Table().Len())
+	}
+
+	if _, err := node.GetPeers([20]byte{1}); err != nil {
+		t.Errorf("Unexpected error looking up peers through proxy: %v", err)
+	}
+}
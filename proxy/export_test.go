@@ -0,0 +1,4 @@
+package proxy
+
+// StartSOCKS5Server starts the SOCKS5 proxy stand-in for tests outside the package.
+var StartSOCKS5Server = startSOCKS5Server
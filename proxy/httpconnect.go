@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPConnect dials TCP connections through an HTTP proxy using the CONNECT method.
+// HTTP proxies cannot relay UDP, so UDP trackers and the DHT are not available through them.
+type HTTPConnect struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (h *HTTPConnect) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("HTTP CONNECT proxy does not support network %s", network)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", h.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error dialing HTTP proxy: %w", err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if h.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error reading HTTP proxy response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy refused CONNECT with status %s", resp.Status)
+	}
+
+	// The reader may have buffered data the remote sent straight after the proxy's response
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func (h *HTTPConnect) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("HTTP CONNECT proxy does not support UDP")
+}
+
+func (h *HTTPConnect) ResolvesRemotely() bool {
+	return true
+}
+
+// bufferedConn reads from a buffered reader before reading from the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
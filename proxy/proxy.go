@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Dialer opens the network connections used by the client. Networked packages are given the dialer to connect with,
+// so that tracker, peer and DHT traffic can be sent through a proxy.
+type Dialer interface {
+	// DialContext connects to the address on the named network. Both TCP and UDP networks are supported,
+	// where a UDP connection is bound to the given remote address.
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+
+	// ListenPacket opens an unconnected UDP socket that can send datagrams to any address.
+	ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error)
+
+	// ResolvesRemotely reports whether host names given to the dialer are resolved by the proxy, in which case they
+	// should not be resolved locally so that our DNS queries do not reveal who we talk to.
+	ResolvesRemotely() bool
+}
+
+// DialTimeout connects to the address on the named network through the dialer, giving up after the timeout.
+func DialTimeout(d Dialer, network string, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return d.DialContext(ctx, network, address)
+}
+
+// FromURL creates a dialer from a proxy url. The supported schemes are `socks5` for SOCKS5 proxies and `http` for
+// HTTP CONNECT proxies, with optional credentials in the url's user info. An empty url dials directly.
+//
+// It returns the dialer, or an error if the url is invalid or the scheme is not supported.
+func FromURL(proxyUrl string) (Dialer, error) {
+	if proxyUrl == "" {
+		return Direct{}, nil
+	}
+
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing proxy URL: %w", err)
+	}
+
+	if u.Port() == "" {
+		return nil, fmt.Errorf("Proxy URL %s is missing a port", proxyUrl)
+	}
+
+	username := u.User.Username()
+	password, _ := u.User.Password()
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &SOCKS5{Addr: u.Host, Username: username, Password: password}, nil
+	case "http":
+		return &HTTPConnect{Addr: u.Host, Username: username, Password: password}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme: %s", u.Scheme)
+	}
+}
+
+// Direct dials connections directly without a proxy.
+type Direct struct{}
+
+func (Direct) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (Direct) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, network, address)
+}
+
+func (Direct) ResolvesRemotely() bool {
+	return false
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// boundPacketConn turns an unconnected packet conn into a connection to a single remote address,
+// discarding datagrams from any other address. A remote given by host name is only known by the address the proxy
+// resolved it to once it replies, so the first reply binds the connection to its address.
+type boundPacketConn struct {
+	net.PacketConn
+
+	mu     sync.Mutex
+	remote net.Addr
+}
+
+func (c *boundPacketConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+
+		c.mu.Lock()
+		if _, byName := c.remote.(hostAddr); byName {
+			c.remote = addr
+		}
+		matches := addr.String() == c.remote.String()
+		c.mu.Unlock()
+
+		if matches {
+			return n, nil
+		}
+	}
+}
+
+func (c *boundPacketConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.RemoteAddr())
+}
+
+func (c *boundPacketConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.remote
+}
+
+// hostAddr is the address of a remote by host name, which is left for the proxy to resolve so that our DNS queries
+// do not reveal who we talk to through the proxy.
+type hostAddr struct {
+	network string
+	address string
+}
+
+func (a hostAddr) Network() string {
+	return a.network
+}
+
+func (a hostAddr) String() string {
+	return a.address
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startEchoServers starts TCP and UDP servers that echo back everything they receive.
+func startEchoServers(t *testing.T) (string, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on TCP: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return listener.Addr().String(), pc.LocalAddr().String()
+}
+
+// startSOCKS5Server starts a minimal SOCKS5 proxy stand-in that requires the given credentials and supports
+// the CONNECT and UDP ASSOCIATE commands.
+func startSOCKS5Server(t *testing.T, username string, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on TCP: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, username, password)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn, username string, password string) {
+	defer conn.Close()
+
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil || greeting[2] != socksAuthPassword {
+		conn.Write([]byte{socksVersion, socksAuthUnavailable})
+		return
+	}
+	conn.Write([]byte{socksVersion, socksAuthPassword})
+
+	header := make([]byte, 2)
+	io.ReadFull(conn, header)
+	user := make([]byte, header[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, header[:1])
+	pass := make([]byte, header[0])
+	io.ReadFull(conn, pass)
+
+	if string(user) != username || string(pass) != password {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		return
+	}
+	conn.Write([]byte{socksPasswordVersion, socksReplySucceeded})
+
+	req := make([]byte, 3)
+	io.ReadFull(conn, req)
+	dest, err := readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch req[1] {
+	case socksCmdConnect:
+		target, err := net.Dial("tcp", dest.String())
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+
+		reply, _ := appendSocksAddr([]byte{socksVersion, socksReplySucceeded, 0}, target.LocalAddr().String())
+		conn.Write(reply)
+
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	case socksCmdUDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+
+		// Reply with an unspecified address, as many proxies do, so the client has to use the proxy's address
+		reply, _ := appendSocksAddr([]byte{socksVersion, socksReplySucceeded, 0}, net.JoinHostPort("0.0.0.0", strconv.Itoa(relay.LocalAddr().(*net.UDPAddr).Port)))
+		conn.Write(reply)
+
+		go relayUDP(relay)
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// relayUDP forwards datagrams between the client and the destinations in the SOCKS5 UDP headers.
+func relayUDP(relay *net.UDPConn) {
+	var client *net.UDPAddr
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if client == nil || (from.IP.Equal(client.IP) && from.Port == client.Port) {
+			client = from
+			reader := &sliceReader{data: buf[3:n]}
+			dest, err := readSocksAddr(reader)
+			if err != nil {
+				continue
+			}
+
+			// The proxy resolves host names for the client
+			destAddr, err := net.ResolveUDPAddr("udp", dest.String())
+			if err != nil {
+				continue
+			}
+			relay.WriteToUDP(reader.data, destAddr)
+			continue
+		}
+
+		packet, _ := appendSocksAddr([]byte{0, 0, 0}, from.String())
+		relay.WriteToUDP(append(packet, buf[:n]...), client)
+	}
+}
+
+// startHTTPConnectServer starts a minimal HTTP CONNECT proxy stand-in.
+func startHTTPConnectServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on TCP: %v", err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go func() {
+			defer target.Close()
+			io.Copy(target, conn)
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	})}
+
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return listener.Addr().String()
+}
+
+// assertEcho writes a message on the connection and checks it is echoed back.
+func assertEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := []byte("hello through the proxy")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Unexpected error writing: %v", err)
+	}
+
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Unexpected error reading: %v", err)
+	}
+
+	if string(buf) != string(msg) {
+		t.Errorf("Expected echo %q, got %q", msg, buf)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	tcpAddr, udpAddr := startEchoServers(t)
+	dialer, err := FromURL("socks5://user:secret@" + startSOCKS5Server(t, "user", "secret"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating dialer: %v", err)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("Unexpected error dialing TCP through proxy: %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	udpConn, err := dialer.DialContext(context.Background(), "udp", udpAddr)
+	if err != nil {
+		t.Fatalf("Unexpected error dialing UDP through proxy: %v", err)
+	}
+	defer udpConn.Close()
+	assertEcho(t, udpConn)
+}
+
+func TestSOCKS5SendsHostNames(t *testing.T) {
+	_, udpAddr := startEchoServers(t)
+	dialer := &SOCKS5{Addr: startSOCKS5Server(t, "user", "secret"), Username: "user", Password: "secret"}
+
+	// The host name of a UDP remote is resolved by the proxy, and replies bind the connection to the address
+	_, port, _ := net.SplitHostPort(udpAddr)
+	udpConn, err := dialer.DialContext(context.Background(), "udp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("Unexpected error dialing UDP through proxy: %v", err)
+	}
+	defer udpConn.Close()
+
+	if _, byName := udpConn.RemoteAddr().(hostAddr); !byName {
+		t.Errorf("Expected remote to be left unresolved, got %v", udpConn.RemoteAddr())
+	}
+	assertEcho(t, udpConn)
+	if udpConn.RemoteAddr().String() != udpAddr {
+		t.Errorf("Expected remote to be bound to %s, got %v", udpAddr, udpConn.RemoteAddr())
+	}
+
+	// The header of a datagram to a host name carries the name itself
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	defer relay.Close()
+
+	local, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+	pc := &socksPacketConn{UDPConn: local, relay: relay.LocalAddr().(*net.UDPAddr), buf: make([]byte, 65535)}
+	defer local.Close()
+
+	pc.WriteTo([]byte("x"), hostAddr{network: "udp", address: "tracker.example:80"})
+	buf := make([]byte, 64)
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := relay.ReadFrom(buf)
+	expected := "\x00\x00\x00\x03\x0ftracker.example\x00\x50x"
+	if err != nil || string(buf[:n]) != expected {
+		t.Errorf("Expected datagram %q, got %q (%v)", expected, buf[:n], err)
+	}
+}
+
+func TestSOCKS5WrongCredentials(t *testing.T) {
+	tcpAddr, _ := startEchoServers(t)
+	dialer := &SOCKS5{Addr: startSOCKS5Server(t, "user", "secret"), Username: "user", Password: "wrong"}
+
+	_, err := dialer.DialContext(context.Background(), "tcp", tcpAddr)
+	if err == nil {
+		t.Errorf("Expected error dialing with wrong credentials, but got none")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	tcpAddr, udpAddr := startEchoServers(t)
+	dialer, err := FromURL("http://" + startHTTPConnectServer(t))
+	if err != nil {
+		t.Fatalf("Unexpected error creating dialer: %v", err)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("Unexpected error dialing TCP through proxy: %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+
+	_, err = dialer.DialContext(context.Background(), "udp", udpAddr)
+	if err == nil {
+		t.Errorf("Expected error dialing UDP through HTTP proxy, but got none")
+	}
+}
@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// These constants are based on the SOCKS5 specification in RFC 1928 and RFC 1929:
+const (
+	socksVersion         = 0x05
+	socksAuthNone        = 0x00
+	socksAuthPassword    = 0x02
+	socksAuthUnavailable = 0xff
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded = 0x00
+)
+
+// Timeout for negotiating with the proxy when the caller did not give a deadline.
+const handshakeTimeout = 10 * time.Second
+
+// SOCKS5 dials connections through a SOCKS5 proxy. TCP connections use the CONNECT command and
+// UDP sockets use the UDP ASSOCIATE command, so UDP trackers and the DHT also work through the proxy.
+type SOCKS5 struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (s *SOCKS5) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, _, err := s.request(ctx, socksCmdConnect, address)
+		return conn, err
+	case "udp", "udp4", "udp6":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		// Host names are sent to the proxy unresolved, as they are for TCP connections
+		var remote net.Addr = hostAddr{network: network, address: address}
+		if net.ParseIP(host) != nil {
+			remote, err = net.ResolveUDPAddr(network, address)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pc, err := s.ListenPacket(ctx, network, "")
+		if err != nil {
+			return nil, err
+		}
+
+		return &boundPacketConn{PacketConn: pc, remote: remote}, nil
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy does not support network %s", network)
+	}
+}
+
+// ListenPacket opens a UDP association with the proxy on the named network. The local address is ignored, since
+// datagrams are sent from the proxy's relay address. The association lasts until the returned packet conn is closed.
+func (s *SOCKS5) ListenPacket(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	// The client's address is not known ahead of time, so the proxy is asked to accept datagrams from any address
+	ctrl, relay, err := s.request(ctx, socksCmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+
+	// Proxies often reply with an unspecified relay address, meaning the relay is on the proxy's own address
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	// The local socket is bound on the requested network, so that its local address tells the address family of the
+	// association apart, as it does for a socket opened directly
+	if (network == "udp4" && relay.IP.To4() == nil) || (network == "udp6" && relay.IP.To4() != nil) {
+		ctrl.Close()
+		return nil, fmt.Errorf("SOCKS5 relay %s cannot be reached over %s", relay, network)
+	}
+
+	local, err := net.ListenUDP(network, nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	pc := &socksPacketConn{UDPConn: local, ctrl: ctrl, relay: relay, buf: make([]byte, 65535)}
+
+	// The association ends when the control connection closes, so closing the packet conn unblocks any reads
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		pc.Close()
+	}()
+
+	return pc, nil
+}
+
+func (s *SOCKS5) ResolvesRemotely() bool {
+	return true
+}
+
+// request connects to the proxy, authenticates and sends the given command.
+//
+// It returns the control connection and the address bound by the proxy, or an error if the proxy refused.
+func (s *SOCKS5) request(ctx context.Context, cmd byte, address string) (net.Conn, *net.UDPAddr, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error dialing SOCKS5 proxy: %w", err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	bound, err := s.negotiate(conn, cmd, address)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, bound, nil
+}
+
+// negotiate performs the SOCKS5 method selection, authentication and request on the control connection.
+//
+// It returns the address bound by the proxy, or an error if the proxy refused.
+func (s *SOCKS5) negotiate(conn net.Conn, cmd byte, address string) (*net.UDPAddr, error) {
+	method := byte(socksAuthNone)
+	if s.Username != "" {
+		method = socksAuthPassword
+	}
+
+	_, err := conn.Write([]byte{socksVersion, 1, method})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("Error reading SOCKS5 method selection: %w", err)
+	}
+
+	if resp[0] != socksVersion || resp[1] == socksAuthUnavailable || resp[1] != method {
+		return nil, fmt.Errorf("SOCKS5 proxy does not accept our authentication method")
+	}
+
+	if method == socksAuthPassword {
+		auth := []byte{socksPasswordVersion, byte(len(s.Username))}
+		auth = append(auth, s.Username...)
+		auth = append(auth, byte(len(s.Password)))
+		auth = append(auth, s.Password...)
+
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, fmt.Errorf("Error reading SOCKS5 authentication response: %w", err)
+		}
+
+		if resp[1] != socksReplySucceeded {
+			return nil, fmt.Errorf("SOCKS5 proxy rejected our credentials")
+		}
+	}
+
+	req := []byte{socksVersion, cmd, 0}
+	req, err = appendSocksAddr(req, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("Error reading SOCKS5 reply: %w", err)
+	}
+
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("Invalid SOCKS5 reply version %d", header[0])
+	}
+
+	if header[1] != socksReplySucceeded {
+		return nil, fmt.Errorf("SOCKS5 proxy refused request with reply code %d", header[1])
+	}
+
+	bound, err := readSocksAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// A relay given by host name runs on the proxy itself, so resolving it reveals nothing the connection to the proxy
+	// did not
+	if addr, ok := bound.(*net.UDPAddr); ok {
+		return addr, nil
+	}
+
+	return net.ResolveUDPAddr("udp", bound.String())
+}
+
+// socksPacketConn sends and receives datagrams through a SOCKS5 UDP relay. Each datagram is prefixed
+// with a header containing the destination or source address, as specified in RFC 1928.
+type socksPacketConn struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	// Datagrams are read into buf, which is large enough for any datagram, before their header is stripped
+	readMu sync.Mutex
+	buf    []byte
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// RSV (2 bytes) and FRAG (1 byte) are always zero, since we never fragment datagrams
+	packet, err := appendSocksAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	packet = append(packet, b...)
+	if _, err := c.UDPConn.WriteTo(packet, c.relay); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	buf := c.buf
+	for {
+		n, from, err := c.UDPConn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// Only datagrams from the relay are accepted, and fragmented datagrams are dropped
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port || n < 4 || buf[2] != 0 {
+			continue
+		}
+
+		reader := &sliceReader{data: buf[3:n]}
+		addr, err := readSocksAddr(reader)
+		if err != nil {
+			continue
+		}
+
+		return copy(b, reader.data), addr, nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// appendSocksAddr appends the address in the SOCKS5 format, which is the address type, the address and a 2 byte port.
+// Host names are sent to the proxy unresolved.
+func appendSocksAddr(buf []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port in address %s", address)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socksAddrIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socksAddrIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name %s is too long for SOCKS5", host)
+		}
+
+		buf = append(buf, socksAddrDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// readSocksAddr reads an address in the SOCKS5 format.
+//
+// It returns the address, or an error if the address is invalid. Host names are left unresolved.
+func readSocksAddr(r io.Reader) (net.Addr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	var host string
+	switch atyp[0] {
+	case socksAddrIPv4:
+		ip = make(net.IP, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+	case socksAddrIPv6:
+		ip = make(net.IP, 16)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, err
+		}
+
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		return nil, fmt.Errorf("Invalid SOCKS5 address type %d", atyp[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+
+	if ip == nil {
+		return hostAddr{network: "udp", address: net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))}, nil
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
+
+// sliceReader reads from a byte slice, leaving the unread bytes in data.
+type sliceReader struct {
+	data []byte
+}
+
+func (r *sliceReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
@@ -52,10 +52,17 @@ func extractMagnetInfo(magnetURI string) (TorrentFile, error) {
 		return TorrentFile{}, fmt.Errorf("Invalid magnet URI: missing tracker URLs")
 	}
 
+	// Magnet links have no notion of tiers, so every tracker is placed in its own tier and announced to
+	var announceTiers [][]string
+	for _, tracker := range announceList {
+		announceTiers = append(announceTiers, []string{tracker})
+	}
+
 	torrentFile := TorrentFile{
-		Name:         url.Query().Get("dn"),
-		InfoHash:     infoHash,
-		AnnounceList: announceList,
+		Name:          url.Query().Get("dn"),
+		InfoHash:      infoHash,
+		AnnounceList:  announceList,
+		AnnounceTiers: announceTiers,
 	}
 
 	return torrentFile, nil
@@ -3,7 +3,9 @@ package torrent
 import (
 	"crypto/sha1"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/anthony/BT/bencode"
@@ -21,18 +23,21 @@ type bencodeInfo struct {
 }
 
 type bencodeTorrent struct {
-	Announce     string      `mapstructure:"announce"`
-	AnnounceList [][]string  `mapstructure:"announce-list"`
-	Info         bencodeInfo `mapstructure:"info"`
+	Announce     string          `mapstructure:"announce"`
+	AnnounceList [][]string      `mapstructure:"announce-list"`
+	Nodes        [][]interface{} `mapstructure:"nodes"`
+	Info         bencodeInfo     `mapstructure:"info"`
 }
 
 type TorrentFile struct {
-	Name         string
-	AnnounceList []string
-	InfoHash     [20]byte
-	PiecesHash   [][20]byte
-	Info         InfoDict
-	Interval     int
+	Name          string
+	AnnounceList  []string
+	AnnounceTiers [][]string
+	Nodes         []string
+	InfoHash      [20]byte
+	PiecesHash    [][20]byte
+	Info          InfoDict
+	Interval      int
 }
 
 type InfoDict struct {
@@ -63,45 +68,34 @@ func extractTorrentInfo(filePath string) (TorrentFile, error) {
 	}
 
 	infoHash := calculateInfoHash(bcodedTorrent.Info)
+	infoDict := newInfoDict(bcodedTorrent.Info)
 
-	bcodedInfo := bcodedTorrent.Info
-	infoDict := InfoDict{}
-
-	infoDict.Name = bcodedInfo.Name
-	infoDict.PieceLength = bcodedInfo.PieceLength
-	infoDict.Pieces = bcodedInfo.Pieces
-
-	// If the file key exists, the torrent file is a multi-file torrent, and the list of files is stored there
-	// Otherwise, the torrent file is a single-file torrent, and the length of the file is stored in the length key
-	if len(bcodedInfo.Files) > 0 {
-		for _, file := range bcodedInfo.Files {
-			path := strings.Join(file.Path, "/")
-			infoDict.Files = append(infoDict.Files, FileDict{
-				Length: file.Length,
-				Path:   path,
-			})
+	// If the announce-list key exists, the tiers of trackers are stored there as specified in BEP 12
+	var announceList []string
+	var announceTiers [][]string
+	for _, tier := range bcodedTorrent.AnnounceList {
+		if len(tier) == 0 {
+			continue
 		}
-	} else {
-		infoDict.Length = bcodedInfo.Length
-	}
 
-	// If the announce-list key exists, the list of trackers is stored there
-	var announceList []string
-	for _, tracker := range bcodedTorrent.AnnounceList {
-		announceList = append(announceList, tracker...)
+		announceList = append(announceList, tier...)
+		announceTiers = append(announceTiers, tier)
 	}
 
 	// Only `announce` if `announce list` is not present
 	if len(announceList) == 0 {
 		announceList = append(announceList, bcodedTorrent.Announce)
+		announceTiers = append(announceTiers, []string{bcodedTorrent.Announce})
 	}
 
 	torrent := TorrentFile{
-		Name:         infoDict.Name,
-		AnnounceList: announceList,
-		InfoHash:     infoHash,
-		Info:         infoDict,
-		Interval:     1800,
+		Name:          infoDict.Name,
+		AnnounceList:  announceList,
+		AnnounceTiers: announceTiers,
+		Nodes:         parseNodes(bcodedTorrent.Nodes),
+		InfoHash:      infoHash,
+		Info:          infoDict,
+		Interval:      1800,
 	}
 
 	err = torrent.CalculatePiecesHash()
@@ -133,8 +127,71 @@ func (tf *TorrentFile) CalculatePiecesHash() error {
 	return nil
 }
 
+// ParseInfoDict decodes a bencoded info dictionary, such as the metadata received from a peer with the ut_metadata
+// extension as specified in BEP 9.
+//
+// It returns the info dictionary, or an error if the metadata is not a valid info dictionary.
+func ParseInfoDict(metadata []byte) (InfoDict, error) {
+	var bcodedInfo bencodeInfo
+	if err := bencode.Decode(metadata, &bcodedInfo); err != nil {
+		return InfoDict{}, err
+	}
+
+	if bcodedInfo.PieceLength <= 0 || len(bcodedInfo.Pieces)%20 != 0 {
+		return InfoDict{}, fmt.Errorf("Invalid info dictionary")
+	}
+
+	return newInfoDict(bcodedInfo), nil
+}
+
 //////////////////////////////// Helper Functions /////////////////////////////////
 
+// newInfoDict converts a decoded info dictionary into an InfoDict.
+func newInfoDict(bcodedInfo bencodeInfo) InfoDict {
+	infoDict := InfoDict{}
+
+	infoDict.Name = bcodedInfo.Name
+	infoDict.PieceLength = bcodedInfo.PieceLength
+	infoDict.Pieces = bcodedInfo.Pieces
+
+	// If the file key exists, the torrent file is a multi-file torrent, and the list of files is stored there
+	// Otherwise, the torrent file is a single-file torrent, and the length of the file is stored in the length key
+	if len(bcodedInfo.Files) > 0 {
+		for _, file := range bcodedInfo.Files {
+			path := strings.Join(file.Path, "/")
+			infoDict.Files = append(infoDict.Files, FileDict{
+				Length: file.Length,
+				Path:   path,
+			})
+		}
+	} else {
+		infoDict.Length = bcodedInfo.Length
+	}
+
+	return infoDict
+}
+
+// parseNodes converts the `nodes` of a trackerless torrent, a list of host and port pairs as specified in BEP 5,
+// into host:port addresses of DHT nodes. Malformed entries are skipped.
+func parseNodes(nodes [][]interface{}) []string {
+	var addrs []string
+	for _, node := range nodes {
+		if len(node) != 2 {
+			continue
+		}
+
+		host, ok := node[0].(string)
+		port, ok2 := node[1].(int)
+		if !ok || !ok2 || host == "" {
+			continue
+		}
+
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	return addrs
+}
+
 // calculateInfoHash takes in the bencoded info struct calculates the SHA-1 hash
 // of the bencoded info dictionary, returning the hash as a byte array.
 func calculateInfoHash(data bencodeInfo) [20]byte {
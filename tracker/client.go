@@ -0,0 +1,189 @@
+package tracker
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/anthony/BT/proxy"
+)
+
+// DefaultUserAgent identifies the client to HTTP trackers.
+const DefaultUserAgent = "BT/1.0"
+
+// Default limits of the HTTP client. Tracker responses are small, so anything larger than the response size
+// limit is most likely not a tracker response.
+const (
+	defaultHTTPTimeout     = 10 * time.Second
+	defaultMaxResponseSize = 1 << 20
+)
+
+// HTTPConfig holds the settings of the HTTP client used for HTTP tracker requests.
+type HTTPConfig struct {
+	Timeout time.Duration
+
+	// RootCAs are the certificate authorities trusted for HTTPS trackers. A nil pool trusts the system's authorities.
+	RootCAs *x509.CertPool
+
+	// Certificates are presented to HTTPS trackers that require client certificates.
+	Certificates []tls.Certificate
+
+	UserAgent string
+
+	// MaxResponseSize is the largest response body accepted from a tracker, after decompression.
+	MaxResponseSize int64
+}
+
+// HTTPClient sends the requests of HTTP trackers with the settings of the config it was built from. Trackers that share
+// a client share its connections.
+type HTTPClient struct {
+	client *http.Client
+	cfg    HTTPConfig
+}
+
+// DefaultHTTPConfig returns the default HTTP client config, which trusts the system's certificate authorities.
+func DefaultHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		Timeout:         defaultHTTPTimeout,
+		UserAgent:       DefaultUserAgent,
+		MaxResponseSize: defaultMaxResponseSize,
+	}
+}
+
+// NewHTTPClient creates an HTTP client for trackers from the config, with the defaults for any unset limits.
+// Connections are dialed through the dialer and kept alive between announces, so repeated announces to a tracker
+// reuse its connection. A nil dialer connects directly.
+func NewHTTPClient(cfg HTTPConfig, dialer proxy.Dialer) *HTTPClient {
+	if dialer == nil {
+		dialer = proxy.Direct{}
+	}
+
+	defaults := DefaultHTTPConfig()
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaults.Timeout
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaults.UserAgent
+	}
+	if cfg.MaxResponseSize <= 0 {
+		cfg.MaxResponseSize = defaults.MaxResponseSize
+	}
+
+	transport := &http.Transport{
+		DialContext: dialer.DialContext,
+		TLSClientConfig: &tls.Config{
+			RootCAs:      cfg.RootCAs,
+			Certificates: cfg.Certificates,
+		},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: cfg.Timeout,
+
+		// Compression is handled by the client itself, so that the response size limit applies after decompression
+		DisableCompression: true,
+	}
+
+	return &HTTPClient{
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: transport,
+		},
+		cfg: cfg,
+	}
+}
+
+// LoadRootCAs adds the PEM encoded certificate authorities in the given file to the trusted authorities,
+// on top of the system's authorities.
+//
+// It returns an error if the file could not be read or contains no certificates.
+func (cfg *HTTPConfig) LoadRootCAs(path string) error {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error reading CA file: %w", err)
+	}
+
+	if cfg.RootCAs == nil {
+		cfg.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			cfg.RootCAs = x509.NewCertPool()
+		}
+	}
+
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No certificates found in CA file %s", path)
+	}
+
+	return nil
+}
+
+// LoadClientCertificate adds the PEM encoded certificate and private key in the given files to the certificates
+// presented to HTTPS trackers.
+//
+// It returns an error if the files could not be read or do not contain a matching certificate and key.
+func (cfg *HTTPConfig) LoadClientCertificate(certPath string, keyPath string) error {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("Error loading client certificate: %w", err)
+	}
+
+	cfg.Certificates = append(cfg.Certificates, cert)
+
+	return nil
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// get sends a GET request to the tracker with the configured user agent, asking for a gzip-compressed response.
+//
+// It returns the status code and the decompressed body, or an error if the request failed
+// or the body is larger than the response size limit.
+func (c *HTTPClient) get(trackerURL string) (int, []byte, error) {
+	cfg := c.cfg
+
+	req, err := http.NewRequest(http.MethodGet, trackerURL, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// The body must be read to the end for the connection to be reused
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, cfg.MaxResponseSize))
+		resp.Body.Close()
+	}()
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error decompressing tracker response: %w", err)
+		}
+		defer gzipReader.Close()
+
+		body = gzipReader
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, cfg.MaxResponseSize+1))
+	if err != nil {
+		return 0, nil, fmt.Errorf("Error reading tracker response: %w", err)
+	}
+
+	if int64(len(data)) > cfg.MaxResponseSize {
+		return 0, nil, fmt.Errorf("Tracker response is larger than the %d byte limit", cfg.MaxResponseSize)
+	}
+
+	return resp.StatusCode, data, nil
+}
@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const compactResponse = "d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"
+
+// startTLSTracker starts an HTTPS tracker that gzips its response and counts the connections made to it.
+func startTLSTracker(t *testing.T, userAgent *string) (*httptest.Server, *int32) {
+	var connections int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*userAgent = r.Header.Get("User-Agent")
+
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(compactResponse))
+			return
+		}
+
+		var buf bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buf)
+		gzipWriter.Write([]byte(compactResponse))
+		gzipWriter.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv, &connections
+}
+
+func TestHTTPClientTrustsConfiguredCA(t *testing.T) {
+	var userAgent string
+	srv, connections := startTLSTracker(t, &userAgent)
+
+	// The test server's certificate is not trusted by the system, so the announce must fail
+	_, err := RequestPeers(srv.URL+"/announce", [20]byte{1}, [20]byte{2}, 6881)
+	if err == nil {
+		t.Fatalf("Expected error announcing to untrusted tracker, but got none")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	cfg := DefaultHTTPConfig()
+	cfg.RootCAs = pool
+	cfg.UserAgent = "test-agent/1.0"
+	client := NewHTTPClient(cfg, nil)
+	atomic.StoreInt32(connections, 0)
+
+	// Trackers sharing a client share its connections
+	for i := 0; i < 2; i++ {
+		tracker, err := NewTracker(srv.URL+"/announce", client, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating tracker: %v", err)
+		}
+
+		result, err := tracker.Announce([20]byte{1}, [20]byte{2}, 6881)
+		if err != nil {
+			t.Fatalf("Unexpected error announcing to trusted tracker: %v", err)
+		}
+
+		if len(result.Peers) != 1 || result.Peers[0].String() != "127.0.0.1:6881" {
+			t.Errorf("Expected peer 127.0.0.1:6881 from gzipped response, got %v", result.Peers)
+		}
+	}
+
+	if userAgent != "test-agent/1.0" {
+		t.Errorf("Expected user agent test-agent/1.0, got %q", userAgent)
+	}
+
+	if n := atomic.LoadInt32(connections); n != 1 {
+		t.Errorf("Expected announces to reuse a single connection, got %d connections", n)
+	}
+}
+
+func TestHTTPClientResponseSizeLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(compactResponse))
+	}))
+	defer srv.Close()
+
+	cfg := DefaultHTTPConfig()
+	cfg.MaxResponseSize = int64(len(compactResponse) - 1)
+	tracker, err := NewTracker(srv.URL+"/announce", NewHTTPClient(cfg, nil), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating tracker: %v", err)
+	}
+
+	_, err = tracker.Announce([20]byte{1}, [20]byte{2}, 6881)
+	if err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("Expected response size limit error, got %v", err)
+	}
+}
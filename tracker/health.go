@@ -0,0 +1,89 @@
+package tracker
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Failing trackers are retried after an exponential backoff, starting at backoffBase and doubling with
+// every consecutive failure up to backoffMax.
+const (
+	backoffBase = 15 * time.Second
+	backoffMax  = 4 * time.Hour
+)
+
+// Weight of the latest latency in the moving average of a tracker's latency.
+const latencyWeight = 0.3
+
+// Health contains the announce statistics of a single tracker.
+type Health struct {
+	Successes           int
+	Failures            int
+	ConsecutiveFailures int
+	Latency             time.Duration
+	LastError           string
+	LastWarning         string
+	LastAnnounce        time.Time
+	RetryAt             time.Time
+}
+
+// Status is a snapshot of a tracker's health. A tracker is working if its last announce succeeded,
+// and ready if it can currently be announced to. Trackers that asked never to be retried are not retried until
+// NeverUntil. The tracker id is the one the tracker last gave us, which is echoed back on every announce.
+type Status struct {
+	Url        string
+	Health     Health
+	Working    bool
+	Ready      bool
+	Never      bool
+	NeverUntil time.Time
+	TrackerId  string
+}
+
+// SuccessRate returns the fraction of announces that succeeded. Trackers without any announces
+// start at 0.5, so that a single result does not decide the tracker's rate.
+func (h Health) SuccessRate() float64 {
+	return float64(h.Successes+1) / float64(h.Successes+h.Failures+2)
+}
+
+// Score rates the tracker by its success rate, penalised by its latency. Higher scores are healthier.
+func (h Health) Score() float64 {
+	return h.SuccessRate() / (1 + h.Latency.Seconds())
+}
+
+// recordSuccess updates the statistics after a successful announce and clears any backoff.
+func (h *Health) recordSuccess(latency time.Duration, warning string, now time.Time) {
+	h.Successes++
+	h.ConsecutiveFailures = 0
+	h.LastError = ""
+	h.LastWarning = warning
+	h.LastAnnounce = now
+	h.RetryAt = time.Time{}
+
+	if h.Latency == 0 {
+		h.Latency = latency
+	} else {
+		h.Latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(h.Latency))
+	}
+}
+
+// recordFailure updates the statistics after a failed announce and backs the tracker off.
+func (h *Health) recordFailure(err error, now time.Time) {
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastError = err.Error()
+	h.LastAnnounce = now
+	h.RetryAt = now.Add(backoff(h.ConsecutiveFailures))
+}
+
+// backoff returns how long to wait before retrying a tracker after the given number of consecutive failures.
+// Half of the delay is random jitter, so that many clients backing off the same tracker do not retry in lockstep.
+func backoff(failures int) time.Duration {
+	delay := backoffBase
+	for i := 1; i < failures && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	delay = min(delay, backoffMax)
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -1,24 +1,36 @@
 package tracker
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/anthony/BT/bencode"
 )
 
+// Struct for parsing the fields the tracker can send alongside the list of peers, regardless of the peer list format.
+// These fields are specified in BEP 3, with `retry in` specified in BEP 31.
+type httpTrackerStatus struct {
+	FailureReason  string      `mapstructure:"failure reason"`
+	WarningMessage string      `mapstructure:"warning message"`
+	Interval       int         `mapstructure:"interval"`
+	MinInterval    int         `mapstructure:"min interval"`
+	TrackerId      string      `mapstructure:"tracker id"`
+	Complete       int         `mapstructure:"complete"`
+	Incomplete     int         `mapstructure:"incomplete"`
+	RetryIn        interface{} `mapstructure:"retry in"`
+}
+
 // Struct for parsing the tracker's response when the tracker responds with a compact string of peers.
-// This format is based off of the specification in BEP 23.
+// This format is based off of the specification in BEP 23, with IPv6 peers in `peers6` as specified in BEP 7.
 type compactHttpTrackerResp struct {
 	Interval int    `mapstructure:"interval"`
 	Peers    string `mapstructure:"peers"`
+	Peers6   string `mapstructure:"peers6"`
 }
 
 // Struct for parsing the tracker's response when the tracker responds with a non-compact list of peers.
@@ -37,31 +49,53 @@ type normalHttpTrackerResp struct {
 	Event      string `mapstructure:"event"`
 }
 
-// requestPeersFromHTTPTracker attempts to extract a list of peers from the given HTTP tracker url
+// Struct for parsing the tracker's response to a scrape, where the statistics of each torrent are keyed by info hash.
+type httpScrapeResp struct {
+	FailureReason string                  `mapstructure:"failure reason"`
+	Files         map[string]ScrapeResult `mapstructure:"files"`
+}
+
+// requestPeersFromHTTPTracker attempts to extract a list of peers from the given HTTP tracker url using the client.
+// The tracker id is echoed back to the tracker if one was given in a previous response.
 //
-// It returns a list of peer IP addresses and ports if the request is successful. Otherwise it returns an error.
-func requestPeersFromHTTPTracker(url *url.URL, infoHash [20]byte, peerId [20]byte, port int) ([]net.TCPAddr, error) {
-	trackerURL, err := buildTrackerURL(url, infoHash, peerId, port)
+// It returns the announce result if the request is successful. If the tracker responds with a failure reason,
+// it returns a *FailureError. Otherwise it returns any other error encountered.
+func requestPeersFromHTTPTracker(client *HTTPClient, url *url.URL, trackerId string, infoHash [20]byte, peerId [20]byte, port int) (AnnounceResult, error) {
+	trackerURL, err := buildTrackerURL(url, trackerId, infoHash, peerId, port)
 	if err != nil {
-		return nil, err
+		return AnnounceResult{}, err
 	}
 
-	http.DefaultClient.Timeout = 10 * time.Second
-	resp, err := http.Get(trackerURL)
+	statusCode, body, err := client.get(trackerURL)
 	if err != nil {
-		return nil, err
+		return AnnounceResult{}, err
 	}
 
-	defer resp.Body.Close()
+	// Some trackers send a failure reason with a non-200 status code, so the body is checked for one first
+	var status httpTrackerStatus
+	statusErr := bencode.Decode(body, &status)
+	if statusErr == nil && status.FailureReason != "" {
+		return AnnounceResult{}, &FailureError{
+			Reason:  status.FailureReason,
+			RetryIn: parseRetryIn(status.RetryIn),
+		}
+	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if statusCode != http.StatusOK {
+		return AnnounceResult{}, fmt.Errorf("Tracker responded with non-200 status code: %d", statusCode)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Tracker responded with non-200 status code: %d", resp.StatusCode)
+	if statusErr != nil {
+		return AnnounceResult{}, fmt.Errorf("Error decoding tracker response: %v", statusErr)
+	}
+
+	result := AnnounceResult{
+		Interval:    time.Duration(status.Interval) * time.Second,
+		MinInterval: time.Duration(status.MinInterval) * time.Second,
+		TrackerId:   status.TrackerId,
+		Warning:     status.WarningMessage,
+		Seeders:     status.Complete,
+		Leechers:    status.Incomplete,
 	}
 
 	var compactResp compactHttpTrackerResp
@@ -69,40 +103,95 @@ func requestPeersFromHTTPTracker(url *url.URL, infoHash [20]byte, peerId [20]byt
 	peerAddr := []net.TCPAddr{}
 
 	// The tracker can respond with a list of peers in two formats:
-	// 1. A compact string of the format x.x.x.x:x, where each peer is represented by 6 bytes (4 for IP and 2 for port)
+	// 1. A compact string, where each peer is represented by 6 bytes (4 for IP and 2 for port),
+	//    along with a compact string of IPv6 peers, where each peer is represented by 18 bytes (16 for IP and 2 for port)
 	// 2. A list of dictionaries, where each dictionary contains the keys "ip" and "port"
 	if err == nil {
-		for i := 0; i < len(compactResp.Peers); i += 6 {
-			ip := net.IP(compactResp.Peers[i : i+4])
-			port := binary.BigEndian.Uint16([]byte(compactResp.Peers[i+4 : i+6]))
+		peersV4, err := parseCompactPeers([]byte(compactResp.Peers), compactPeerLenV4)
+		if err != nil {
+			return AnnounceResult{}, err
+		}
 
-			peerAddr = append(peerAddr, net.TCPAddr{
-				IP:   ip,
-				Port: int(port),
-			})
+		peersV6, err := parseCompactPeers([]byte(compactResp.Peers6), compactPeerLenV6)
+		if err != nil {
+			return AnnounceResult{}, err
 		}
+
+		peerAddr = append(peerAddr, peersV4...)
+		peerAddr = append(peerAddr, peersV6...)
 	} else {
 		var normalResp normalHttpTrackerResp
 		err = bencode.Decode(body, &normalResp)
 		if err != nil {
-			return nil, fmt.Errorf("Error decoding tracker response: %v", err)
+			return AnnounceResult{}, fmt.Errorf("Error decoding tracker response: %v", err)
 		}
 
 		for _, peer := range normalResp.Peers {
+			// The ip can be an IPv4 address, an IPv6 address or a DNS name as specified in BEP 3
+			ip := net.ParseIP(peer.Ip)
+			if ip == nil {
+				ips, err := net.LookupIP(peer.Ip)
+				if err != nil || len(ips) == 0 {
+					continue
+				}
+				ip = ips[0]
+			}
+
 			peerAddr = append(peerAddr, net.TCPAddr{
-				IP:   net.ParseIP(peer.Ip),
+				IP:   ip,
 				Port: peer.Port,
 			})
 		}
 	}
 
-	return peerAddr, nil
+	result.Peers = peerAddr
+
+	return result, nil
+}
+
+// scrapeHTTPTracker requests the statistics of the info hash's swarm from the scrape url of the HTTP tracker using
+// the client.
+//
+// It returns the statistics of the swarm if the request is successful. If the tracker responds with a failure reason,
+// it returns a *FailureError. Otherwise it returns any other error encountered.
+func scrapeHTTPTracker(client *HTTPClient, url *url.URL, infoHash [20]byte) (ScrapeResult, error) {
+	scrapeURL, err := buildScrapeURL(url, infoHash)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	statusCode, body, err := client.get(scrapeURL)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	var resp httpScrapeResp
+	decodeErr := bencode.Decode(body, &resp)
+	if decodeErr == nil && resp.FailureReason != "" {
+		return ScrapeResult{}, &FailureError{Reason: resp.FailureReason}
+	}
+
+	if statusCode != http.StatusOK {
+		return ScrapeResult{}, fmt.Errorf("Tracker responded with non-200 status code: %d", statusCode)
+	}
+
+	if decodeErr != nil {
+		return ScrapeResult{}, fmt.Errorf("Error decoding scrape response: %v", decodeErr)
+	}
+
+	// Trackers leave out torrents they do not track
+	result, ok := resp.Files[string(infoHash[:])]
+	if !ok {
+		return ScrapeResult{}, fmt.Errorf("Tracker %s does not track the torrent", url)
+	}
+
+	return result, nil
 }
 
 // buildTrackerURL constructs the URL to send to the tracker based on the given parameters.
 //
 // It returns the constructed URL as a string, or an error if there is an issue building the URL.
-func buildTrackerURL(url *url.URL, hash [20]byte, peerId [20]byte, port int) (string, error) {
+func buildTrackerURL(url *url.URL, trackerId string, hash [20]byte, peerId [20]byte, port int) (string, error) {
 	query := url.Query()
 	query.Set("info_hash", string(hash[:]))
 	query.Set("peer_id", string(peerId[:]))
@@ -112,7 +201,65 @@ func buildTrackerURL(url *url.URL, hash [20]byte, peerId [20]byte, port int) (st
 	query.Set("left", "0")
 	query.Set("compact", "1")
 
-	url.RawQuery = query.Encode()
+	// The tracker id must be sent back on subsequent announces if the tracker gave us one
+	if trackerId != "" {
+		query.Set("trackerid", trackerId)
+	}
+
+	// Let the tracker know about our addresses of both families, so that peers using the other
+	// family can still reach us, as specified in BEP 7.
+	ipv4, ipv6 := localIPs()
+	if ipv4 != nil {
+		query.Set("ipv4", ipv4.String())
+	}
+	if ipv6 != nil {
+		query.Set("ipv6", ipv6.String())
+	}
+
+	// Copy the url so that the announce parameters do not leak into the next announce
+	announceURL := *url
+	announceURL.RawQuery = query.Encode()
+
+	return announceURL.String(), nil
+}
+
+// buildScrapeURL derives the scrape url of the tracker from its announce url, by replacing `announce` at the start of
+// the last path segment with `scrape`, which is the convention trackers follow for scrapes.
+//
+// It returns the scrape url for the info hash, or an error if the announce url does not follow the convention, in
+// which case the tracker does not support scrapes.
+func buildScrapeURL(url *url.URL, infoHash [20]byte) (string, error) {
+	i := strings.LastIndex(url.Path, "/")
+	if i < 0 || !strings.HasPrefix(url.Path[i+1:], "announce") {
+		return "", fmt.Errorf("Tracker %s does not support scrapes", url)
+	}
+
+	scrapeURL := *url
+	scrapeURL.Path = url.Path[:i+1] + "scrape" + strings.TrimPrefix(url.Path[i+1:], "announce")
+	scrapeURL.RawPath = ""
+
+	query := url.Query()
+	query.Set("info_hash", string(infoHash[:]))
+	scrapeURL.RawQuery = query.Encode()
+
+	return scrapeURL.String(), nil
+}
+
+// parseRetryIn parses the `retry in` field of a failed announce as specified in BEP 31. It is either the number of
+// minutes to wait before retrying, or the string "never".
+//
+// It returns the time to wait, RetryNever if the tracker should not be retried, or zero if no hint was given.
+func parseRetryIn(retryIn interface{}) time.Duration {
+	switch v := retryIn.(type) {
+	case int:
+		if v > 0 {
+			return time.Duration(v) * time.Minute
+		}
+	case string:
+		if v == "never" {
+			return RetryNever
+		}
+	}
 
-	return url.String(), nil
+	return 0
 }
@@ -0,0 +1,264 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+	"github.com/anthony/BT/proxy"
+)
+
+// Manager keeps a single Tracker for each announce url, so that tracker health is shared between announces,
+// and persists the health and tracker id of every tracker to a state file so that dead trackers are remembered
+// and tracker ids are echoed back between runs.
+type Manager struct {
+	statePath string
+	http      *HTTPClient
+	dialer    proxy.Dialer
+
+	mu       sync.Mutex
+	trackers map[string]*Tracker
+}
+
+// Struct for decoding the persisted tracker health. The state file is a bencoded dictionary of urls to health.
+type persistedTrackers struct {
+	Trackers map[string]persistedHealth `mapstructure:"trackers"`
+}
+
+type persistedHealth struct {
+	Successes           int    `mapstructure:"successes"`
+	Failures            int    `mapstructure:"failures"`
+	ConsecutiveFailures int    `mapstructure:"consecutive_failures"`
+	LatencyMs           int    `mapstructure:"latency_ms"`
+	LastError           string `mapstructure:"last_error"`
+	LastAnnounce        int    `mapstructure:"last_announce"`
+	RetryAt             int    `mapstructure:"retry_at"`
+	NeverUntil          int    `mapstructure:"never_until"`
+	TrackerId           string `mapstructure:"tracker_id"`
+}
+
+// NewManager creates a tracker manager whose HTTP trackers share a client built from httpCfg, and whose trackers are
+// all connected to through the dialer, restoring tracker health from the state file if a path is given. A missing
+// state file is not an error, since it is created on the first save. A nil dialer connects directly.
+//
+// It returns the manager, or an error if the state file exists but could not be read.
+func NewManager(statePath string, httpCfg HTTPConfig, dialer proxy.Dialer) (*Manager, error) {
+	m := &Manager{
+		statePath: statePath,
+		http:      NewHTTPClient(httpCfg, dialer),
+		dialer:    dialer,
+		trackers:  make(map[string]*Tracker),
+	}
+
+	if statePath == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading tracker state: %w", err)
+	}
+
+	var state persistedTrackers
+	if err := bencode.Decode(data, &state); err != nil {
+		return nil, fmt.Errorf("Error decoding tracker state: %w", err)
+	}
+
+	for trackerUrl, persisted := range state.Trackers {
+		t, err := NewTracker(trackerUrl, m.http, m.dialer)
+		if err != nil {
+			continue
+		}
+
+		t.trackerId = persisted.TrackerId
+		if persisted.NeverUntil != 0 {
+			t.neverUntil = time.Unix(int64(persisted.NeverUntil), 0)
+		}
+		t.health = Health{
+			Successes:           persisted.Successes,
+			Failures:            persisted.Failures,
+			ConsecutiveFailures: persisted.ConsecutiveFailures,
+			Latency:             time.Duration(persisted.LatencyMs) * time.Millisecond,
+			LastError:           persisted.LastError,
+		}
+		if persisted.LastAnnounce != 0 {
+			t.health.LastAnnounce = time.Unix(int64(persisted.LastAnnounce), 0)
+		}
+		if persisted.RetryAt != 0 {
+			t.health.RetryAt = time.Unix(int64(persisted.RetryAt), 0)
+		}
+
+		m.trackers[trackerUrl] = t
+	}
+
+	return m, nil
+}
+
+// Tracker returns the tracker for the given announce url, creating it if it does not exist yet.
+//
+// It returns an error if the url is invalid.
+func (m *Manager) Tracker(trackerUrl string) (*Tracker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.trackers[trackerUrl]; ok {
+		return t, nil
+	}
+
+	t, err := NewTracker(trackerUrl, m.http, m.dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	m.trackers[trackerUrl] = t
+
+	return t, nil
+}
+
+// AnnounceTiers announces to the given tiers of trackers as specified in BEP 12. Tiers are announced to
+// concurrently, and within a tier the trackers are tried from healthiest to least healthy until one succeeds.
+// Trackers that are backing off are skipped.
+//
+// It returns the peers returned by all the trackers that were announced to successfully.
+func (m *Manager) AnnounceTiers(tiers [][]string, infoHash [20]byte, peerId [20]byte, port int) []net.TCPAddr {
+	var peerAddrs []net.TCPAddr
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+
+	wg.Add(len(tiers))
+	for _, tier := range tiers {
+		go func() {
+			defer wg.Done()
+
+			for _, t := range m.rankTier(tier) {
+				result, err := t.Announce(infoHash, peerId, port)
+				if err != nil {
+					continue
+				}
+
+				mut.Lock()
+				peerAddrs = append(peerAddrs, result.Peers...)
+				mut.Unlock()
+
+				return
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return peerAddrs
+}
+
+// Status returns a snapshot of the health of every tracker, sorted by url.
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	trackers := make([]*Tracker, 0, len(m.trackers))
+	for _, t := range m.trackers {
+		trackers = append(trackers, t)
+	}
+	m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(trackers))
+	for _, t := range trackers {
+		statuses = append(statuses, t.Status())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Url < statuses[j].Url
+	})
+
+	return statuses
+}
+
+// Save writes the health of every tracker to the state file. The file is written to a temporary file first
+// and then renamed, so a crash while saving does not corrupt the previous state.
+//
+// It returns an error if the state could not be written.
+func (m *Manager) Save() error {
+	if m.statePath == "" {
+		return nil
+	}
+
+	trackers := map[string]interface{}{}
+	for _, status := range m.Status() {
+		health := status.Health
+		persisted := map[string]interface{}{
+			"successes":            health.Successes,
+			"failures":             health.Failures,
+			"consecutive_failures": health.ConsecutiveFailures,
+			"latency_ms":           int(health.Latency.Milliseconds()),
+			"last_error":           health.LastError,
+		}
+		if !health.LastAnnounce.IsZero() {
+			persisted["last_announce"] = int(health.LastAnnounce.Unix())
+		}
+		if !health.RetryAt.IsZero() {
+			persisted["retry_at"] = int(health.RetryAt.Unix())
+		}
+		if status.TrackerId != "" {
+			persisted["tracker_id"] = status.TrackerId
+		}
+		if status.Never {
+			persisted["never_until"] = int(status.NeverUntil.Unix())
+		}
+
+		trackers[status.Url] = persisted
+	}
+
+	data, err := bencode.Encode(map[string]interface{}{"trackers": trackers})
+	if err != nil {
+		return fmt.Errorf("Error encoding tracker state: %w", err)
+	}
+
+	tmpPath := m.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("Error writing tracker state: %w", err)
+	}
+
+	return os.Rename(tmpPath, m.statePath)
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// rankTier returns the trackers of a tier that are not backing off, sorted from healthiest to least healthy.
+// Trackers with equal scores keep the order of the tier, as specified in BEP 12.
+func (m *Manager) rankTier(tier []string) []*Tracker {
+	type rankedTracker struct {
+		tracker *Tracker
+		score   float64
+	}
+
+	var ranked []rankedTracker
+	for _, trackerUrl := range tier {
+		t, err := m.Tracker(trackerUrl)
+		if err != nil {
+			continue
+		}
+
+		status := t.Status()
+		if !status.Ready {
+			continue
+		}
+
+		ranked = append(ranked, rankedTracker{tracker: t, score: status.Health.Score()})
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].score > ranked[j].score
+	})
+
+	trackers := make([]*Tracker, len(ranked))
+	for i, r := range ranked {
+		trackers[i] = r.tracker
+	}
+
+	return trackers
+}
@@ -0,0 +1,167 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+)
+
+func TestBackoff(t *testing.T) {
+	for failures := 1; failures < 40; failures++ {
+		delay := backoff(failures)
+		expected := backoffMax
+		if failures < 12 {
+			expected = min(backoffBase<<(failures-1), backoffMax)
+		}
+
+		if delay < expected/2 || delay > expected {
+			t.Errorf("Expected backoff after %d failures between %s and %s, got %s", failures, expected/2, expected, delay)
+		}
+	}
+}
+
+func TestAnnounceTiersSkipsFailingTrackers(t *testing.T) {
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if r.URL.Path == "/dead" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer srv.Close()
+
+	statePath := filepath.Join(t.TempDir(), "trackers")
+	manager, err := NewManager(statePath, DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating manager: %v", err)
+	}
+
+	tier := []string{srv.URL + "/dead", srv.URL + "/alive"}
+	peers := manager.AnnounceTiers([][]string{tier}, [20]byte{1}, [20]byte{2}, 6881)
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("Expected peer 127.0.0.1:6881, got %v", peers)
+	}
+
+	// The dead tracker is backing off, so the second announce should go straight to the working tracker
+	manager.AnnounceTiers([][]string{tier}, [20]byte{1}, [20]byte{2}, 6881)
+	if requests["/dead"] != 1 {
+		t.Errorf("Expected the dead tracker to be announced to once, got %d", requests["/dead"])
+	}
+
+	if err := manager.Save(); err != nil {
+		t.Fatalf("Unexpected error saving state: %v", err)
+	}
+
+	restored, err := NewManager(statePath, DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error restoring manager: %v", err)
+	}
+
+	for _, status := range restored.Status() {
+		dead := status.Url == tier[0]
+		if status.Working == dead {
+			t.Errorf("Expected tracker %s working to be %v", status.Url, !dead)
+		}
+
+		if dead && (status.Ready || !status.Health.RetryAt.After(time.Now())) {
+			t.Errorf("Expected restored dead tracker %s to still be backing off", status.Url)
+		}
+	}
+}
+
+func TestAnnounceTiersFallsBackWithinTier(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/first":
+			w.Write([]byte("d14:failure reason9:overloade"))
+		case "/second":
+			w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+		case "/other":
+			w.Write([]byte("d8:intervali1800e5:peers6:\x7f\x00\x00\x02\x1a\xe1e"))
+		}
+	}))
+	defer srv.Close()
+
+	manager, err := NewManager("", DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating manager: %v", err)
+	}
+
+	// The tier falls back to its second tracker, and the trackers after it are not used
+	tiers := [][]string{{srv.URL + "/first", srv.URL + "/second", srv.URL + "/unused"}}
+	peers := manager.AnnounceTiers(tiers, [20]byte{1}, [20]byte{2}, 6881)
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:6881" {
+		t.Errorf("Expected peer 127.0.0.1:6881 from the second tracker, got %v", peers)
+	}
+	if len(requests) != 2 || requests[0] != "/first" || requests[1] != "/second" {
+		t.Errorf("Expected the first tracker to be tried before the second, got %v", requests)
+	}
+
+	// The failing tracker is backing off, so only the tracker that answered is announced to
+	requests = nil
+	tiers = append(tiers, []string{srv.URL + "/other"})
+	peers = manager.AnnounceTiers(tiers, [20]byte{1}, [20]byte{2}, 6881)
+	if len(peers) != 2 || slices.Contains(requests, "/first") {
+		t.Errorf("Expected peers from both tiers without the failing tracker, got %v from %v", peers, requests)
+	}
+}
+
+func TestNeverRetriedTrackersExpire(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason12:unregistered8:retry in5:nevere"))
+	}))
+	defer srv.Close()
+
+	statePath := filepath.Join(t.TempDir(), "trackers")
+	manager, err := NewManager(statePath, DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating manager: %v", err)
+	}
+
+	manager.AnnounceTiers([][]string{{srv.URL}}, [20]byte{1}, [20]byte{2}, 6881)
+	if err := manager.Save(); err != nil {
+		t.Fatalf("Unexpected error saving state: %v", err)
+	}
+
+	restored, err := NewManager(statePath, DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error restoring manager: %v", err)
+	}
+	status := restored.Status()
+	if len(status) != 1 || !status[0].Never || status[0].Ready || !status[0].NeverUntil.After(time.Now().Add(neverExpiry-time.Minute)) {
+		t.Fatalf("Expected restored tracker to not be retried until the expiry, got %+v", status)
+	}
+
+	// Once the expiry has passed, the tracker is announced to again
+	data, _ := bencode.Encode(map[string]interface{}{
+		"trackers": map[string]interface{}{
+			srv.URL: map[string]interface{}{"never_until": int(time.Now().Add(-time.Minute).Unix())},
+		},
+	})
+	if err := os.WriteFile(statePath, data, 0644); err != nil {
+		t.Fatalf("Unexpected error writing state: %v", err)
+	}
+
+	expired, err := NewManager(statePath, DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error restoring manager: %v", err)
+	}
+	if status := expired.Status(); len(status) != 1 || status[0].Never || !status[0].Ready {
+		t.Errorf("Expected expired tracker to be ready, got %+v", status)
+	}
+}
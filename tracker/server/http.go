@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// ServeHTTPListener serves HTTP announces and scrapes on the given listener until the server is closed.
+//
+// It returns nil once the server is closed, otherwise it returns the error that stopped the listener. If the server is
+// already closed, the listener is closed straight away.
+func (s *Server) ServeHTTPListener(listener net.Listener) error {
+	httpServer := &http.Server{Handler: s}
+
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	default:
+	}
+	s.httpServer = httpServer
+	s.mu.Unlock()
+
+	err := httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// ServeHTTP routes HTTP tracker requests to the announce and scrape handlers.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		s.handleHTTPAnnounce(w, r)
+	case "/scrape":
+		s.handleHTTPScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleHTTPAnnounce handles an HTTP announce as specified in BEP 3. Peers are returned in the compact format
+// specified in BEP 23 when the client asks for it, with IPv6 peers in `peers6` as specified in BEP 7.
+func (s *Server) handleHTTPAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	req, err := parseHTTPAnnounce(query)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	// The address the request came from takes priority over the address the client claims to have
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, "Invalid remote address")
+		return
+	}
+
+	remoteIP := net.ParseIP(host)
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		req.ipv4 = ip4
+	} else {
+		req.ipv6 = remoteIP
+	}
+
+	peers, stats, err := s.announce(req)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	resp := map[string]interface{}{
+		"interval":     int(s.cfg.Interval.Seconds()),
+		"min interval": int(s.cfg.MinInterval.Seconds()),
+		"complete":     stats.Complete,
+		"incomplete":   stats.Incomplete,
+	}
+
+	if query.Get("compact") == "1" {
+		var peersV4, peersV6 []byte
+		for _, peer := range peers {
+			if peer.IPv4 != nil {
+				peersV4 = appendCompactPeer(peersV4, peer.IPv4.To4(), peer.Port)
+			}
+			if peer.IPv6 != nil {
+				peersV6 = appendCompactPeer(peersV6, peer.IPv6.To16(), peer.Port)
+			}
+		}
+
+		resp["peers"] = string(peersV4)
+		if len(peersV6) > 0 {
+			resp["peers6"] = string(peersV6)
+		}
+	} else {
+		peerList := []interface{}{}
+		for _, peer := range peers {
+			for _, ip := range []net.IP{peer.IPv4, peer.IPv6} {
+				if ip == nil {
+					continue
+				}
+
+				peerDict := map[string]interface{}{
+					"ip":   ip.String(),
+					"port": peer.Port,
+				}
+				if query.Get("no_peer_id") != "1" {
+					peerDict["peer id"] = string(peer.Id[:])
+				}
+
+				peerList = append(peerList, peerDict)
+			}
+		}
+
+		resp["peers"] = peerList
+	}
+
+	writeBencoded(w, resp)
+}
+
+// handleHTTPScrape handles an HTTP scrape, returning the statistics of each requested torrent.
+// If no info hash is given, the statistics of every tracked torrent are returned.
+func (s *Server) handleHTTPScrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := r.URL.Query()["info_hash"]
+
+	if len(infoHashes) == 0 {
+		s.mu.Lock()
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, string(infoHash[:]))
+		}
+		s.mu.Unlock()
+	}
+
+	files := map[string]interface{}{}
+	for _, hash := range infoHashes {
+		if len(hash) != 20 {
+			writeFailure(w, "Invalid info_hash")
+			return
+		}
+
+		stats, err := s.scrape([20]byte([]byte(hash)))
+		if err != nil {
+			continue
+		}
+
+		files[hash] = map[string]interface{}{
+			"complete":   stats.Complete,
+			"incomplete": stats.Incomplete,
+			"downloaded": stats.Downloaded,
+		}
+	}
+
+	writeBencoded(w, map[string]interface{}{"files": files})
+}
+
+/////////////////////////////// Helper Functions /////////////////////////////////
+
+// parseHTTPAnnounce parses the query parameters of an HTTP announce as specified in BEP 3,
+// along with the `ipv4` and `ipv6` parameters specified in BEP 7.
+//
+// It returns the announce request, or an error if a required parameter is missing or invalid.
+func parseHTTPAnnounce(query url.Values) (announceRequest, error) {
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != 20 {
+		return announceRequest{}, fmt.Errorf("Invalid info_hash")
+	}
+
+	peerId := query.Get("peer_id")
+	if len(peerId) != 20 {
+		return announceRequest{}, fmt.Errorf("Invalid peer_id")
+	}
+
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return announceRequest{}, fmt.Errorf("Invalid port")
+	}
+
+	left, err := strconv.Atoi(query.Get("left"))
+	if err != nil || left < 0 {
+		return announceRequest{}, fmt.Errorf("Invalid left")
+	}
+
+	numWant := -1
+	if query.Has("numwant") {
+		numWant, err = strconv.Atoi(query.Get("numwant"))
+		if err != nil {
+			return announceRequest{}, fmt.Errorf("Invalid numwant")
+		}
+	}
+
+	event := query.Get("event")
+	switch event {
+	case eventNone, eventStarted, eventCompleted, eventStopped:
+	default:
+		return announceRequest{}, fmt.Errorf("Invalid event")
+	}
+
+	req := announceRequest{
+		infoHash: [20]byte([]byte(infoHash)),
+		peerId:   [20]byte([]byte(peerId)),
+		port:     port,
+		left:     left,
+		event:    event,
+		numWant:  numWant,
+	}
+
+	if ip := net.ParseIP(query.Get("ipv4")); ip != nil && ip.To4() != nil {
+		req.ipv4 = ip.To4()
+	}
+	if ip := net.ParseIP(query.Get("ipv6")); ip != nil && ip.To4() == nil {
+		req.ipv6 = ip
+	}
+
+	return req, nil
+}
+
+// appendCompactPeer appends the peer to a compact peer list, where each peer is the IP address followed by a 2 byte port.
+func appendCompactPeer(peers []byte, ip net.IP, port int) []byte {
+	peers = append(peers, ip...)
+	return binary.BigEndian.AppendUint16(peers, uint16(port))
+}
+
+// writeFailure writes a bencoded failure reason as specified in BEP 3.
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencoded(w, map[string]interface{}{"failure reason": reason})
+}
+
+// writeBencoded writes the bencoded response to the client.
+func writeBencoded(w http.ResponseWriter, resp map[string]interface{}) {
+	body, err := bencode.Encode(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
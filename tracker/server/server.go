@@ -0,0 +1,364 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/tracker"
+)
+
+// Default announce parameters sent to clients.
+const (
+	DefaultInterval    = 30 * time.Minute
+	DefaultMinInterval = 5 * time.Minute
+	defaultNumWant     = 50
+	maxNumWant         = 200
+)
+
+// Events a client can send with an announce as specified in BEP 3.
+const (
+	eventNone      = ""
+	eventCompleted = "completed"
+	eventStarted   = "started"
+	eventStopped   = "stopped"
+)
+
+// Config holds the settings of a tracker server.
+type Config struct {
+	// Addresses to listen on for HTTP and UDP announces. An empty address disables that protocol.
+	HTTPAddr string
+	UDPAddr  string
+
+	// Interval clients are asked to wait between announces. Peers that have not announced
+	// within PeerTTL are removed from the swarm.
+	Interval    time.Duration
+	MinInterval time.Duration
+	PeerTTL     time.Duration
+
+	// Whitelist restricts the tracker to the given info hashes. An empty whitelist allows any torrent.
+	Whitelist [][20]byte
+
+	// StatePath is the file the swarms are persisted to. An empty path disables persistence.
+	StatePath string
+}
+
+// Server is a BitTorrent tracker serving HTTP announces as specified in BEP 3 and BEP 23,
+// and UDP announces as specified in BEP 15. IPv6 peers are supported as specified in BEP 7.
+type Server struct {
+	cfg       Config
+	whitelist map[[20]byte]bool
+	secret    [20]byte
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+
+	httpServer *http.Server
+	udpConn    net.PacketConn
+	done       chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+}
+
+// swarm holds all the peers announcing a single torrent.
+type swarm struct {
+	peers      map[[20]byte]*peerEntry
+	downloaded int
+}
+
+// peerEntry is a single peer in a swarm. A peer can be reachable over IPv4, IPv6 or both.
+type peerEntry struct {
+	Id       [20]byte
+	IPv4     net.IP
+	IPv6     net.IP
+	Port     int
+	Left     int
+	LastSeen time.Time
+}
+
+// announceRequest holds the parameters of an announce, regardless of the protocol it was received over.
+type announceRequest struct {
+	infoHash [20]byte
+	peerId   [20]byte
+	ipv4     net.IP
+	ipv6     net.IP
+	port     int
+	left     int
+	event    string
+	numWant  int
+
+	// sameFamily only selects peers with an address in the family of the announcing peer, for responses that can only
+	// hold peers of a single family
+	sameFamily bool
+}
+
+var errNotWhitelisted = errors.New("Requested torrent is not tracked by this tracker")
+
+// New creates a tracker server with the given config, restoring the swarms from the state file if one is configured.
+//
+// It returns the server, or an error if the state file could not be loaded.
+func New(cfg Config) (*Server, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.MinInterval <= 0 || cfg.MinInterval > cfg.Interval {
+		cfg.MinInterval = min(DefaultMinInterval, cfg.Interval)
+	}
+	if cfg.PeerTTL <= 0 {
+		cfg.PeerTTL = 2 * cfg.Interval
+	}
+
+	s := &Server{
+		cfg:       cfg,
+		whitelist: make(map[[20]byte]bool),
+		swarms:    make(map[[20]byte]*swarm),
+		done:      make(chan struct{}),
+	}
+
+	for _, infoHash := range cfg.Whitelist {
+		s.whitelist[infoHash] = true
+	}
+
+	if _, err := rand.Read(s.secret[:]); err != nil {
+		return nil, fmt.Errorf("Error generating connection id secret: %w", err)
+	}
+
+	if cfg.StatePath != "" {
+		if err := s.loadState(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// ListenAndServe listens on the configured HTTP and UDP addresses and serves announces until the server is closed.
+//
+// It returns nil once the server is closed, or the first error encountered by either listener.
+func (s *Server) ListenAndServe() error {
+	if s.cfg.HTTPAddr == "" && s.cfg.UDPAddr == "" {
+		return fmt.Errorf("No HTTP or UDP address to listen on")
+	}
+
+	// Both listeners are created before either is served, so that a failure to listen on one does not leave the
+	// other serving.
+	var conn net.PacketConn
+	if s.cfg.UDPAddr != "" {
+		var err error
+		conn, err = net.ListenPacket("udp", s.cfg.UDPAddr)
+		if err != nil {
+			return fmt.Errorf("Error listening on UDP address: %w", err)
+		}
+	}
+
+	var listener net.Listener
+	if s.cfg.HTTPAddr != "" {
+		var err error
+		listener, err = net.Listen("tcp", s.cfg.HTTPAddr)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return fmt.Errorf("Error listening on HTTP address: %w", err)
+		}
+	}
+
+	errs := make(chan error, 2)
+	if conn != nil {
+		go func() { errs <- s.ServeUDP(conn) }()
+	}
+	if listener != nil {
+		go func() { errs <- s.ServeHTTPListener(listener) }()
+	}
+
+	s.wg.Add(1)
+	go s.maintain()
+
+	select {
+	case err := <-errs:
+		s.Close()
+		return err
+	case <-s.done:
+		return nil
+	}
+}
+
+// Close stops all listeners and persists the swarms to the state file if one is configured.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		// The serve loops check done while holding the lock, so any listener not taken here is closed by its loop.
+		s.mu.Lock()
+		httpServer, udpConn := s.httpServer, s.udpConn
+		s.mu.Unlock()
+
+		if httpServer != nil {
+			httpServer.Close()
+		}
+		if udpConn != nil {
+			udpConn.Close()
+		}
+
+		s.wg.Wait()
+
+		if s.cfg.StatePath != "" {
+			err = s.saveState()
+		}
+	})
+
+	return err
+}
+
+// maintain periodically removes expired peers and persists the swarms until the server is closed.
+func (s *Server) maintain() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.expirePeers()
+
+			if s.cfg.StatePath != "" {
+				if err := s.saveState(); err != nil {
+					fmt.Printf("Error saving tracker state: %s\n", err)
+				}
+			}
+		}
+	}
+}
+
+// announce records the announcing peer in the torrent's swarm and selects peers to return to it.
+//
+// It returns the selected peers along with the swarm's statistics, or an error if the torrent is not whitelisted.
+func (s *Server) announce(req announceRequest) ([]peerEntry, tracker.ScrapeResult, error) {
+	if len(s.whitelist) > 0 && !s.whitelist[req.infoHash] {
+		return nil, tracker.ScrapeResult{}, errNotWhitelisted
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[req.infoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[[20]byte]*peerEntry)}
+		s.swarms[req.infoHash] = sw
+	}
+
+	if req.event == eventStopped {
+		delete(sw.peers, req.peerId)
+	} else {
+		entry, ok := sw.peers[req.peerId]
+		if !ok {
+			entry = &peerEntry{Id: req.peerId}
+			sw.peers[req.peerId] = entry
+		}
+
+		// Keep the address of the other family if the peer announced it previously
+		if req.ipv4 != nil {
+			entry.IPv4 = req.ipv4
+		}
+		if req.ipv6 != nil {
+			entry.IPv6 = req.ipv6
+		}
+
+		entry.Port = req.port
+		entry.Left = req.left
+		entry.LastSeen = time.Now()
+	}
+
+	if req.event == eventCompleted {
+		sw.downloaded++
+	}
+
+	numWant := req.numWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	// Map iteration order is random, so every announce gets a different selection of peers
+	peers := []peerEntry{}
+	for id, entry := range sw.peers {
+		if len(peers) >= numWant {
+			break
+		}
+
+		if id == req.peerId {
+			continue
+		}
+
+		// Seeds have no use for other seeds
+		if req.left == 0 && entry.Left == 0 {
+			continue
+		}
+
+		if req.sameFamily && ((req.ipv4 != nil && entry.IPv4 == nil) || (req.ipv4 == nil && entry.IPv6 == nil)) {
+			continue
+		}
+
+		peers = append(peers, *entry)
+	}
+
+	return peers, sw.stats(), nil
+}
+
+// scrape returns the statistics of the given torrent's swarm.
+func (s *Server) scrape(infoHash [20]byte) (tracker.ScrapeResult, error) {
+	if len(s.whitelist) > 0 && !s.whitelist[infoHash] {
+		return tracker.ScrapeResult{}, errNotWhitelisted
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return tracker.ScrapeResult{}, nil
+	}
+
+	return sw.stats(), nil
+}
+
+// expirePeers removes peers that have not announced within the peer TTL, along with any swarms left empty.
+func (s *Server) expirePeers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline := time.Now().Add(-s.cfg.PeerTTL)
+	for infoHash, sw := range s.swarms {
+		for id, entry := range sw.peers {
+			if entry.LastSeen.Before(deadline) {
+				delete(sw.peers, id)
+			}
+		}
+
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+// stats counts the seeders and leechers in the swarm.
+func (sw *swarm) stats() tracker.ScrapeResult {
+	result := tracker.ScrapeResult{Downloaded: sw.downloaded}
+	for _, entry := range sw.peers {
+		if entry.Left == 0 {
+			result.Complete++
+		} else {
+			result.Incomplete++
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/anthony/BT/tracker"
+)
+
+// startServer starts a tracker on random local ports and returns it along with its HTTP and UDP announce urls.
+func startServer(t *testing.T, cfg Config) (*Server, string, string) {
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on TCP: %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+
+	go srv.ServeHTTPListener(listener)
+	go srv.ServeUDP(conn)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, "http://" + listener.Addr().String() + "/announce", "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+// announceLeecher announces a peer that is still downloading, since the client always announces as a seed.
+func announceLeecher(t *testing.T, announceUrl string, infoHash [20]byte, peerId [20]byte, port int) {
+	query := url.Values{}
+	query.Set("info_hash", string(infoHash[:]))
+	query.Set("peer_id", string(peerId[:]))
+	query.Set("port", strconv.Itoa(port))
+	query.Set("left", "100")
+	query.Set("compact", "1")
+
+	resp, err := http.Get(announceUrl + "?" + query.Encode())
+	if err != nil {
+		t.Fatalf("Unexpected error announcing leecher: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	_, httpUrl, _ := startServer(t, Config{})
+	infoHash := [20]byte{1}
+
+	announceLeecher(t, httpUrl, infoHash, [20]byte{'a'}, 1111)
+
+	trk, err := tracker.NewTracker(httpUrl, tracker.NewHTTPClient(tracker.DefaultHTTPConfig(), nil), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating tracker: %v", err)
+	}
+
+	result, err := trk.Announce(infoHash, [20]byte{'b'}, 2222)
+	if err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	if len(result.Peers) != 1 || result.Peers[0].String() != "127.0.0.1:1111" {
+		t.Errorf("Expected peer 127.0.0.1:1111, got %v", result.Peers)
+	}
+
+	if result.Seeders != 1 || result.Leechers != 1 {
+		t.Errorf("Expected 1 seeder and 1 leecher, got %d and %d", result.Seeders, result.Leechers)
+	}
+
+	if result.Interval != DefaultInterval || result.MinInterval != DefaultMinInterval {
+		t.Errorf("Expected intervals %s and %s, got %s and %s", DefaultInterval, DefaultMinInterval, result.Interval, result.MinInterval)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	_, httpUrl, udpUrl := startServer(t, Config{})
+	infoHash := [20]byte{2}
+
+	announceLeecher(t, httpUrl, infoHash, [20]byte{'a'}, 1111)
+
+	peers, err := tracker.RequestPeers(udpUrl, infoHash, [20]byte{'b'}, 2222)
+	if err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	if len(peers) != 1 || peers[0].String() != "127.0.0.1:1111" {
+		t.Errorf("Expected peer 127.0.0.1:1111, got %v", peers)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	_, httpUrl, udpUrl := startServer(t, Config{})
+	infoHash := [20]byte{7}
+
+	announceLeecher(t, httpUrl, infoHash, [20]byte{'a'}, 1111)
+	if _, err := tracker.RequestPeers(httpUrl, infoHash, [20]byte{'b'}, 2222); err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	for _, announceUrl := range []string{httpUrl, udpUrl} {
+		trk, err := tracker.NewTracker(announceUrl, tracker.NewHTTPClient(tracker.DefaultHTTPConfig(), nil), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error creating tracker: %v", err)
+		}
+
+		result, err := trk.Scrape(infoHash)
+		if err != nil {
+			t.Errorf("Unexpected error scraping %s: %v", announceUrl, err)
+			continue
+		}
+
+		if result.Complete != 1 || result.Incomplete != 1 {
+			t.Errorf("Expected 1 seeder and 1 leecher scraping %s, got %d and %d", announceUrl, result.Complete, result.Incomplete)
+		}
+	}
+}
+
+func TestWhitelist(t *testing.T) {
+	_, httpUrl, udpUrl := startServer(t, Config{Whitelist: [][20]byte{{3}}})
+
+	for _, announceUrl := range []string{httpUrl, udpUrl} {
+		_, err := tracker.RequestPeers(announceUrl, [20]byte{4}, [20]byte{'a'}, 1111)
+
+		var failure *tracker.FailureError
+		if !errors.As(err, &failure) {
+			t.Errorf("Expected failure announcing unlisted torrent to %s, got %v", announceUrl, err)
+		}
+
+		_, err = tracker.RequestPeers(announceUrl, [20]byte{3}, [20]byte{'a'}, 1111)
+		if err != nil {
+			t.Errorf("Unexpected error announcing listed torrent to %s: %v", announceUrl, err)
+		}
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state")
+	infoHash := [20]byte{5}
+
+	srv, httpUrl, _ := startServer(t, Config{StatePath: statePath})
+	announceLeecher(t, httpUrl, infoHash, [20]byte{'a'}, 1111)
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Unexpected error closing server: %v", err)
+	}
+
+	restored, err := New(Config{StatePath: statePath})
+	if err != nil {
+		t.Fatalf("Unexpected error restoring server: %v", err)
+	}
+
+	stats, err := restored.scrape(infoHash)
+	if err != nil {
+		t.Fatalf("Unexpected error scraping: %v", err)
+	}
+
+	if stats.Incomplete != 1 {
+		t.Errorf("Expected 1 leecher after restoring state, got %d", stats.Incomplete)
+	}
+}
+
+func TestServeAfterClose(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %v", err)
+	}
+	srv.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on UDP: %v", err)
+	}
+
+	if err := srv.ServeUDP(conn); err != nil {
+		t.Errorf("Expected no error serving UDP on a closed server, got %v", err)
+	}
+
+	if _, err := conn.WriteTo([]byte{0}, conn.LocalAddr()); err == nil {
+		t.Errorf("Expected UDP connection to be closed when served on a closed server")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening on TCP: %v", err)
+	}
+
+	if err := srv.ServeHTTPListener(listener); err != nil {
+		t.Errorf("Expected no error serving HTTP on a closed server, got %v", err)
+	}
+
+	if _, err := listener.Accept(); err == nil {
+		t.Errorf("Expected HTTP listener to be closed when served on a closed server")
+	}
+}
+
+func TestUDPAnnounceFiltersFamilyBeforeNumWant(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %v", err)
+	}
+
+	// A swarm of mostly IPv6 peers, with only a couple of IPv4 peers
+	infoHash := [20]byte{6}
+	for i := range 20 {
+		req := announceRequest{infoHash: infoHash, peerId: [20]byte{byte(i)}, port: 1000 + i, left: 1}
+		if i < 2 {
+			req.ipv4 = net.IPv4(10, 0, 0, byte(i))
+		} else {
+			req.ipv6 = net.ParseIP("2001:db8::" + strconv.Itoa(i))
+		}
+
+		if _, _, err := srv.announce(req); err != nil {
+			t.Fatalf("Unexpected error announcing: %v", err)
+		}
+	}
+
+	peers, _, err := srv.announce(announceRequest{
+		infoHash:   infoHash,
+		peerId:     [20]byte{'a'},
+		ipv4:       net.IPv4(10, 0, 0, 100),
+		left:       1,
+		numWant:    2,
+		sameFamily: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error announcing: %v", err)
+	}
+
+	if len(peers) != 2 {
+		t.Fatalf("Expected both IPv4 peers for an IPv4 announce, got %d peers", len(peers))
+	}
+
+	for _, peer := range peers {
+		if peer.IPv4 == nil {
+			t.Errorf("Expected only IPv4 peers, got %v", peer)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/anthony/BT/bencode"
+)
+
+// Struct for decoding the persisted swarms. The state file is a bencoded dictionary of info hashes to swarms.
+type persistedState struct {
+	Torrents map[string]persistedSwarm `mapstructure:"torrents"`
+}
+
+type persistedSwarm struct {
+	Downloaded int             `mapstructure:"downloaded"`
+	Peers      []persistedPeer `mapstructure:"peers"`
+}
+
+type persistedPeer struct {
+	Id       string `mapstructure:"id"`
+	IPv4     string `mapstructure:"ipv4"`
+	IPv6     string `mapstructure:"ipv6"`
+	Port     int    `mapstructure:"port"`
+	Left     int    `mapstructure:"left"`
+	LastSeen int    `mapstructure:"last_seen"`
+}
+
+// saveState writes the swarms to the state file. The file is written to a temporary file first and then renamed,
+// so a crash while saving does not corrupt the previous state.
+//
+// It returns an error if the state could not be written.
+func (s *Server) saveState() error {
+	s.mu.Lock()
+	torrents := map[string]interface{}{}
+	for infoHash, sw := range s.swarms {
+		peers := []interface{}{}
+		for _, entry := range sw.peers {
+			peer := map[string]interface{}{
+				"id":        string(entry.Id[:]),
+				"port":      entry.Port,
+				"left":      entry.Left,
+				"last_seen": int(entry.LastSeen.Unix()),
+			}
+			if entry.IPv4 != nil {
+				peer["ipv4"] = entry.IPv4.String()
+			}
+			if entry.IPv6 != nil {
+				peer["ipv6"] = entry.IPv6.String()
+			}
+
+			peers = append(peers, peer)
+		}
+
+		torrents[string(infoHash[:])] = map[string]interface{}{
+			"downloaded": sw.downloaded,
+			"peers":      peers,
+		}
+	}
+	s.mu.Unlock()
+
+	data, err := bencode.Encode(map[string]interface{}{"torrents": torrents})
+	if err != nil {
+		return fmt.Errorf("Error encoding tracker state: %w", err)
+	}
+
+	tmpPath := s.cfg.StatePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("Error writing tracker state: %w", err)
+	}
+
+	return os.Rename(tmpPath, s.cfg.StatePath)
+}
+
+// loadState restores the swarms from the state file, skipping peers that have already expired.
+// A missing state file is not an error, since it is created on the first save.
+//
+// It returns an error if the state file exists but could not be read or decoded.
+func (s *Server) loadState() error {
+	data, err := os.ReadFile(s.cfg.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading tracker state: %w", err)
+	}
+
+	var state persistedState
+	if err := bencode.Decode(data, &state); err != nil {
+		return fmt.Errorf("Error decoding tracker state: %w", err)
+	}
+
+	deadline := time.Now().Add(-s.cfg.PeerTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, persisted := range state.Torrents {
+		if len(infoHash) != 20 {
+			continue
+		}
+
+		sw := &swarm{
+			peers:      make(map[[20]byte]*peerEntry),
+			downloaded: persisted.Downloaded,
+		}
+
+		for _, peer := range persisted.Peers {
+			lastSeen := time.Unix(int64(peer.LastSeen), 0)
+			if len(peer.Id) != 20 || lastSeen.Before(deadline) {
+				continue
+			}
+
+			entry := &peerEntry{
+				Id:       [20]byte([]byte(peer.Id)),
+				IPv4:     net.ParseIP(peer.IPv4).To4(),
+				IPv6:     net.ParseIP(peer.IPv6),
+				Port:     peer.Port,
+				Left:     peer.Left,
+				LastSeen: lastSeen,
+			}
+			sw.peers[entry.Id] = entry
+		}
+
+		s.swarms[[20]byte([]byte(infoHash))] = sw
+	}
+
+	return nil
+}
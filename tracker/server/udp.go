@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// These constants are based on the specification in BEP 15:
+const protocolId uint64 = 0x41727101980
+const connectAction uint32 = 0
+const announceAction uint32 = 1
+const scrapeAction uint32 = 2
+const errorAction uint32 = 3
+
+// Connection ids are valid for two minutes as specified in BEP 15. They are derived from the client's address and the
+// current time window, so the server does not need to remember which ids it handed out.
+const connectionIdWindow = time.Minute
+
+// Maximum number of info hashes in a single UDP scrape, which keeps the response within a single packet.
+const maxScrapeHashes = 74
+
+// ServeUDP serves UDP announces and scrapes as specified in BEP 15 on the given connection until the server is closed.
+//
+// It returns nil once the server is closed, otherwise it returns the error that stopped the connection. If the server
+// is already closed, the connection is closed straight away.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	s.udpConn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		resp := s.handleUDPPacket(buf[:n], udpAddr)
+		if resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// handleUDPPacket handles a single UDP tracker request.
+//
+// It returns the response to send to the client, or nil if the packet should be ignored.
+func (s *Server) handleUDPPacket(packet []byte, addr *net.UDPAddr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connectionId := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == connectAction {
+		if connectionId != protocolId {
+			return nil
+		}
+
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], connectAction)
+		binary.BigEndian.PutUint32(resp[4:8], transactionId)
+		binary.BigEndian.PutUint64(resp[8:16], s.connectionId(addr, time.Now()))
+
+		return resp
+	}
+
+	if !s.validConnectionId(connectionId, addr) {
+		return udpError(transactionId, "Invalid connection id")
+	}
+
+	switch action {
+	case announceAction:
+		return s.handleUDPAnnounce(packet, addr, transactionId)
+	case scrapeAction:
+		return s.handleUDPScrape(packet, transactionId)
+	default:
+		return udpError(transactionId, "Unknown action")
+	}
+}
+
+// handleUDPAnnounce handles a UDP announce as specified in BEP 15. Clients connecting over IPv4 receive 6 byte
+// peer entries and clients connecting over IPv6 receive 18 byte peer entries.
+func (s *Server) handleUDPAnnounce(packet []byte, addr *net.UDPAddr, transactionId uint32) []byte {
+	// Any BEP 41 options after the fixed size request are ignored
+	if len(packet) < 98 {
+		return udpError(transactionId, "Invalid announce request")
+	}
+
+	req := announceRequest{
+		infoHash: [20]byte(packet[16:36]),
+		peerId:   [20]byte(packet[36:56]),
+		left:     int(binary.BigEndian.Uint64(packet[64:72])),
+		numWant:  int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+		port:     int(binary.BigEndian.Uint16(packet[96:98])),
+
+		sameFamily: true,
+	}
+
+	switch binary.BigEndian.Uint32(packet[80:84]) {
+	case 1:
+		req.event = eventCompleted
+	case 2:
+		req.event = eventStarted
+	case 3:
+		req.event = eventStopped
+	}
+
+	ipv4 := addr.IP.To4()
+	if ipv4 != nil {
+		req.ipv4 = ipv4
+	} else {
+		req.ipv6 = addr.IP
+	}
+
+	peers, stats, err := s.announce(req)
+	if err != nil {
+		return udpError(transactionId, err.Error())
+	}
+
+	resp := make([]byte, 20)
+	binary.BigEndian.PutUint32(resp[0:4], announceAction)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+	binary.BigEndian.PutUint32(resp[8:12], uint32(s.cfg.Interval.Seconds()))
+	binary.BigEndian.PutUint32(resp[12:16], uint32(stats.Incomplete))
+	binary.BigEndian.PutUint32(resp[16:20], uint32(stats.Complete))
+
+	for _, peer := range peers {
+		if ipv4 != nil && peer.IPv4 != nil {
+			resp = appendCompactPeer(resp, peer.IPv4.To4(), peer.Port)
+		} else if ipv4 == nil && peer.IPv6 != nil {
+			resp = appendCompactPeer(resp, peer.IPv6.To16(), peer.Port)
+		}
+	}
+
+	return resp
+}
+
+// handleUDPScrape handles a UDP scrape as specified in BEP 15.
+func (s *Server) handleUDPScrape(packet []byte, transactionId uint32) []byte {
+	hashes := packet[16:]
+	if len(hashes) == 0 || len(hashes)%20 != 0 || len(hashes)/20 > maxScrapeHashes {
+		return udpError(transactionId, "Invalid scrape request")
+	}
+
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp[0:4], scrapeAction)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+
+	for i := 0; i < len(hashes); i += 20 {
+		stats, err := s.scrape([20]byte(hashes[i : i+20]))
+		if err != nil {
+			return udpError(transactionId, err.Error())
+		}
+
+		resp = binary.BigEndian.AppendUint32(resp, uint32(stats.Complete))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(stats.Downloaded))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(stats.Incomplete))
+	}
+
+	return resp
+}
+
+/////////////////////////////// Helper Functions /////////////////////////////////
+
+// connectionId derives the connection id for the given address in the time window containing t.
+func (s *Server) connectionId(addr *net.UDPAddr, t time.Time) uint64 {
+	window := uint64(t.UnixNano() / int64(connectionIdWindow))
+
+	mac := hmac.New(sha1.New, s.secret[:])
+	mac.Write(addr.IP.To16())
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(addr.Port)))
+	mac.Write(binary.BigEndian.AppendUint64(nil, window))
+
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validConnectionId checks the connection id was handed out to the address in the current or previous time window.
+func (s *Server) validConnectionId(connectionId uint64, addr *net.UDPAddr) bool {
+	now := time.Now()
+	return connectionId == s.connectionId(addr, now) || connectionId == s.connectionId(addr, now.Add(-connectionIdWindow))
+}
+
+// udpError builds an error response with the given message as specified in BEP 15.
+func udpError(transactionId uint32, msg string) []byte {
+	resp := make([]byte, 8, 8+len(msg))
+	binary.BigEndian.PutUint32(resp[0:4], errorAction)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+
+	return append(resp, msg...)
+}
@@ -1,29 +1,277 @@
 package tracker
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
-	"os"
+	"sync"
+	"time"
+
+	"github.com/anthony/BT/proxy"
+)
+
+// Sizes of a single peer entry in a compact peer list. IPv4 peers are specified in BEP 23
+// and IPv6 peers are specified in BEP 7.
+const (
+	compactPeerLenV4 = 6
+	compactPeerLenV6 = 18
 )
 
-// RequestPeers attempts to extract a list of peers from the given tracker url.
+// RetryNever is the RetryIn value of a FailureError when the tracker asked never to be retried, as specified in BEP 31.
+const RetryNever time.Duration = -1
+
+// Trackers that asked never to be retried are retried after neverExpiry, since a tracker may start tracking a torrent
+// it rejected, and a tracker that is down for good would otherwise be remembered forever.
+const neverExpiry = 7 * 24 * time.Hour
+
+// AnnounceResult contains the peers and announce parameters returned by a tracker.
+type AnnounceResult struct {
+	Peers       []net.TCPAddr
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerId   string
+	Warning     string
+	Seeders     int
+	Leechers    int
+}
+
+// ScrapeResult contains the statistics of a torrent's swarm returned by a scrape. The fields match the keys of a
+// tracker's scrape dictionary, and DHT scrapes as specified in BEP 33 estimate the same counts.
+type ScrapeResult struct {
+	// Complete is the number of peers with the whole torrent, i.e. seeders.
+	Complete int `mapstructure:"complete"`
+
+	// Incomplete is the number of peers that are still downloading, i.e. leechers.
+	Incomplete int `mapstructure:"incomplete"`
+
+	// Downloaded is the number of times the torrent was downloaded completely. DHT scrapes do not count downloads, so
+	// it is always zero for them.
+	Downloaded int `mapstructure:"downloaded"`
+}
+
+// FailureError is returned when a tracker rejects an announce with a failure reason.
+type FailureError struct {
+	Reason  string
+	RetryIn time.Duration
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("Tracker responded with failure: %s", e.Reason)
+}
+
+// Tracker keeps the state of a single tracker between announces, so that the tracker id is echoed back, the
+// tracker's minimum interval and retry hints are honoured, and failing trackers are backed off.
+type Tracker struct {
+	Url *url.URL
+
+	http   *HTTPClient
+	dialer proxy.Dialer
+
+	mu           sync.Mutex
+	trackerId    string
+	nextAnnounce time.Time
+	neverUntil   time.Time
+	health       Health
+}
+
+// NewTracker parses the given tracker url and returns a Tracker for it that announces to HTTP trackers with the
+// client and to UDP trackers through the dialer, or an error if the url is invalid. A nil dialer connects directly.
+func NewTracker(trackerUrl string, client *HTTPClient, dialer proxy.Dialer) (*Tracker, error) {
+	url, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing tracker URL: %w", err)
+	}
+
+	if dialer == nil {
+		dialer = proxy.Direct{}
+	}
+
+	return &Tracker{Url: url, http: client, dialer: dialer}, nil
+}
+
+// Announce announces ourselves to the tracker and requests a list of peers.
 // It currently supports both HTTP and UDP trackers.
 //
-// It returns a list of peer IP addresses and ports if the request is successful. Otherwise it returns an error.
-func RequestPeers(trackerUrl string, infoHash [20]byte, peerId [20]byte, port int) ([]net.TCPAddr, error) {
-	url, err := url.Parse(trackerUrl)
+// It returns the announce result if the request is successful. If the tracker responds with a failure reason,
+// it returns a *FailureError. If the tracker asked us to wait before announcing again, it returns an error without
+// contacting the tracker. If the tracker is backing off after failed announces, it returns an error without
+// contacting the tracker.
+func (t *Tracker) Announce(infoHash [20]byte, peerId [20]byte, port int) (AnnounceResult, error) {
+	t.mu.Lock()
+	trackerId := t.trackerId
+	if time.Now().Before(t.neverUntil) {
+		t.mu.Unlock()
+		return AnnounceResult{}, fmt.Errorf("Tracker %s asked never to be retried", t.Url)
+	}
+	if wait := time.Until(t.nextAnnounce); wait > 0 {
+		t.mu.Unlock()
+		return AnnounceResult{}, fmt.Errorf("Tracker %s asked to wait %s before announcing again", t.Url, wait.Round(time.Second))
+	}
+	if wait := time.Until(t.health.RetryAt); wait > 0 {
+		t.mu.Unlock()
+		return AnnounceResult{}, fmt.Errorf("Tracker %s is backing off for %s after %d failures", t.Url, wait.Round(time.Second), t.health.ConsecutiveFailures)
+	}
+	t.mu.Unlock()
+
+	start := time.Now()
+
+	var result AnnounceResult
+	var err error
+	switch t.Url.Scheme {
+	case "http", "https":
+		result, err = requestPeersFromHTTPTracker(t.http, t.Url, trackerId, infoHash, peerId, port)
+	case "udp":
+		result, err = requestPeersFromUDPTracker(t.dialer, t.Url, infoHash, peerId, port)
+	default:
+		return AnnounceResult{}, fmt.Errorf("Unrecognised tracker url scheme: %s", t.Url.Scheme)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if err != nil {
+		t.health.recordFailure(err, now)
+	} else {
+		t.health.recordSuccess(now.Sub(start), result.Warning, now)
+	}
+
+	var failure *FailureError
+	if errors.As(err, &failure) {
+		switch {
+		case failure.RetryIn == RetryNever:
+			t.neverUntil = now.Add(neverExpiry)
+		case failure.RetryIn > 0:
+			t.nextAnnounce = now.Add(failure.RetryIn)
+		}
+	}
+
 	if err != nil {
-		fmt.Println("Error parsing tracker URL:", err)
-		os.Exit(1)
+		return AnnounceResult{}, err
+	}
+
+	if result.TrackerId != "" {
+		t.trackerId = result.TrackerId
+	}
+
+	t.nextAnnounce = now.Add(result.MinInterval)
+
+	return result, nil
+}
+
+// Status returns a snapshot of the tracker's health.
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	never := now.Before(t.neverUntil)
+
+	return Status{
+		Url:        t.Url.String(),
+		Health:     t.health,
+		Working:    !never && t.health.ConsecutiveFailures == 0,
+		Ready:      !never && !now.Before(t.health.RetryAt) && !now.Before(t.nextAnnounce),
+		Never:      never,
+		NeverUntil: t.neverUntil,
+		TrackerId:  t.trackerId,
 	}
+}
 
-	switch url.Scheme {
+// Scrape requests the statistics of the info hash's swarm from the tracker. HTTP trackers are scraped at the scrape
+// url derived from the announce url, and UDP trackers with a scrape request as specified in BEP 15.
+//
+// It returns the statistics of the swarm if the request is successful. If the tracker responds with a failure
+// reason, it returns a *FailureError. Otherwise it returns any other error encountered.
+func (t *Tracker) Scrape(infoHash [20]byte) (ScrapeResult, error) {
+	switch t.Url.Scheme {
 	case "http", "https":
-		return requestPeersFromHTTPTracker(url, infoHash, peerId, port)
+		return scrapeHTTPTracker(t.http, t.Url, infoHash)
 	case "udp":
-		return requestPeersFromUDPTracker(url, infoHash, peerId, port)
+		return scrapeUDPTracker(t.dialer, t.Url, infoHash)
 	default:
-		return nil, fmt.Errorf("Unrecognised tracker url scheme: %s", url.Scheme)
+		return ScrapeResult{}, fmt.Errorf("Unrecognised tracker url scheme: %s", t.Url.Scheme)
+	}
+}
+
+// RequestPeers attempts to extract a list of peers from the given tracker url, connecting directly with the default
+// HTTP client config.
+// It currently supports both HTTP and UDP trackers.
+//
+// It returns a list of peer IP addresses and ports if the request is successful. Otherwise it returns an error.
+func RequestPeers(trackerUrl string, infoHash [20]byte, peerId [20]byte, port int) ([]net.TCPAddr, error) {
+	tracker, err := NewTracker(trackerUrl, NewHTTPClient(DefaultHTTPConfig(), nil), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tracker.Announce(infoHash, peerId, port)
+	if err != nil {
+		return nil, err
 	}
+
+	return result.Peers, nil
+}
+
+//////////////////////////////// Helper Functions /////////////////////////////////
+
+// parseCompactPeers parses a compact peer list where each peer is represented by an IP address followed by
+// a 2 byte port. The size of each entry is 6 bytes for IPv4 peers and 18 bytes for IPv6 peers.
+//
+// It returns the list of peers, or an error if the list is not a multiple of the entry size.
+func parseCompactPeers(peers []byte, entryLen int) ([]net.TCPAddr, error) {
+	if len(peers)%entryLen != 0 {
+		return nil, fmt.Errorf("Invalid compact peer list length %d for entry size %d", len(peers), entryLen)
+	}
+
+	ipLen := entryLen - 2
+	peerAddrs := make([]net.TCPAddr, 0, len(peers)/entryLen)
+	for i := 0; i < len(peers); i += entryLen {
+		ip := make(net.IP, ipLen)
+		copy(ip, peers[i:i+ipLen])
+
+		peerAddrs = append(peerAddrs, net.TCPAddr{
+			IP:   ip,
+			Port: int(binary.BigEndian.Uint16(peers[i+ipLen : i+entryLen])),
+		})
+	}
+
+	return peerAddrs, nil
+}
+
+var (
+	localIPsOnce sync.Once
+	localIPv4    net.IP
+	localIPv6    net.IP
+)
+
+// localIPs returns the public IPv4 and IPv6 addresses this host uses for outgoing connections, so that
+// they can be reported to trackers as specified in BEP 7. Either address is nil if the host has no
+// public address of that family.
+func localIPs() (net.IP, net.IP) {
+	localIPsOnce.Do(func() {
+		localIPv4 = outboundIP("udp4", "192.0.2.1:80")
+		localIPv6 = outboundIP("udp6", "[2001:db8::1]:80")
+	})
+
+	return localIPv4, localIPv6
+}
+
+// outboundIP finds the local address the kernel would route packets to the given address from.
+// Connecting a UDP socket does not send any packets, it only selects a route.
+func outboundIP(network string, addr string) net.IP {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+
+	return ip
 }
@@ -0,0 +1,218 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCompactPeers(t *testing.T) {
+	peersV4 := []byte{192, 168, 1, 2, 0x1a, 0xe1, 10, 0, 0, 1, 0x00, 0x50}
+	addrs, err := parseCompactPeers(peersV4, compactPeerLenV4)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing IPv4 peers: %v", err)
+	}
+
+	expectedV4 := []string{"192.168.1.2:6881", "10.0.0.1:80"}
+	if len(addrs) != len(expectedV4) {
+		t.Fatalf("Expected %d peers, got %d", len(expectedV4), len(addrs))
+	}
+
+	for i, addr := range addrs {
+		if addr.String() != expectedV4[i] {
+			t.Errorf("Expected peer %s, got %s", expectedV4[i], addr.String())
+		}
+	}
+
+	peersV6 := append([]byte(net.ParseIP("2001:db8::1")), 0x1a, 0xe1)
+	addrs, err = parseCompactPeers(peersV6, compactPeerLenV6)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing IPv6 peers: %v", err)
+	}
+
+	if len(addrs) != 1 || addrs[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("Expected peer [2001:db8::1]:6881, got %v", addrs)
+	}
+}
+
+func TestInvalidCompactPeers(t *testing.T) {
+	var invalidPeers = map[int][]byte{
+		compactPeerLenV4: {192, 168, 1, 2, 0x1a},          // truncated IPv4 peer
+		compactPeerLenV6: {192, 168, 1, 2, 0x1a, 0xe1, 1}, // IPv4 sized entry in IPv6 list
+	}
+
+	for entryLen, peers := range invalidPeers {
+		_, err := parseCompactPeers(peers, entryLen)
+		if err == nil {
+			t.Errorf("Expected error parsing invalid compact peers %v, but got none", peers)
+		}
+	}
+}
+
+// startUDPTracker starts a UDP tracker that answers every announce with the response, or with an error message if
+// failure is set.
+func startUDPTracker(t *testing.T, failure string) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening for UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+
+			action := binary.BigEndian.Uint32(buf[8:12])
+			resp := binary.BigEndian.AppendUint32(nil, action)
+			resp = append(resp, buf[12:16]...)
+			switch {
+			case action == connectAction:
+				resp = binary.BigEndian.AppendUint64(resp, 42)
+			case failure != "":
+				binary.BigEndian.PutUint32(resp[0:4], errorAction)
+				resp = append(resp, failure...)
+			default:
+				resp = binary.BigEndian.AppendUint32(resp, 1800) // interval
+				resp = binary.BigEndian.AppendUint32(resp, 3)    // leechers
+				resp = binary.BigEndian.AppendUint32(resp, 7)    // seeders
+				resp = append(resp, 127, 0, 0, 1, 0x1a, 0xe1)
+			}
+
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestAnnounceResponses(t *testing.T) {
+	httpTracker := func(response string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(response))
+		}))
+		t.Cleanup(srv.Close)
+
+		return srv.URL + "/announce"
+	}
+
+	var tests = []struct {
+		name      string
+		url       string
+		failure   string
+		retryIn   time.Duration
+		warning   string
+		trackerId string
+	}{
+		{
+			name:    "http failure reason",
+			url:     httpTracker("d14:failure reason12:unregisterede"),
+			failure: "unregistered",
+		},
+		{
+			name:    "http retry in minutes",
+			url:     httpTracker("d14:failure reason10:overloaded8:retry ini5ee"),
+			failure: "overloaded",
+			retryIn: 5 * time.Minute,
+		},
+		{
+			name:    "http retry never",
+			url:     httpTracker("d14:failure reason6:banned8:retry in5:nevere"),
+			failure: "banned",
+			retryIn: RetryNever,
+		},
+		{
+			name:    "http warning message",
+			url:     httpTracker("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe115:warning message8:upgradede"),
+			warning: "upgraded",
+		},
+		{
+			name:      "http tracker id",
+			url:       httpTracker("d8:intervali1800e5:peers6:\x7f\x00\x00\x01\x1a\xe110:tracker id3:abce"),
+			trackerId: "abc",
+		},
+		{
+			name:    "udp error message",
+			url:     startUDPTracker(t, "unregistered"),
+			failure: "unregistered",
+		},
+		{
+			name: "udp peers",
+			url:  startUDPTracker(t, ""),
+		},
+	}
+
+	for _, test := range tests {
+		tracker, err := NewTracker(test.url, NewHTTPClient(DefaultHTTPConfig(), nil), nil)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error creating tracker: %v", test.name, err)
+		}
+
+		result, err := tracker.Announce([20]byte{1}, [20]byte{2}, 6881)
+
+		var failure *FailureError
+		if test.failure != "" {
+			if !errors.As(err, &failure) || failure.Reason != test.failure || failure.RetryIn != test.retryIn {
+				t.Errorf("%s: Expected failure %q retrying in %s, got %v", test.name, test.failure, test.retryIn, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: Unexpected error announcing: %v", test.name, err)
+		}
+		if len(result.Peers) != 1 || result.Peers[0].String() != "127.0.0.1:6881" {
+			t.Errorf("%s: Expected peer 127.0.0.1:6881, got %v", test.name, result.Peers)
+		}
+		if result.Warning != test.warning || tracker.Status().Health.LastWarning != test.warning {
+			t.Errorf("%s: Expected warning %q, got %q", test.name, test.warning, result.Warning)
+		}
+		if result.TrackerId != test.trackerId {
+			t.Errorf("%s: Expected tracker id %q, got %q", test.name, test.trackerId, result.TrackerId)
+		}
+	}
+}
+
+func TestTrackerIdIsEchoed(t *testing.T) {
+	var trackerIds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trackerIds = append(trackerIds, r.URL.Query().Get("trackerid"))
+		w.Write([]byte("d8:intervali1800e5:peers0:10:tracker id3:abce"))
+	}))
+	defer srv.Close()
+
+	statePath := filepath.Join(t.TempDir(), "trackers")
+	manager, err := NewManager(statePath, DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating manager: %v", err)
+	}
+
+	tier := []string{srv.URL + "/announce"}
+	manager.AnnounceTiers([][]string{tier}, [20]byte{1}, [20]byte{2}, 6881)
+	manager.AnnounceTiers([][]string{tier}, [20]byte{1}, [20]byte{2}, 6881)
+
+	// The tracker id is remembered between runs as well
+	if err := manager.Save(); err != nil {
+		t.Fatalf("Unexpected error saving state: %v", err)
+	}
+	restored, err := NewManager(statePath, DefaultHTTPConfig(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error restoring manager: %v", err)
+	}
+	restored.AnnounceTiers([][]string{tier}, [20]byte{1}, [20]byte{2}, 6881)
+
+	if len(trackerIds) != 3 || trackerIds[0] != "" || trackerIds[1] != "abc" || trackerIds[2] != "abc" {
+		t.Errorf("Expected the tracker id to be echoed after the first announce, got %q", trackerIds)
+	}
+}
@@ -7,41 +7,100 @@ import (
 	"net"
 	"net/url"
 	"time"
+
+	"github.com/anthony/BT/proxy"
 )
 
 // These constants are based on the specification in BEP 15:
 const protocolId uint64 = 0x41727101980
 const connectAction uint32 = 0
 const announceAction uint32 = 1
-
-// requestPeersFromUDPTracker attempts to extract a list of peers from the given UDP tracker url
+const scrapeAction uint32 = 2
+const errorAction uint32 = 3
+
+// These constants are based on the specification in BEP 41:
+const optionEndOfOptions byte = 0x0
+const optionURLData byte = 0x2
+const maxOptionLength = 255
+
+// requestPeersFromUDPTracker attempts to extract a list of peers from the given UDP tracker url.
+// If the tracker has both IPv4 and IPv6 addresses, it announces over both so that peers of both
+// families are found, as specified in BEP 7. Through a proxy, the host of the tracker is resolved by the proxy
+// instead, so that our DNS queries do not reveal the trackers we announce to, and only one address is announced to.
 //
-// It returns a list of peer IP addresses and ports if the request is successful. Otherwise it returns an error.
-func requestPeersFromUDPTracker(url *url.URL, infoHash [20]byte, peerId [20]byte, port int) ([]net.TCPAddr, error) {
-	udpAddr, err := net.ResolveUDPAddr(url.Scheme, url.Host)
-	if err != nil {
-		return nil, fmt.Errorf("Error resolving UDP address: %s", err)
+// It returns the announce result if the request is successful. If the tracker responds with an error message,
+// it returns a *FailureError. Otherwise it returns any other error encountered.
+func requestPeersFromUDPTracker(dialer proxy.Dialer, url *url.URL, infoHash [20]byte, peerId [20]byte, port int) (AnnounceResult, error) {
+	if dialer.ResolvesRemotely() {
+		return announceToUDPTracker(dialer, "udp", url.Host, url, infoHash, peerId, port)
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	udpAddrs, err := resolveUDPTracker(url.Host)
 	if err != nil {
-		return nil, fmt.Errorf("Error dialing UDP tracker: %s", err)
+		return AnnounceResult{}, err
+	}
+
+	var result AnnounceResult
+	var lastErr error
+	announced := false
+	for _, udpAddr := range udpAddrs {
+		network := "udp4"
+		if udpAddr.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		res, err := announceToUDPTracker(dialer, network, udpAddr.String(), url, infoHash, peerId, port)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// Both families report the same swarm, so the announce parameters are taken from the first response
+		if !announced {
+			result = res
+			announced = true
+			continue
+		}
+
+		result.Peers = append(result.Peers, res.Peers...)
 	}
 
-	err = conn.SetReadBuffer(4096)
+	if !announced {
+		return AnnounceResult{}, lastErr
+	}
+
+	return result, nil
+}
+
+// announceToUDPTracker sends an announce request through the dialer to the UDP tracker at the given address on the
+// named network.
+// IPv4 trackers respond with 6 byte peer entries and IPv6 trackers respond with 18 byte peer entries, as specified in
+// BEP 15. The path and query of the tracker url are sent as URLData options, as specified in BEP 41, so that trackers
+// can authenticate announces the same way HTTP trackers do.
+//
+// It returns the announce result if the request is successful. Otherwise it returns an error.
+func announceToUDPTracker(dialer proxy.Dialer, network string, address string, url *url.URL, infoHash [20]byte, peerId [20]byte, port int) (AnnounceResult, error) {
+	conn, err := proxy.DialTimeout(dialer, network, address, 10*time.Second)
 	if err != nil {
-		return nil, fmt.Errorf("Error setting UDP read buffer: %s", err)
+		return AnnounceResult{}, fmt.Errorf("Error dialing UDP tracker: %s", err)
 	}
+	defer conn.Close()
 
 	// Initiate handshake and get connection ID
 	connectionId, err := initiateUDPHandshake(conn)
 	if err != nil {
-		return nil, err
+		return AnnounceResult{}, err
+	}
+
+	// The address of a tracker resolved by a proxy is known once it replied to the handshake
+	peerLen := compactPeerLenV4
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		peerLen = compactPeerLenV6
 	}
 
 	transactionId, err := generateTransactionId()
 	if err != nil {
-		return nil, err
+		return AnnounceResult{}, err
 	}
 
 	// This is the format of the announce request message as specified in the BEP 15:
@@ -66,45 +125,184 @@ func requestPeersFromUDPTracker(url *url.URL, infoHash [20]byte, peerId [20]byte
 	binary.BigEndian.PutUint32(announceMsg[92:96], uint32(neg1)) // num want, -1 for default
 	binary.BigEndian.PutUint16(announceMsg[96:98], uint16(port)) // port
 
+	announceMsg = append(announceMsg, buildURLDataOptions(url)...)
+
 	// Send announce request and parse response
 	_, err = conn.Write(announceMsg)
 	if err != nil {
-		fmt.Println("Error sending announce request to UDP tracker:", err)
-		return nil, err
+		return AnnounceResult{}, fmt.Errorf("Error sending announce request to UDP tracker: %s", err)
 	}
 
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
 	// The size of the response can vary depending on the number of peers returned by the tracker,
 	// so we use a large buffer and then trim it down after reading.
 	resp := make([]byte, 4096)
 	n, err := conn.Read(resp)
 	if err != nil {
-		fmt.Println("Error sending announce request to UDP tracker:", err)
-		return nil, err
+		return AnnounceResult{}, fmt.Errorf("Error reading announce response from UDP tracker: %s", err)
 	}
 
-	resp = resp[:n]
+	payload, err := parseUDPResponse(resp[:n], announceAction, transactionId)
+	if err != nil {
+		return AnnounceResult{}, err
+	}
+
+	if len(payload) < 12 {
+		return AnnounceResult{}, fmt.Errorf("Invalid announce response from UDP tracker: too short")
+	}
 
 	// The format of the announce response message is specified in the BEP 15:
-	interval := binary.BigEndian.Uint32(resp[0:4])
-	leechers := binary.BigEndian.Uint32(resp[4:8])
-	seeders := binary.BigEndian.Uint32(resp[8:12])
+	interval := binary.BigEndian.Uint32(payload[0:4])
+	leechers := binary.BigEndian.Uint32(payload[4:8])
+	seeders := binary.BigEndian.Uint32(payload[8:12])
 
-	_, _, _ = interval, leechers, seeders // Currently unused, but could be used to prioritise certain trackers in the future
+	// The rest of the response is a list of peers, where each peer is represented by an IP address and a 2 byte port
+	peers, err := parseCompactPeers(payload[12:], peerLen)
+	if err != nil {
+		return AnnounceResult{}, err
+	}
 
-	peerIPs := []net.TCPAddr{}
+	return AnnounceResult{
+		Peers:    peers,
+		Interval: time.Duration(interval) * time.Second,
+		Seeders:  int(seeders),
+		Leechers: int(leechers),
+	}, nil
+}
+
+// scrapeUDPTracker sends a scrape request for the info hash through the dialer to the UDP tracker, as specified in
+// BEP 15. The statistics of the swarm are the same over both address families, so only one address is scraped.
+//
+// It returns the statistics of the swarm if the request is successful. If the tracker responds with an error message,
+// it returns a *FailureError. Otherwise it returns any other error encountered.
+func scrapeUDPTracker(dialer proxy.Dialer, url *url.URL, infoHash [20]byte) (ScrapeResult, error) {
+	conn, err := proxy.DialTimeout(dialer, "udp", url.Host, 10*time.Second)
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("Error dialing UDP tracker: %s", err)
+	}
+	defer conn.Close()
+
+	connectionId, err := initiateUDPHandshake(conn)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	transactionId, err := generateTransactionId()
+	if err != nil {
+		return ScrapeResult{}, err
+	}
 
-	// The rest of the response is a list of peers, where each peer is represented by 6 bytes (4 for IP and 2 for port)
-	for i := 12; i < len(resp); i += 6 {
-		ip := net.IP(resp[i : i+4]).String()
-		port := int(binary.BigEndian.Uint16(resp[i+4 : i+6]))
+	// This is the format of the scrape request message as specified in the BEP 15, with a single info hash:
+	// https://www.bittorrent.org/beps/bep_0015.html#scrape
+	scrapeMsg := make([]byte, 36)
+	binary.BigEndian.PutUint64(scrapeMsg[0:8], connectionId)
+	binary.BigEndian.PutUint32(scrapeMsg[8:12], scrapeAction)
+	binary.BigEndian.PutUint32(scrapeMsg[12:16], transactionId)
+	copy(scrapeMsg[16:36], infoHash[:])
 
-		peerIPs = append(peerIPs, net.TCPAddr{
-			IP:   net.ParseIP(ip),
-			Port: port,
-		})
+	_, err = conn.Write(scrapeMsg)
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("Error sending scrape request to UDP tracker: %s", err)
 	}
 
-	return peerIPs, nil
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	// The buffer is larger than the scrape response so that error messages are not truncated
+	resp := make([]byte, 1024)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return ScrapeResult{}, fmt.Errorf("Error reading scrape response from UDP tracker: %s", err)
+	}
+
+	payload, err := parseUDPResponse(resp[:n], scrapeAction, transactionId)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	if len(payload) < 12 {
+		return ScrapeResult{}, fmt.Errorf("Invalid scrape response from UDP tracker: too short")
+	}
+
+	return ScrapeResult{
+		Complete:   int(binary.BigEndian.Uint32(payload[0:4])),
+		Downloaded: int(binary.BigEndian.Uint32(payload[4:8])),
+		Incomplete: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
+}
+
+// buildURLDataOptions encodes the path and query of the tracker url as URLData options as specified in BEP 41.
+// Each option holds at most 255 bytes, so longer urls are split across multiple options which the tracker concatenates.
+//
+// It returns the encoded options terminated by an EndOfOptions option, or nil if the url has no path or query.
+func buildURLDataOptions(url *url.URL) []byte {
+	urlData := url.EscapedPath()
+	if url.RawQuery != "" {
+		urlData += "?" + url.RawQuery
+	}
+
+	if urlData == "" || urlData == "/" {
+		return nil
+	}
+
+	var options []byte
+	for len(urlData) > 0 {
+		chunk := urlData
+		if len(chunk) > maxOptionLength {
+			chunk = chunk[:maxOptionLength]
+		}
+
+		options = append(options, optionURLData, byte(len(chunk)))
+		options = append(options, chunk...)
+		urlData = urlData[len(chunk):]
+	}
+
+	return append(options, optionEndOfOptions)
+}
+
+// resolveUDPTracker resolves the host of a UDP tracker into at most one IPv4 and one IPv6 address.
+//
+// It returns the resolved addresses, or an error if the host could not be resolved.
+func resolveUDPTracker(hostPort string) ([]*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving UDP address: %s", err)
+	}
+
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving UDP address: %s", err)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving UDP address: %s", err)
+	}
+
+	var addrV4, addrV6 *net.UDPAddr
+	for _, ip := range ips {
+		if ip.To4() != nil && addrV4 == nil {
+			addrV4 = &net.UDPAddr{IP: ip, Port: port}
+		} else if ip.To4() == nil && addrV6 == nil {
+			addrV6 = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+
+	if addrV4 == nil && addrV6 == nil {
+		return nil, fmt.Errorf("Error resolving UDP address: no addresses found for %s", host)
+	}
+
+	var addrs []*net.UDPAddr
+	if addrV6 != nil {
+		addrs = append(addrs, addrV6)
+	}
+	if addrV4 != nil {
+		addrs = append(addrs, addrV4)
+	}
+
+	return addrs, nil
 }
 
 // generateTransactionId generates a random transaction ID for use in UDP tracker requests.
@@ -131,6 +329,10 @@ func parseUDPResponse(resp []byte, wantedAction uint32, wantedTransactionId uint
 	action := binary.BigEndian.Uint32(resp[0:4])
 	transactionId := binary.BigEndian.Uint32(resp[4:8])
 
+	if transactionId == wantedTransactionId && action == errorAction {
+		return nil, &FailureError{Reason: string(resp[8:])}
+	}
+
 	if action != wantedAction {
 		return nil, fmt.Errorf("unexpected action in UDP tracker announce response")
 	}
@@ -145,7 +347,7 @@ func parseUDPResponse(resp []byte, wantedAction uint32, wantedTransactionId uint
 // initiateUDPHandshake performs the initial handshake with the UDP tracker as specified in the BEP 15.
 //
 // If the handshake is successful, it returns the connection ID provided by the tracker. Otherwise, it returns an error.
-func initiateUDPHandshake(conn *net.UDPConn) (uint64, error) {
+func initiateUDPHandshake(conn net.Conn) (uint64, error) {
 	// Generate a random transaction ID
 	transactionId, err := generateTransactionId()
 	if err != nil {
@@ -168,22 +370,23 @@ func initiateUDPHandshake(conn *net.UDPConn) (uint64, error) {
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
-	resp := make([]byte, 16)
+	// The buffer is larger than the handshake response so that error messages are not truncated
+	resp := make([]byte, 1024)
 	n, err := conn.Read(resp)
 	if err != nil {
 		return 0, err
 	}
 
+	resp, err = parseUDPResponse(resp[:n], connectAction, transactionId)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing UDP tracker handshake response: %w", err)
+	}
+
 	// The response to the handshake should be 16 bytes long, containing the action, transaction ID, and connection ID
 	if n != 16 {
 		return 0, fmt.Errorf("Invalid response length from UDP tracker: expected 16 bytes, got %d", n)
 	}
 
-	resp, err = parseUDPResponse(resp, connectAction, transactionId)
-	if err != nil {
-		return 0, fmt.Errorf("Error parsing UDP tracker handshake response: %s", err)
-	}
-
 	connectionId := binary.BigEndian.Uint64(resp[0:8])
 
 	return connectionId, nil
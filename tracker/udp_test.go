@@ -0,0 +1,50 @@
+package tracker
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBuildURLDataOptions(t *testing.T) {
+	trackerUrl, _ := url.Parse("udp://tracker.example.com:6969/announce?passkey=abc")
+	urlData := "/announce?passkey=abc"
+	expected := append([]byte{optionURLData, byte(len(urlData))}, urlData...)
+	expected = append(expected, optionEndOfOptions)
+
+	options := buildURLDataOptions(trackerUrl)
+	if !bytes.Equal(options, expected) {
+		t.Errorf("Expected options %q, got %q", expected, options)
+	}
+
+	trackerUrl, _ = url.Parse("udp://tracker.example.com:6969")
+	if options := buildURLDataOptions(trackerUrl); options != nil {
+		t.Errorf("Expected no options for url without a path, got %q", options)
+	}
+}
+
+func TestBuildLongURLDataOptions(t *testing.T) {
+	path := "/" + strings.Repeat("a", 300)
+	trackerUrl, _ := url.Parse("udp://tracker.example.com:6969" + path)
+
+	options := buildURLDataOptions(trackerUrl)
+
+	// Two URLData options (255 and 46 bytes) followed by EndOfOptions
+	if len(options) != 2+255+2+46+1 {
+		t.Fatalf("Expected %d bytes of options, got %d", 2+255+2+46+1, len(options))
+	}
+
+	if options[0] != optionURLData || options[1] != 255 || options[257] != optionURLData || options[258] != 46 {
+		t.Errorf("Invalid option headers in %q", options)
+	}
+
+	data := string(options[2:257]) + string(options[259:305])
+	if data != path {
+		t.Errorf("Expected url data %q, got %q", path, data)
+	}
+
+	if options[len(options)-1] != optionEndOfOptions {
+		t.Errorf("Expected options to end with EndOfOptions")
+	}
+}